@@ -3,33 +3,509 @@ package main
 import (
 	"balance-service/controllers"
 	"balance-service/repositories"
+	"balance-service/services"
+	"context"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const usage = `Usage:
+  main [serve]            apply pending migrations and start the HTTP server
+  main migrate up         apply all pending migrations
+  main migrate down [N]   roll back the latest N applied migrations (1 by default)
+  main migrate status     list migrations and whether they are applied
+  main reconcile [--fix]  compare user balances with their postings, --fix writes adjustments for mismatches
+  main api-keys create NAME SCOPES [SERVICE_IDS]
+                          create an API key with comma separated scopes (read, write, reports, admin)
+                          bound to comma separated service ids, the key is printed once
+  main api-keys list      list API keys
+  main api-keys revoke ID revoke the API key`
+
 func main() {
-	// Set up server
-	if err := repositories.CreateConnection(); err != nil {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+
+	db, err := repositories.CreateConnection()
+	if err != nil {
 		log.Fatal(err)
 		return
 	}
 
+	switch args[0] {
+	case "serve":
+		err = serve(db)
+	case "migrate":
+		err = migrate(db, args[1:])
+	case "reconcile":
+		err = reconcile(db, args[1:])
+	case "api-keys":
+		err = apiKeys(db, args[1:])
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+}
+
+func serve(db *sqlx.DB) error {
+	baseCurrency, err := newBaseCurrency()
+	if err != nil {
+		return err
+	}
+
+	if err := migrateUp(db, baseCurrency); err != nil {
+		return err
+	}
+
+	rates, err := newRatesProvider()
+	if err != nil {
+		return err
+	}
+
+	balanceCache, err := newBalanceCache()
+	if err != nil {
+		return err
+	}
+
+	reservationTTL, err := newReservationTTL()
+	if err != nil {
+		return err
+	}
+	reservationExpiryInterval, err := durationFromEnv("RESERVATION_EXPIRY_INTERVAL", time.Minute)
+	if err != nil {
+		return err
+	}
+
+	repos := repositories.NewPostgresRepositories(db)
+	runner := repositories.NewPostgresTransactionRunner(db)
+
+	transactionService := services.NewTransactionService(runner, balanceCache, baseCurrency, reservationTTL)
+	services.NewReservationExpirer(transactionService, repositories.NewPostgresLocker(db), reservationExpiryInterval).Start(context.Background())
+	transactionController := controllers.NewTransactionController(transactionService)
+	userController := controllers.NewUserController(services.NewUserService(repos.Users, repos.Transactions, rates, balanceCache, baseCurrency))
+	reportStorage, err := newReportStorage()
+	if err != nil {
+		return err
+	}
+	reportLinkTTL, err := durationFromEnv("REPORT_LINK_TTL", 15*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	reportService := services.NewReportService(repos.Transactions, repos.Reports, reportStorage)
+	reportJobs, err := newReportJobService(reportService, repos.ReportJobs)
+	if err != nil {
+		return err
+	}
+	reportJobs.Start(context.Background())
+	reportLinks, err := newReportLinkSigner()
+	if err != nil {
+		return err
+	}
+	reportController := controllers.NewReportController(reportService, reportJobs, reportLinks, reportLinkTTL)
+	reconciliationController := controllers.NewReconciliationController(services.NewReconciliationService(runner, repos.Ledger, repos.Reconciliations))
+	idempotency := controllers.Idempotency(services.NewIdempotencyService(repos.IdempotencyKeys))
+	apiKeyService := services.NewAPIKeyService(repos.APIKeys)
+
+	reportScheduler, err := newReportScheduler(reportService, repos.ReportRuns, repositories.NewPostgresLocker(db))
+	if err != nil {
+		return err
+	}
+	reportScheduler.Start()
+	defer reportScheduler.Stop()
+	reportSchedulerController := controllers.NewReportSchedulerController(reportScheduler, reportController)
+
 	r := gin.Default()
-	r.Static("/data", "./data")
 
 	v1 := r.Group("/v1")
-	v1.POST("/transactions/replenish", controllers.StoreReplenishmentTransaction)
-	v1.POST("/transactions/reserve", controllers.StoreReservationTransaction)
-	v1.POST("/transactions/withdraw", controllers.StoreWithdrawalTransaction)
 
-	v1.GET("/users", controllers.GetUserBalance)
+	// Keys are checked before idempotency, so rejected requests don't claim idempotency keys
+	transactions := v1.Group("/transactions", controllers.APIKey(apiKeyService, services.ScopeWrite), controllers.ServiceAccess(), idempotency)
+	transactions.POST("/replenish", transactionController.StoreReplenishmentTransaction)
+	transactions.POST("/reserve", transactionController.StoreReservationTransaction)
+	transactions.POST("/reserve/adjust", transactionController.AdjustReservation)
+	transactions.POST("/withdraw", transactionController.StoreWithdrawalTransaction)
+	transactions.POST("/cancel", transactionController.StoreCancellationTransaction)
+	transactions.POST("/refund", transactionController.StoreRefundTransaction)
+	transactions.POST("/transfer", transactionController.StoreTransferTransaction)
+
+	users := v1.Group("/users", controllers.APIKey(apiKeyService, services.ScopeRead))
+	users.GET("", userController.GetUserBalance)
+	users.GET("/:id/transactions", userController.GetUserTransactions)
+	users.GET("/:id/statement", userController.GetUserStatement)
+
+	reports := v1.Group("", controllers.APIKey(apiKeyService, services.ScopeReports))
+	reports.POST("/report", reportController.StoreReport)
+	reports.GET("/reports", reportController.GetReports)
+	reports.GET("/reports/jobs/:id", reportController.GetReportJob)
+	// Signed links let clients, which can't send the key, download the report
+	v1.GET("/reports/:id/download", controllers.APIKey(apiKeyService, services.ScopeReports, reportController.HasSignedLink), reportController.DownloadReport)
+
+	admin := v1.Group("/admin", controllers.APIKey(apiKeyService, services.ScopeAdmin))
+	admin.POST("/reconciliations", reconciliationController.StoreReconciliation)
+	admin.GET("/reconciliations", reconciliationController.GetReconciliations)
+	admin.GET("/reconciliations/:id", reconciliationController.GetReconciliation)
+	admin.GET("/report-job", reportSchedulerController.GetReportJob)
+
+	return r.Run(":8080")
+}
+
+// newBaseCurrency reads BASE_CURRENCY, balances kept before currencies were introduced are migrated to it as well
+func newBaseCurrency() (string, error) {
+	baseCurrency := os.Getenv("BASE_CURRENCY")
+	if baseCurrency == "" {
+		baseCurrency = services.DefaultBaseCurrency
+	}
+	if !services.IsCurrencyCode(baseCurrency) {
+		return "", fmt.Errorf("invalid base currency %q, ISO 4217 code is expected", baseCurrency)
+	}
+
+	return baseCurrency, nil
+}
+
+// newRatesProvider picks the exchange rates source, a local file wins over an HTTP service
+func newRatesProvider() (services.RatesProvider, error) {
+	if path := os.Getenv("RATES_FILE"); path != "" {
+		interval, err := durationFromEnv("RATES_REFRESH_INTERVAL", time.Hour)
+		if err != nil {
+			return nil, err
+		}
+
+		provider, err := services.NewFileRatesProvider(path)
+		if err != nil {
+			return nil, err
+		}
+		go provider.RefreshEvery(context.Background(), interval)
+
+		return provider, nil
+	}
+
+	if endpoint := os.Getenv("RATES_URL"); endpoint != "" {
+		ttl, err := durationFromEnv("RATES_CACHE_TTL", 10*time.Minute)
+		if err != nil {
+			return nil, err
+		}
 
-	v1.POST("/report", controllers.StoreReport)
+		return services.NewCachedRatesProvider(services.NewHTTPRatesProvider(endpoint, 5*time.Second), ttl), nil
+	}
 
-	err := r.Run(":8080")
+	return services.NoRatesProvider{}, nil
+}
 
+// newBalanceCache caches balances in Redis if it is configured, otherwise balances are always read from the database
+func newBalanceCache() (services.BalanceCache, error) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		return services.NoBalanceCache{}, nil
+	}
+
+	ttl, err := durationFromEnv("BALANCE_CACHE_TTL", time.Minute)
 	if err != nil {
-		log.Fatal(err)
-		return
+		return nil, err
 	}
+
+	return services.NewRedisBalanceCache(services.NewRedisPool(url), ttl), nil
+}
+
+// newReservationTTL reads the lifetime of reservations, RESERVATION_SERVICE_TTLS overrides RESERVATION_TTL
+// for the listed services. Reservations never expire unless either is set.
+func newReservationTTL() (services.ReservationTTL, error) {
+	ttl, err := durationFromEnv("RESERVATION_TTL", 0)
+	if err != nil {
+		return services.ReservationTTL{}, err
+	}
+
+	serviceTTLs, err := services.ParseServiceTTLs(os.Getenv("RESERVATION_SERVICE_TTLS"))
+	if err != nil {
+		return services.ReservationTTL{}, fmt.Errorf("invalid RESERVATION_SERVICE_TTLS: %w", err)
+	}
+
+	return services.ReservationTTL{Default: ttl, Services: serviceTTLs}, nil
+}
+
+// newReportStorage keeps reports in an S3 compatible storage if it is configured, otherwise in a local directory
+func newReportStorage() (services.ReportStorage, error) {
+	switch storage := os.Getenv("REPORT_STORAGE"); storage {
+	case "", "local":
+		dir := os.Getenv("REPORT_STORAGE_DIR")
+		if dir == "" {
+			dir = "data"
+		}
+
+		return services.NewLocalReportStorage(dir), nil
+	case "s3":
+		options := services.S3Options{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			UseSSL:    os.Getenv("S3_USE_SSL") != "false",
+		}
+		if options.Endpoint == "" || options.Bucket == "" {
+			return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET are required for the s3 report storage")
+		}
+		if options.Region == "" {
+			options.Region = "us-east-1"
+		}
+
+		return services.NewS3ReportStorage(options)
+	default:
+		return nil, fmt.Errorf("invalid REPORT_STORAGE %q, local or s3 is expected", storage)
+	}
+}
+
+// newReportLinkSigner signs download links with REPORT_LINK_SECRET, which should be shared by all replicas
+func newReportLinkSigner() (*services.ReportLinkSigner, error) {
+	secret := os.Getenv("REPORT_LINK_SECRET")
+	if secret == "" {
+		log.Println("REPORT_LINK_SECRET is not set, signed report links are valid only for this instance until it restarts")
+	}
+
+	return services.NewReportLinkSigner(secret)
+}
+
+func newReportJobService(reports *services.ReportService, jobs repositories.ReportJobRepository) (*services.ReportJobService, error) {
+	workers := 2
+	if value := os.Getenv("REPORT_WORKERS"); value != "" {
+		var err error
+		if workers, err = strconv.Atoi(value); err != nil || workers < 1 {
+			return nil, fmt.Errorf("invalid REPORT_WORKERS %q, positive number is expected", value)
+		}
+	}
+
+	return services.NewReportJobService(reports, jobs, workers), nil
+}
+
+func newReportScheduler(reports *services.ReportService, runs repositories.ReportRunRepository, locker repositories.Locker) (*services.ReportScheduler, error) {
+	spec := os.Getenv("REPORT_SCHEDULE")
+	if spec == "" {
+		spec = services.DefaultReportSchedule
+	}
+
+	retries := 3
+	if value := os.Getenv("REPORT_RETRIES"); value != "" {
+		var err error
+		if retries, err = strconv.Atoi(value); err != nil || retries < 0 {
+			return nil, fmt.Errorf("invalid REPORT_RETRIES %q, non-negative number is expected", value)
+		}
+	}
+
+	retryDelay, err := durationFromEnv("REPORT_RETRY_DELAY", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	return services.NewReportScheduler(reports, runs, locker, spec, retries, retryDelay)
+}
+
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid %s %q, positive duration like 30m is expected", name, value)
+	}
+
+	return duration, nil
+}
+
+func migrate(db *sqlx.DB, args []string) error {
+	if len(args) == 0 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	baseCurrency, err := newBaseCurrency()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		return migrateUp(db, baseCurrency)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations to roll back: %q", args[1])
+			}
+		}
+
+		migrations, err := repositories.MigrateDown(context.Background(), db, steps, baseCurrency)
+		for _, migration := range migrations {
+			log.Printf("rolled back %04d_%s", migration.Version, migration.Name)
+		}
+		if err == nil && len(migrations) == 0 {
+			log.Println("nothing to roll back")
+		}
+
+		return err
+	case "status":
+		statuses, err := repositories.GetMigrationsStatus(context.Background(), db)
+		if err != nil {
+			return err
+		}
+
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = "applied at " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+
+		return nil
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	return nil
+}
+
+func reconcile(db *sqlx.DB, args []string) error {
+	fix := false
+	for _, arg := range args {
+		if arg != "--fix" {
+			fmt.Println(usage)
+			os.Exit(2)
+		}
+		fix = true
+	}
+
+	repos := repositories.NewPostgresRepositories(db)
+	service := services.NewReconciliationService(repositories.NewPostgresTransactionRunner(db), repos.Ledger, repos.Reconciliations)
+
+	run, mismatches, err := service.Reconcile(context.Background(), fix)
+	if err != nil {
+		return err
+	}
+
+	for _, mismatch := range mismatches {
+		status := "not fixed"
+		if mismatch.Fixed {
+			status = "fixed"
+		}
+		fmt.Printf("user %d %s %s account %d: stored %d, computed %d, %s\n", mismatch.UserID, mismatch.Currency, mismatch.AccountType,
+			mismatch.AccountID, mismatch.StoredBalance, mismatch.ComputedBalance, status)
+	}
+	log.Printf("reconciliation %d checked %d accounts, found %d mismatches, fixed %d", run.ID, run.CheckedAccounts, run.Mismatches, run.Fixed)
+
+	if run.Mismatches > run.Fixed {
+		return fmt.Errorf("%d mismatches are not fixed", run.Mismatches-run.Fixed)
+	}
+
+	return nil
+}
+
+func apiKeys(db *sqlx.DB, args []string) error {
+	if len(args) == 0 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	service := services.NewAPIKeyService(repositories.NewPostgresRepositories(db).APIKeys)
+
+	switch args[0] {
+	case "create":
+		if len(args) < 3 || len(args) > 4 {
+			fmt.Println(usage)
+			os.Exit(2)
+		}
+
+		serviceIDs := []int64{}
+		if len(args) == 4 {
+			var err error
+			if serviceIDs, err = services.ParseServiceIDs(args[3]); err != nil {
+				return err
+			}
+		}
+
+		key, plaintext, err := service.CreateAPIKey(context.Background(), args[1], strings.Split(args[2], ","), serviceIDs)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("created api key %d %q, it is shown only once", key.ID, key.Name)
+		fmt.Println(plaintext)
+
+		return nil
+	case "list":
+		keys, err := service.GetAPIKeys(context.Background())
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			status := "active"
+			if key.RevokedAt.Valid {
+				status = "revoked at " + key.RevokedAt.Time.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%d\t%s\t%s...\tscopes %s\tservices %s\t%s\n", key.ID, key.Name, key.KeyPrefix,
+				strings.Join(key.Scopes, ","), formatServiceIDs(key.ServiceIDs), status)
+		}
+
+		return nil
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Println(usage)
+			os.Exit(2)
+		}
+
+		ID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || ID <= 0 {
+			return fmt.Errorf("invalid api key id %q", args[1])
+		}
+		if err := service.RevokeAPIKey(context.Background(), ID); err != nil {
+			return err
+		}
+
+		log.Printf("revoked api key %d", ID)
+
+		return nil
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	return nil
+}
+
+func formatServiceIDs(serviceIDs []int64) string {
+	if len(serviceIDs) == 0 {
+		return "-"
+	}
+
+	values := make([]string, 0, len(serviceIDs))
+	for _, ID := range serviceIDs {
+		values = append(values, strconv.FormatInt(ID, 10))
+	}
+
+	return strings.Join(values, ",")
+}
+
+func migrateUp(db *sqlx.DB, baseCurrency string) error {
+	migrations, err := repositories.MigrateUp(context.Background(), db, baseCurrency)
+	for _, migration := range migrations {
+		log.Printf("applied %04d_%s", migration.Version, migration.Name)
+	}
+
+	return err
 }
@@ -0,0 +1,101 @@
+package controllers
+
+import (
+	"balance-service/repositories"
+	"balance-service/services"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const apiKeyContextKey = "api_key"
+
+// APIKey rejects requests without a valid API key in the Authorization header, unless one of the alternatives,
+// like a signed link, authorizes the request. Keys without the scope are forbidden.
+func APIKey(keys *services.APIKeyService, scope string, alternatives ...func(c *gin.Context) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var key *repositories.APIKey
+		if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			var err error
+			key, err = keys.Authenticate(c.Request.Context(), header[len("Bearer "):])
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		if key == nil {
+			for _, authorized := range alternatives {
+				if authorized(c) {
+					c.Next()
+					return
+				}
+			}
+
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "valid api key is required"})
+			return
+		}
+
+		if !key.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("api key has no %s scope", scope)})
+			return
+		}
+
+		c.Set(apiKeyContextKey, key)
+		c.Next()
+	}
+}
+
+// CurrentAPIKey returns the API key resolved by APIKey, nil if the request was authorized otherwise
+func CurrentAPIKey(c *gin.Context) *repositories.APIKey {
+	key, ok := c.Get(apiKeyContextKey)
+	if !ok {
+		return nil
+	}
+
+	return key.(*repositories.APIKey)
+}
+
+// ServiceAccess forbids requests on behalf of services the API key resolved by APIKey is not bound to.
+// Requests without a service, like replenishments, pass through. Bodies which aren't a single JSON object are rejected
+// here, otherwise the handler could bind a service the key wasn't checked against.
+func ServiceAccess() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := CurrentAPIKey(c)
+		if key == nil {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		var input struct {
+			ServiceID *int64 `json:"service_id"`
+		}
+		if err := json.Unmarshal(body, &input); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		if input.ServiceID == nil {
+			c.Next()
+			return
+		}
+
+		if !key.AllowsService(*input.ServiceID) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("api key is not allowed to use service %d", *input.ServiceID)})
+			return
+		}
+
+		c.Next()
+	}
+}
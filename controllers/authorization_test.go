@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"testing"
+)
+
+func TestAPIKey(t *testing.T) {
+	s := newTestServer(t)
+	s.mustPost(t, "/v1/transactions/replenish", gin.H{"user_id": 1, "amount": 100})
+
+	revoked := s.createAPIKey(t, []string{"read"}, nil)
+	keys, err := s.keyService.GetAPIKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.keyService.RevokeAPIKey(context.Background(), keys[len(keys)-1].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		key        string
+		wantStatus int
+	}{
+		{name: "read key reads balances", method: http.MethodGet, path: "/v1/users?id=1", key: s.readKey, wantStatus: http.StatusOK},
+		{name: "without key", method: http.MethodGet, path: "/v1/users?id=1", wantStatus: http.StatusUnauthorized},
+		{name: "unknown key", method: http.MethodGet, path: "/v1/users?id=1", key: "bs_unknown", wantStatus: http.StatusUnauthorized},
+		{name: "revoked key", method: http.MethodGet, path: "/v1/users?id=1", key: revoked, wantStatus: http.StatusUnauthorized},
+		{name: "write key reads balances", method: http.MethodGet, path: "/v1/users?id=1", key: s.writeKey, wantStatus: http.StatusForbidden},
+		{name: "read key stores transactions", method: http.MethodPost, path: "/v1/transactions/replenish", key: s.readKey, wantStatus: http.StatusForbidden},
+		{name: "reports key lists reports", method: http.MethodGet, path: "/v1/reports", key: s.reportsKey, wantStatus: http.StatusOK},
+		{name: "admin key lists reports", method: http.MethodGet, path: "/v1/reports", key: s.adminKey, wantStatus: http.StatusForbidden},
+		{name: "admin key lists reconciliations", method: http.MethodGet, path: "/v1/admin/reconciliations", key: s.adminKey, wantStatus: http.StatusOK},
+		{name: "reports key lists reconciliations", method: http.MethodGet, path: "/v1/admin/reconciliations", key: s.reportsKey, wantStatus: http.StatusForbidden},
+		{name: "download without key or signature", method: http.MethodGet, path: "/v1/reports/1/download", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body interface{}
+			if tt.method == http.MethodPost {
+				body = gin.H{"user_id": 1, "amount": 100}
+			}
+
+			w := s.request(t, tt.method, tt.path, tt.key, body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestServiceAccess(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		body       interface{}
+		wantStatus int
+	}{
+		{name: "bound service", path: "/v1/transactions/reserve", body: gin.H{"user_id": 1, "amount": 10, "service_id": 2, "order_id": 1}, wantStatus: http.StatusCreated},
+		{name: "another service", path: "/v1/transactions/reserve", body: gin.H{"user_id": 1, "amount": 10, "service_id": 1, "order_id": 1}, wantStatus: http.StatusForbidden},
+		{name: "refund of another service", path: "/v1/transactions/refund", body: gin.H{"user_id": 1, "amount": 10, "service_id": 1, "order_id": 1}, wantStatus: http.StatusForbidden},
+		{name: "request without service", path: "/v1/transactions/replenish", body: gin.H{"user_id": 1, "amount": 10}, wantStatus: http.StatusCreated},
+		{name: "malformed request", path: "/v1/transactions/reserve", body: `{"service_id":`, wantStatus: http.StatusUnprocessableEntity},
+		{name: "another service followed by trailing data", path: "/v1/transactions/reserve", body: `{"user_id":1,"amount":10,"service_id":1,"order_id":1} x`, wantStatus: http.StatusUnprocessableEntity},
+		{name: "two bodies", path: "/v1/transactions/reserve", body: `{"user_id":1,"amount":10,"service_id":1,"order_id":1}{"service_id":2}`, wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.mustPost(t, "/v1/transactions/replenish", gin.H{"user_id": 1, "amount": 100})
+
+			w := s.request(t, http.MethodPost, tt.path, s.serviceKey, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+		})
+	}
+}
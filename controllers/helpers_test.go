@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"balance-service/repositories"
+	"balance-service/repositories/memory"
+	"balance-service/services"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// testServer serves the API the way cmd/main.go does, backed by the in-memory store
+type testServer struct {
+	router       *gin.Engine
+	repos        repositories.Repositories
+	transactions *services.TransactionService
+	reports      *services.ReportService
+	scheduler    *services.ReportScheduler
+	keyService   *services.APIKeyService
+
+	// Plaintext API keys by what they allow, writeKey may store transactions of services 1 and 2, serviceKey of 2 only
+	writeKey   string
+	serviceKey string
+	readKey    string
+	reportsKey string
+	adminKey   string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	// Report workers are only told to stop and may still write into the directory while t.TempDir removes it,
+	// so the directory is removed without failing the test
+	reportsDir, err := os.MkdirTemp("", "reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(reportsDir) })
+
+	store := memory.NewStore()
+	repos := store.Repositories()
+	s := &testServer{
+		repos:        repos,
+		transactions: services.NewTransactionService(store, services.NoBalanceCache{}, "RUB", services.ReservationTTL{}),
+		reports:      services.NewReportService(repos.Transactions, repos.Reports, services.NewLocalReportStorage(reportsDir)),
+		keyService:   services.NewAPIKeyService(repos.APIKeys),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	reportJobs := services.NewReportJobService(s.reports, repos.ReportJobs, 1)
+	reportJobs.Start(ctx)
+
+	links, err := services.NewReportLinkSigner("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.scheduler, err = services.NewReportScheduler(s.reports, repos.ReportRuns, memory.NewLocker(), services.DefaultReportSchedule, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.writeKey = s.createAPIKey(t, []string{services.ScopeWrite}, []int64{1, 2})
+	s.serviceKey = s.createAPIKey(t, []string{services.ScopeWrite}, []int64{2})
+	s.readKey = s.createAPIKey(t, []string{services.ScopeRead}, nil)
+	s.reportsKey = s.createAPIKey(t, []string{services.ScopeReports}, nil)
+	s.adminKey = s.createAPIKey(t, []string{services.ScopeAdmin}, nil)
+
+	transactionController := NewTransactionController(s.transactions)
+	userController := NewUserController(services.NewUserService(repos.Users, repos.Transactions, services.NoRatesProvider{}, services.NoBalanceCache{}, "RUB"))
+	reportController := NewReportController(s.reports, reportJobs, links, time.Minute)
+	reconciliationController := NewReconciliationController(services.NewReconciliationService(store, repos.Ledger, repos.Reconciliations))
+	reportSchedulerController := NewReportSchedulerController(s.scheduler, reportController)
+	idempotency := Idempotency(services.NewIdempotencyService(repos.IdempotencyKeys))
+
+	r := gin.New()
+	r.Use(gin.Recovery())
+	v1 := r.Group("/v1")
+
+	transactions := v1.Group("/transactions", APIKey(s.keyService, services.ScopeWrite), ServiceAccess(), idempotency)
+	transactions.POST("/replenish", transactionController.StoreReplenishmentTransaction)
+	transactions.POST("/reserve", transactionController.StoreReservationTransaction)
+	transactions.POST("/reserve/adjust", transactionController.AdjustReservation)
+	transactions.POST("/withdraw", transactionController.StoreWithdrawalTransaction)
+	transactions.POST("/cancel", transactionController.StoreCancellationTransaction)
+	transactions.POST("/refund", transactionController.StoreRefundTransaction)
+	transactions.POST("/transfer", transactionController.StoreTransferTransaction)
+
+	users := v1.Group("/users", APIKey(s.keyService, services.ScopeRead))
+	users.GET("", userController.GetUserBalance)
+	users.GET("/:id/transactions", userController.GetUserTransactions)
+	users.GET("/:id/statement", userController.GetUserStatement)
+
+	reports := v1.Group("", APIKey(s.keyService, services.ScopeReports))
+	reports.POST("/report", reportController.StoreReport)
+	reports.GET("/reports", reportController.GetReports)
+	reports.GET("/reports/jobs/:id", reportController.GetReportJob)
+	v1.GET("/reports/:id/download", APIKey(s.keyService, services.ScopeReports, reportController.HasSignedLink), reportController.DownloadReport)
+
+	admin := v1.Group("/admin", APIKey(s.keyService, services.ScopeAdmin))
+	admin.POST("/reconciliations", reconciliationController.StoreReconciliation)
+	admin.GET("/reconciliations", reconciliationController.GetReconciliations)
+	admin.GET("/reconciliations/:id", reconciliationController.GetReconciliation)
+	admin.GET("/report-job", reportSchedulerController.GetReportJob)
+
+	s.router = r
+	return s
+}
+
+func (s *testServer) createAPIKey(t *testing.T, scopes []string, serviceIDs []int64) string {
+	t.Helper()
+
+	_, plaintext, err := s.keyService.CreateAPIKey(context.Background(), "test", scopes, serviceIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return plaintext
+}
+
+// request sends the body encoded as JSON unless it is a string, headers go in name and value pairs
+func (s *testServer) request(t *testing.T, method string, path string, key string, body interface{}, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var content []byte
+	switch body := body.(type) {
+	case nil:
+	case string:
+		content = []byte(body)
+	default:
+		var err error
+		if content, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(content))
+	if content != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+
+	return w
+}
+
+// post stores a transaction with writeKey
+func (s *testServer) post(t *testing.T, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	return s.request(t, http.MethodPost, path, s.writeKey, body)
+}
+
+// mustPost fails the test unless the transaction is stored
+func (s *testServer) mustPost(t *testing.T, path string, body interface{}) {
+	t.Helper()
+
+	if w := s.post(t, path, body); w.Code != http.StatusCreated {
+		t.Fatalf("POST %s = %d %s", path, w.Code, w.Body)
+	}
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("response %q is not a JSON object: %v", w.Body, err)
+	}
+
+	return response
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"balance-service/services"
+	"bytes"
+	"context"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// detachedContext keeps the values of the request context, but is not cancelled when the client goes away
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// Idempotency replays the stored response for requests repeated with the same Idempotency-Key header
+func Idempotency(idempotency *services.IdempotencyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		if len(key) > 255 {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "idempotency key should not be longer than 255 characters"})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		endpoint := c.Request.Method + " " + c.FullPath()
+		// Clients choose keys on their own, so every API key has its own
+		apiKeyID := int64(0)
+		if apiKey := CurrentAPIKey(c); apiKey != nil {
+			apiKeyID = apiKey.ID
+		}
+
+		// The outcome of the request is stored even if the client disconnects, otherwise the key would stay claimed
+		ctx := detachedContext{c.Request.Context()}
+
+		claim, existing, err := idempotency.BeginIdempotentRequest(ctx, apiKeyID, key, endpoint, body)
+
+		if err == services.ErrIdempotencyKeyReused || err == services.ErrIdempotencyKeyInProgress || err == services.ErrIdempotencyKeyResponseLost {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if existing != nil {
+			c.Data(int(existing.StatusCode.Int32), "application/json; charset=utf-8", existing.ResponseBody)
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Request = c.Request.WithContext(services.WithIdempotencyClaim(c.Request.Context(), claim))
+
+		// A panicking handler skips the rest of the middleware, the claim is released before the panic reaches Recovery
+		defer func() {
+			if r := recover(); r != nil {
+				if err := idempotency.ReleaseIdempotentRequest(ctx, claim); err != nil {
+					log.Println(err)
+				}
+				panic(r)
+			}
+		}()
+
+		c.Next()
+
+		// Server errors are not remembered, so the client is able to retry. Claims of requests which changed balances
+		// before failing are kept.
+		if recorder.Status() >= http.StatusInternalServerError {
+			if err := idempotency.ReleaseIdempotentRequest(ctx, claim); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+
+		if err := idempotency.CompleteIdempotentRequest(ctx, claim, recorder.Status(), recorder.body.Bytes()); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"balance-service/repositories"
+	"balance-service/repositories/memory"
+	"balance-service/services"
+	"context"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdempotency(t *testing.T) {
+	replenish := gin.H{"user_id": 1, "amount": 100}
+
+	tests := []struct {
+		name string
+		// first is sent with the key before the checked request, unless it is nil
+		first      interface{}
+		firstKey   func(s *testServer) string
+		request    interface{}
+		wantStatus int
+		// wantBalance is the balance of the user after both requests
+		wantBalance float64
+	}{
+		{
+			name:        "replayed",
+			first:       replenish,
+			request:     replenish,
+			wantStatus:  http.StatusCreated,
+			wantBalance: 100,
+		},
+		{
+			name:        "reused with another body",
+			first:       replenish,
+			request:     gin.H{"user_id": 1, "amount": 50},
+			wantStatus:  http.StatusConflict,
+			wantBalance: 100,
+		},
+		{
+			name:        "rejected requests are replayed as well",
+			first:       gin.H{"user_id": 1, "amount": -1},
+			request:     gin.H{"user_id": 1, "amount": -1},
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantBalance: 0,
+		},
+		{
+			name:        "same key of another API key",
+			first:       replenish,
+			firstKey:    func(s *testServer) string { return s.serviceKey },
+			request:     replenish,
+			wantStatus:  http.StatusCreated,
+			wantBalance: 200,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+
+			firstKey := s.writeKey
+			if tt.firstKey != nil {
+				firstKey = tt.firstKey(s)
+			}
+			first := s.request(t, http.MethodPost, "/v1/transactions/replenish", firstKey, tt.first, IdempotencyKeyHeader, "key-1")
+
+			w := s.request(t, http.MethodPost, "/v1/transactions/replenish", s.writeKey, tt.request, IdempotencyKeyHeader, "key-1")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if tt.firstKey == nil && tt.wantStatus != http.StatusConflict && w.Body.String() != first.Body.String() {
+				t.Errorf("replayed response = %s, want %s", w.Body, first.Body)
+			}
+
+			balance := s.request(t, http.MethodGet, "/v1/users?id=1", s.readKey, nil)
+			if tt.wantBalance == 0 {
+				if balance.Code != http.StatusBadRequest {
+					t.Errorf("user exists after a rejected request: %s", balance.Body)
+				}
+				return
+			}
+			if got := decode(t, balance)["balance"]; got != tt.wantBalance {
+				t.Errorf("balance = %v, want %v", got, tt.wantBalance)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeyTooLong(t *testing.T) {
+	s := newTestServer(t)
+
+	w := s.request(t, http.MethodPost, "/v1/transactions/replenish", s.writeKey, gin.H{"user_id": 1, "amount": 100}, IdempotencyKeyHeader, strings.Repeat("k", 256))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d %s, want %d", w.Code, w.Body, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestIdempotencyReleasesKeyOfFailedRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	idempotency := Idempotency(services.NewIdempotencyService(memory.NewStore().Repositories().IdempotencyKeys))
+
+	tests := []struct {
+		name    string
+		failure gin.HandlerFunc
+	}{
+		{
+			name:    "server error",
+			failure: func(c *gin.Context) { c.JSON(http.StatusInternalServerError, gin.H{"error": "failed"}) },
+		},
+		{
+			name:    "panic",
+			failure: func(c *gin.Context) { panic("failed") },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			r := gin.New()
+			r.Use(gin.RecoveryWithWriter(io.Discard))
+			r.POST("/", idempotency, func(c *gin.Context) {
+				calls++
+				if calls == 1 {
+					tt.failure(c)
+					return
+				}
+				c.JSON(http.StatusCreated, gin.H{"calls": calls})
+			})
+
+			key := "key-" + tt.name
+			for attempt := 1; attempt <= 3; attempt++ {
+				req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{}`))
+				req.Header.Set(IdempotencyKeyHeader, key)
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+
+				wantStatus := http.StatusCreated
+				if attempt == 1 {
+					wantStatus = http.StatusInternalServerError
+				}
+				if w.Code != wantStatus {
+					t.Fatalf("attempt %d = %d %s, want %d", attempt, w.Code, w.Body, wantStatus)
+				}
+			}
+
+			// The retry was processed and the one after it was replayed
+			if calls != 2 {
+				t.Errorf("handler was called %d times, want 2", calls)
+			}
+		})
+	}
+}
+
+// cancellableIdempotencyKeys fails like Postgres does once the context is cancelled
+type cancellableIdempotencyKeys struct {
+	repositories.IdempotencyKeyRepository
+}
+
+func (r cancellableIdempotencyKeys) UpdateIdempotencyKeyResponse(ctx context.Context, apiKeyID int64, key string, endpoint string, claimToken string, statusCode int, responseBody []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return r.IdempotencyKeyRepository.UpdateIdempotencyKeyResponse(ctx, apiKeyID, key, endpoint, claimToken, statusCode, responseBody)
+}
+
+func TestIdempotencyStoresResponseOfDisconnectedClient(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	idempotency := Idempotency(services.NewIdempotencyService(cancellableIdempotencyKeys{memory.NewStore().Repositories().IdempotencyKeys}))
+
+	calls := 0
+	r := gin.New()
+	r.POST("/", idempotency, func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusCreated, gin.H{"calls": calls})
+	})
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{}`)).WithContext(ctx)
+		req.Header.Set(IdempotencyKeyHeader, "key")
+		w := httptest.NewRecorder()
+		// The client goes away once the response is written
+		r.ServeHTTP(&disconnectingWriter{ResponseRecorder: w, cancel: cancel}, req)
+		cancel()
+
+		if w.Code != http.StatusCreated || w.Body.String() != `{"calls":1}` {
+			t.Fatalf("attempt %d = %d %s, want the first response", attempt, w.Code, w.Body)
+		}
+	}
+}
+
+type disconnectingWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w *disconnectingWriter) Write(data []byte) (int, error) {
+	defer w.cancel()
+	return w.ResponseRecorder.Write(data)
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"balance-service/repositories"
+	"balance-service/services"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+type StoreReconciliationInput struct {
+	Fix bool `json:"fix"`
+}
+
+type GetReconciliationsInput struct {
+	Limit int `form:"limit" binding:"omitempty,min=1,max=100"`
+}
+
+type GetReconciliationURI struct {
+	ID int64 `uri:"id" binding:"required,gt=0"`
+}
+
+type ReconciliationController struct {
+	reconciliations *services.ReconciliationService
+}
+
+func NewReconciliationController(reconciliations *services.ReconciliationService) *ReconciliationController {
+	return &ReconciliationController{reconciliations: reconciliations}
+}
+
+func (ctrl *ReconciliationController) StoreReconciliation(c *gin.Context) {
+	var json StoreReconciliationInput
+	// The body is optional, an empty one means a check without fixes
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Fixes write journal entries, so they are never made for requests not authenticated by an admin key,
+	// even if the route is served without APIKey by mistake. The reconcile --fix command makes them otherwise.
+	if key := CurrentAPIKey(c); json.Fix && (key == nil || !key.HasScope(services.ScopeAdmin)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "fixes are made only for requests with an admin api key"})
+		return
+	}
+
+	run, mismatches, err := ctrl.reconciliations.Reconcile(c.Request.Context(), json.Fix)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := reconciliationRunResponse(*run)
+	response["mismatches"] = reconciliationMismatchesResponse(mismatches)
+
+	c.JSON(http.StatusCreated, response)
+}
+
+func (ctrl *ReconciliationController) GetReconciliations(c *gin.Context) {
+	input := GetReconciliationsInput{Limit: 20}
+	if err := c.ShouldBindQuery(&input); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	runs, err := ctrl.reconciliations.GetReconciliationRuns(c.Request.Context(), input.Limit)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	items := make([]gin.H, 0, len(runs))
+	for _, run := range runs {
+		items = append(items, reconciliationRunResponse(run))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reconciliations": items})
+}
+
+func (ctrl *ReconciliationController) GetReconciliation(c *gin.Context) {
+	var uri GetReconciliationURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	run, mismatches, err := ctrl.reconciliations.GetReconciliationRun(c.Request.Context(), uri.ID)
+
+	if err == services.ErrReconciliationRunNotExists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := reconciliationRunResponse(*run)
+	response["mismatches"] = reconciliationMismatchesResponse(mismatches)
+
+	c.JSON(http.StatusOK, response)
+}
+
+func reconciliationRunResponse(run repositories.ReconciliationRun) gin.H {
+	response := gin.H{
+		"id":               run.ID,
+		"started_at":       run.StartedAt,
+		"finished_at":      nil,
+		"fix":              run.Fix,
+		"status":           run.Status,
+		"checked_accounts": run.CheckedAccounts,
+		"mismatches_count": run.Mismatches,
+		"fixed_count":      run.Fixed,
+		"error":            nil,
+	}
+	if run.FinishedAt.Valid {
+		response["finished_at"] = run.FinishedAt.Time
+	}
+	if run.Error.Valid {
+		response["error"] = run.Error.String
+	}
+
+	return response
+}
+
+func reconciliationMismatchesResponse(mismatches []repositories.ReconciliationMismatch) []gin.H {
+	items := make([]gin.H, 0, len(mismatches))
+	for _, mismatch := range mismatches {
+		items = append(items, gin.H{
+			"account_id":       mismatch.AccountID,
+			"account_type":     mismatch.AccountType,
+			"user_id":          mismatch.UserID,
+			"currency":         mismatch.Currency,
+			"stored_balance":   mismatch.StoredBalance,
+			"computed_balance": mismatch.ComputedBalance,
+			"fixed":            mismatch.Fixed,
+		})
+	}
+
+	return items
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"balance-service/repositories/memory"
+	"balance-service/services"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReconciliationEndpoints(t *testing.T) {
+	s := newTestServer(t)
+	s.mustPost(t, "/v1/transactions/replenish", gin.H{"user_id": 1, "amount": 100})
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       interface{}
+		wantStatus int
+		want       gin.H
+	}{
+		{name: "check", method: http.MethodPost, path: "/v1/admin/reconciliations", wantStatus: http.StatusCreated, want: gin.H{"id": 1, "fix": false, "status": "completed", "checked_accounts": 1, "mismatches_count": 0}},
+		{name: "fix", method: http.MethodPost, path: "/v1/admin/reconciliations", body: gin.H{"fix": true}, wantStatus: http.StatusCreated, want: gin.H{"id": 2, "fix": true, "fixed_count": 0}},
+		{name: "malformed body", method: http.MethodPost, path: "/v1/admin/reconciliations", body: "{", wantStatus: http.StatusUnprocessableEntity},
+		{name: "run", method: http.MethodGet, path: "/v1/admin/reconciliations/1", wantStatus: http.StatusOK, want: gin.H{"id": 1, "status": "completed"}},
+		{name: "unknown run", method: http.MethodGet, path: "/v1/admin/reconciliations/100", wantStatus: http.StatusBadRequest},
+		{name: "invalid id", method: http.MethodGet, path: "/v1/admin/reconciliations/x", wantStatus: http.StatusUnprocessableEntity},
+		{name: "limit too large", method: http.MethodGet, path: "/v1/admin/reconciliations?limit=101", wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	// Cases run in order, the runs are stored by the first ones
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.request(t, tt.method, tt.path, s.adminKey, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			response := decode(t, w)
+			assertFields(t, response, tt.want)
+			if w.Code < http.StatusBadRequest {
+				if _, ok := response["mismatches"].([]interface{}); !ok {
+					t.Errorf("response = %v, want mismatches listed", response)
+				}
+			}
+		})
+	}
+
+	w := s.request(t, http.MethodGet, "/v1/admin/reconciliations", s.adminKey, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	if runs, _ := decode(t, w)["reconciliations"].([]interface{}); len(runs) != 2 {
+		t.Errorf("runs = %v, want 2", runs)
+	}
+}
+
+func TestReconciliationFixRequiresAdminKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := memory.NewStore()
+	repos := store.Repositories()
+
+	// The controller is served without APIKey, like a misconfigured route
+	r := gin.New()
+	r.POST("/reconciliations", NewReconciliationController(services.NewReconciliationService(store, repos.Ledger, repos.Reconciliations)).StoreReconciliation)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "check", body: `{"fix":false}`, wantStatus: http.StatusCreated},
+		{name: "fix", body: `{"fix":true}`, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reconciliations", strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+		})
+	}
+}
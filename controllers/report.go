@@ -1,38 +1,298 @@
 package controllers
 
 import (
+	"balance-service/repositories"
 	"balance-service/services"
+	"database/sql"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// StoreReportInput takes either a calendar month or a range of days from and to inclusive
 type StoreReportInput struct {
-	Year  int `json:"year" binding:"required,min=0,max=9999"`
-	Month int `json:"month" binding:"required,min=1,max=12"`
+	Year     int    `json:"year" binding:"required_without=From,excluded_with=From,omitempty,min=0,max=9999"`
+	Month    int    `json:"month" binding:"required_with=Year,excluded_with=From,omitempty,min=1,max=12"`
+	From     string `json:"from" binding:"required_with=To,omitempty,datetime=2006-01-02"`
+	To       string `json:"to" binding:"required_with=From,omitempty,datetime=2006-01-02"`
+	Timezone string `json:"timezone" binding:"omitempty,timezone"`
+	GroupBy  string `json:"group_by" binding:"omitempty,oneof=service day service_day"`
+	Format   string `json:"format" binding:"omitempty,oneof=csv json xlsx parquet"`
 }
 
-func StoreReport(c *gin.Context) {
+const reportDateLayout = "2006-01-02"
+
+type GetReportJobURI struct {
+	ID int64 `uri:"id" binding:"required,gt=0"`
+}
+
+type GetReportsInput struct {
+	Limit  int `form:"limit" binding:"omitempty,min=1,max=100"`
+	Offset int `form:"offset" binding:"omitempty,min=0"`
+}
+
+type DownloadReportURI struct {
+	ID int64 `uri:"id" binding:"required,gt=0"`
+}
+
+type ReportController struct {
+	reports *services.ReportService
+	jobs    *services.ReportJobService
+	links   *services.ReportLinkSigner
+	// linkTTL is the lifetime of signed links and direct links to the storage
+	linkTTL time.Duration
+}
+
+func NewReportController(reports *services.ReportService, jobs *services.ReportJobService, links *services.ReportLinkSigner, linkTTL time.Duration) *ReportController {
+	return &ReportController{reports: reports, jobs: jobs, links: links, linkTTL: linkTTL}
+}
+
+func (ctrl *ReportController) StoreReport(c *gin.Context) {
 	var json StoreReportInput
 	if err := c.ShouldBindJSON(&json); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
 		return
 	}
 
-	filePath, err := services.StoreReport(json.Month, json.Year)
+	if json.Timezone == "" {
+		json.Timezone = "UTC"
+	}
+	if json.GroupBy == "" {
+		json.GroupBy = repositories.ReportGroupByService
+	}
+	if json.Format == "" {
+		json.Format = services.ReportFormatCSV
+	}
+
+	period := repositories.MonthReportPeriod(json.Month, json.Year, json.Timezone)
+	if json.From != "" {
+		// Both dates are already validated
+		from, _ := time.Parse(reportDateLayout, json.From)
+		to, _ := time.Parse(reportDateLayout, json.To)
+		period = repositories.ReportPeriod{From: from, To: to, Timezone: json.Timezone}
+	}
+
+	job, err := ctrl.jobs.StoreReportJob(c.Request.Context(), period, json.GroupBy, json.Format)
+
+	if err == services.ErrInvalidReportPeriod {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
+	response, err := ctrl.reportJobResponse(c, *job)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	c.JSON(http.StatusAccepted, response)
+}
+
+func (ctrl *ReportController) GetReportJob(c *gin.Context) {
+	var uri GetReportJobURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	job, err := ctrl.jobs.GetReportJob(c.Request.Context(), uri.ID)
+
+	if err == services.ErrReportJobNotExists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response, err := ctrl.reportJobResponse(c, *job)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (ctrl *ReportController) GetReports(c *gin.Context) {
+	input := GetReportsInput{Limit: 20}
+	if err := c.ShouldBindQuery(&input); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	reports, total, err := ctrl.reports.GetReports(c.Request.Context(), input.Limit, input.Offset)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	items := make([]gin.H, 0, len(reports))
+	for _, e := range reports {
+		url, err := ctrl.reportURL(c, e)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		items = append(items, gin.H{
+			"id":         e.ID,
+			"from":       e.From.Format(reportDateLayout),
+			"to":         e.To.Format(reportDateLayout),
+			"timezone":   e.Timezone,
+			"group_by":   e.GroupBy,
+			"format":     e.Format,
+			"created_at": e.CreatedAt,
+			"url":        url,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"reports": items,
+		"total":   total,
+		"limit":   input.Limit,
+		"offset":  input.Offset,
+	})
+}
+
+// DownloadReport streams the report file, it is authorized either by the API key or by a signed link
+func (ctrl *ReportController) DownloadReport(c *gin.Context) {
+	var uri DownloadReportURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	report, err := ctrl.reports.GetReport(c.Request.Context(), uri.ID)
+
+	if err == services.ErrReportNotExists {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	file, err := ctrl.reports.OpenReportFile(c.Request.Context(), report.FileKey)
+
+	if err == services.ErrReportFileNotExists {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	c.Header("Content-Type", services.ReportContentType(report.FileKey))
+	c.Header("Content-Disposition", `attachment; filename="`+reportFileName(*report)+`"`)
+	c.Status(http.StatusOK)
+	_, _ = io.Copy(c.Writer, file)
+}
+
+// HasSignedLink reports whether the request carries a valid signature of the downloaded report,
+// it is an alternative to the API key for DownloadReport
+func (ctrl *ReportController) HasSignedLink(c *gin.Context) bool {
+	ID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return false
+	}
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return ctrl.links.Verify(ID, expires, c.Query("signature"), time.Now())
+}
+
+func (ctrl *ReportController) reportJobResponse(c *gin.Context, job repositories.ReportJob) (gin.H, error) {
+	response := gin.H{
+		"id":          job.ID,
+		"from":        job.From.Format(reportDateLayout),
+		"to":          job.To.Format(reportDateLayout),
+		"timezone":    job.Timezone,
+		"group_by":    job.GroupBy,
+		"format":      job.Format,
+		"status":      job.Status,
+		"report_id":   nil,
+		"url":         nil,
+		"error":       nil,
+		"created_at":  job.CreatedAt,
+		"finished_at": nil,
+	}
+	if err := ctrl.linkReport(c, response, job.ReportID); err != nil {
+		return nil, err
+	}
+	if job.Error.Valid {
+		response["error"] = job.Error.String
+	}
+	if job.FinishedAt.Valid {
+		response["finished_at"] = job.FinishedAt.Time
+	}
+
+	return response, nil
+}
+
+// linkReport sets report_id and url of the response to the report, if there is one.
+// Reports with an outdated layout, which may be linked by runs and jobs of older versions, are not served.
+func (ctrl *ReportController) linkReport(c *gin.Context, response gin.H, reportID sql.NullInt64) error {
+	if !reportID.Valid {
+		return nil
+	}
+
+	report, err := ctrl.reports.GetReport(c.Request.Context(), reportID.Int64)
+	if err == services.ErrReportNotExists {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	url, err := ctrl.reportURL(c, *report)
+	if err != nil {
+		return err
+	}
+	response["report_id"] = report.ID
+	response["url"] = url
+
+	return nil
+}
+
+// reportURL prefers a direct link to the storage and falls back to a signed link to download the report
+// from the service
+func (ctrl *ReportController) reportURL(c *gin.Context, report repositories.Report) (string, error) {
+	url, err := ctrl.reports.PresignReportURL(c.Request.Context(), report.FileKey, ctrl.linkTTL)
+	if err != nil || url != "" {
+		return url, err
+	}
+
 	scheme := "http"
 	if c.Request.TLS != nil {
 		scheme = "https"
 	}
 
-	url := scheme + "://" + c.Request.Host + "/" + filePath
+	expires := time.Now().Add(ctrl.linkTTL)
+	query := "expires=" + strconv.FormatInt(expires.Unix(), 10) + "&signature=" + ctrl.links.Sign(report.ID, expires)
 
-	c.JSON(http.StatusCreated, gin.H{
-		"url": url,
-	})
+	return scheme + "://" + c.Request.Host + "/v1/reports/" + strconv.FormatInt(report.ID, 10) + "/download?" + query, nil
+}
+
+// reportFileName names the downloaded file after the period and the grouping of the report
+func reportFileName(report repositories.Report) string {
+	return fmt.Sprintf("report-%s-%s-%s.%s", report.From.Format("20060102"), report.To.Format("20060102"), report.GroupBy, report.Format)
 }
@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"balance-service/repositories"
+	"balance-service/services"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+type GetReportJobInput struct {
+	Limit int `form:"limit" binding:"omitempty,min=1,max=100"`
+}
+
+type ReportSchedulerController struct {
+	scheduler *services.ReportScheduler
+	// reports link the reports of completed runs the same way as report jobs do
+	reports *ReportController
+}
+
+func NewReportSchedulerController(scheduler *services.ReportScheduler, reports *ReportController) *ReportSchedulerController {
+	return &ReportSchedulerController{scheduler: scheduler, reports: reports}
+}
+
+func (ctrl *ReportSchedulerController) GetReportJob(c *gin.Context) {
+	input := GetReportJobInput{Limit: 12}
+	if err := c.ShouldBindQuery(&input); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	status, err := ctrl.scheduler.GetStatus(c.Request.Context(), input.Limit)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	runs := make([]gin.H, 0, len(status.Runs))
+	for _, run := range status.Runs {
+		response, err := ctrl.reportRunResponse(c, run)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		runs = append(runs, response)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"schedule":    status.Schedule,
+		"next_run_at": status.NextRunAt,
+		"runs":        runs,
+	})
+}
+
+func (ctrl *ReportSchedulerController) reportRunResponse(c *gin.Context, run repositories.ReportRun) (gin.H, error) {
+	response := gin.H{
+		"month":       run.Month,
+		"year":        run.Year,
+		"status":      run.Status,
+		"attempts":    run.Attempts,
+		"started_at":  run.StartedAt,
+		"finished_at": nil,
+		"report_id":   nil,
+		"url":         nil,
+		"error":       nil,
+	}
+	if run.FinishedAt.Valid {
+		response["finished_at"] = run.FinishedAt.Time
+	}
+	if err := ctrl.reports.linkReport(c, response, run.ReportID); err != nil {
+		return nil, err
+	}
+	if run.Error.Valid {
+		response["error"] = run.Error.String
+	}
+
+	return response, nil
+}
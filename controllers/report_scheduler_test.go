@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGetScheduledReportJob(t *testing.T) {
+	s := newTestServer(t)
+	if _, err := s.scheduler.Run(context.Background(), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	w := s.request(t, http.MethodGet, "/v1/admin/report-job", s.adminKey, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	response := decode(t, w)
+	if response["schedule"] != "0 0 1 * *" || response["next_run_at"] == nil {
+		t.Errorf("response = %v", response)
+	}
+
+	runs, _ := response["runs"].([]interface{})
+	if len(runs) != 1 {
+		t.Fatalf("runs = %v, want 1", response["runs"])
+	}
+	run := runs[0].(map[string]interface{})
+	if run["month"] != 2.0 || run["year"] != 2024.0 || run["status"] != "completed" || run["report_id"] == nil {
+		t.Fatalf("run = %v, want completed 02.2024 with the report", run)
+	}
+
+	// The run links the report the same way report jobs do
+	if w := s.request(t, http.MethodGet, signedPath(t, run["url"]), "", nil); w.Code != http.StatusOK {
+		t.Errorf("download status = %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+
+	if w := s.request(t, http.MethodGet, "/v1/admin/report-job?limit=101", s.adminKey, nil); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d %s, want %d", w.Code, w.Body, http.StatusUnprocessableEntity)
+	}
+}
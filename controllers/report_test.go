@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"balance-service/repositories"
+	"context"
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func reportJobPath(job map[string]interface{}) string {
+	return "/v1/reports/jobs/" + strconv.FormatInt(int64(job["id"].(float64)), 10)
+}
+
+// waitReportJob polls the job until a worker finishes it
+func waitReportJob(t *testing.T, s *testServer, job map[string]interface{}) map[string]interface{} {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for job["status"] == "pending" || job["status"] == "running" {
+		if time.Now().After(deadline) {
+			t.Fatalf("job %v is still %v", job["id"], job["status"])
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		w := s.request(t, http.MethodGet, reportJobPath(job), s.reportsKey, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d %s, want %d", w.Code, w.Body, http.StatusOK)
+		}
+		job = decode(t, w)
+	}
+
+	return job
+}
+
+// storeReport builds the report of today and returns the finished job
+func storeReport(t *testing.T, s *testServer, input gin.H) map[string]interface{} {
+	t.Helper()
+
+	w := s.request(t, http.MethodPost, "/v1/report", s.reportsKey, input)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d %s, want %d", w.Code, w.Body, http.StatusAccepted)
+	}
+
+	return waitReportJob(t, s, decode(t, w))
+}
+
+// signedPath strips the scheme and the host of the signed link
+func signedPath(t *testing.T, link interface{}) string {
+	t.Helper()
+
+	raw, ok := link.(string)
+	if !ok {
+		t.Fatalf("url = %v, want a link", link)
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed.RequestURI()
+}
+
+func TestStoreReport(t *testing.T) {
+	s := newTestServer(t)
+	s.mustPost(t, "/v1/transactions/replenish", gin.H{"user_id": 1, "amount": 100})
+	s.mustPost(t, "/v1/transactions/reserve", gin.H{"user_id": 1, "amount": 40, "service_id": 1, "order_id": 1})
+	s.mustPost(t, "/v1/transactions/withdraw", gin.H{"user_id": 1, "amount": 40, "service_id": 1, "order_id": 1})
+	today := time.Now().UTC().Format("2006-01-02")
+
+	job := storeReport(t, s, gin.H{"from": today, "to": today})
+	if job["status"] != "done" || job["report_id"] == nil || job["error"] != nil {
+		t.Fatalf("job = %v, want a done one", job)
+	}
+
+	// Signed link works without the key
+	link := signedPath(t, job["url"])
+	w := s.request(t, http.MethodGet, link, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("download status = %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	if w.Header().Get("Content-Type") != "text/csv" || !strings.Contains(w.Header().Get("Content-Disposition"), "-service.csv") {
+		t.Errorf("download headers = %v", w.Header())
+	}
+	if !strings.Contains(w.Body.String(), "1,RUB,1,40,0,40,0,0,0,40") {
+		t.Errorf("report = %s", w.Body)
+	}
+
+	// The same report is returned by a new job done at once
+	w = s.request(t, http.MethodPost, "/v1/report", s.reportsKey, gin.H{"from": today, "to": today})
+	if again := decode(t, w); w.Code != http.StatusAccepted || again["status"] != "done" || again["report_id"] != job["report_id"] {
+		t.Errorf("job = %d %v, want report %v", w.Code, again, job["report_id"])
+	}
+
+	w = s.request(t, http.MethodGet, "/v1/reports?limit=10", s.reportsKey, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	list := decode(t, w)
+	reports, _ := list["reports"].([]interface{})
+	if len(reports) != 1 || list["total"] != 1.0 {
+		t.Fatalf("reports = %v, want 1", list)
+	}
+	if signedPath(t, reports[0].(map[string]interface{})["url"]) == "" {
+		t.Error("listed report has no link")
+	}
+}
+
+func TestStoreReportValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      interface{}
+		wantStatus int
+	}{
+		{name: "month", input: gin.H{"year": 2024, "month": 2}, wantStatus: http.StatusAccepted},
+		{name: "every format", input: gin.H{"year": 2024, "month": 2, "format": "parquet", "group_by": "service_day"}, wantStatus: http.StatusAccepted},
+		{name: "year without month", input: gin.H{"year": 2024}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "month out of range", input: gin.H{"year": 2024, "month": 13}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "month and days", input: gin.H{"year": 2024, "month": 2, "from": "2024-02-01", "to": "2024-02-10"}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "malformed day", input: gin.H{"from": "01.02.2024", "to": "2024-02-10"}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "unknown timezone", input: gin.H{"year": 2024, "month": 2, "timezone": "Mars/Olympus"}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "unknown format", input: gin.H{"year": 2024, "month": 2, "format": "pdf"}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "period ends before it begins", input: gin.H{"from": "2024-02-10", "to": "2024-02-01"}, wantStatus: http.StatusBadRequest},
+		{name: "empty body", input: "{}", wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+
+			w := s.request(t, http.MethodPost, "/v1/report", s.reportsKey, tt.input)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDownloadReport(t *testing.T) {
+	s := newTestServer(t)
+	job := storeReport(t, s, gin.H{"year": 2024, "month": 2})
+	link := signedPath(t, job["url"])
+	reportPath := link[:strings.Index(link, "?")]
+	signature := link[strings.Index(link, "signature=")+len("signature="):]
+
+	tests := []struct {
+		name       string
+		path       string
+		key        string
+		wantStatus int
+	}{
+		{name: "signed link", path: link, wantStatus: http.StatusOK},
+		{name: "api key", path: reportPath, key: s.reportsKey, wantStatus: http.StatusOK},
+		{name: "api key without the scope", path: reportPath, key: s.readKey, wantStatus: http.StatusForbidden},
+		{name: "tampered signature", path: strings.Replace(link, signature, strings.Repeat("0", len(signature)), 1), wantStatus: http.StatusUnauthorized},
+		{name: "signature of another report", path: strings.Replace(link, reportPath, "/v1/reports/2/download", 1), wantStatus: http.StatusUnauthorized},
+		{name: "expired link", path: reportPath + "?expires=1&signature=" + signature, wantStatus: http.StatusUnauthorized},
+		{name: "unknown report", path: "/v1/reports/2/download", key: s.reportsKey, wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.request(t, http.MethodGet, tt.path, tt.key, nil)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestGetReportJob(t *testing.T) {
+	s := newTestServer(t)
+
+	// Jobs of older versions may reference reports with an outdated layout, which are not served
+	legacy := repositories.Report{ReportPeriod: repositories.MonthReportPeriod(10, 2022, "UTC"), Format: "csv", FileKey: "legacy.csv"}
+	if err := s.repos.Reports.StoreReport(context.Background(), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	job := repositories.ReportJob{ReportPeriod: legacy.ReportPeriod, Status: repositories.ReportJobDone, ReportID: sql.NullInt64{Int64: legacy.ID, Valid: true}}
+	if _, err := s.repos.ReportJobs.StoreReportJobIfNotInFlight(context.Background(), &job); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{name: "job of a legacy report", path: "/v1/reports/jobs/" + strconv.FormatInt(job.ID, 10), wantStatus: http.StatusOK},
+		{name: "unknown job", path: "/v1/reports/jobs/100", wantStatus: http.StatusBadRequest},
+		{name: "invalid id", path: "/v1/reports/jobs/x", wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.request(t, http.MethodGet, tt.path, s.reportsKey, nil)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if w.Code == http.StatusOK {
+				if job := decode(t, w); job["url"] != nil || job["report_id"] != nil {
+					t.Errorf("legacy report is linked: %s", w.Body)
+				}
+			}
+		})
+	}
+}
@@ -4,35 +4,86 @@ import (
 	"balance-service/services"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"time"
 )
 
 type StoreReplenishmentTransactionInput struct {
-	UserID int64 `json:"user_id" binding:"required,gt=0"`
-	Amount int64 `json:"amount" binding:"required,gt=0"`
+	UserID   int64  `json:"user_id" binding:"required,gt=0"`
+	Amount   int64  `json:"amount" binding:"required,gt=0"`
+	Currency string `json:"currency" binding:"omitempty,iso4217"`
 }
 
+// StoreReservationTransactionInput takes either the lifetime of the reservation in seconds, up to a year, or the moment
+// it expires, without them the lifetime configured for the service applies
 type StoreReservationTransactionInput struct {
-	UserID    int64 `json:"user_id" binding:"required,gt=0"`
-	Amount    int64 `json:"amount" binding:"required,gt=0"`
-	ServiceID int64 `json:"service_id" binding:"required,gt=0"`
-	OrderID   int64 `json:"order_id" binding:"required,gt=0"`
+	UserID    int64      `json:"user_id" binding:"required,gt=0"`
+	Amount    int64      `json:"amount" binding:"required,gt=0"`
+	Currency  string     `json:"currency" binding:"omitempty,iso4217"`
+	ServiceID int64      `json:"service_id" binding:"required,gt=0"`
+	OrderID   int64      `json:"order_id" binding:"required,gt=0"`
+	ExpiresIn int64      `json:"expires_in" binding:"omitempty,gt=0,max=31536000"`
+	ExpiresAt *time.Time `json:"expires_at" binding:"excluded_with=ExpiresIn"`
 }
 
+// AdjustReservationInput sets the amount held by the reservation, it can't be less than the already captured amount
+type AdjustReservationInput struct {
+	UserID    int64  `json:"user_id" binding:"required,gt=0"`
+	Amount    int64  `json:"amount" binding:"required,gt=0"`
+	Currency  string `json:"currency" binding:"omitempty,iso4217"`
+	ServiceID int64  `json:"service_id" binding:"required,gt=0"`
+	OrderID   int64  `json:"order_id" binding:"required,gt=0"`
+}
+
+// StoreWithdrawalTransactionInput captures the amount out of the reservation, a final withdrawal may omit the amount
+// to only release the remainder of the reservation
 type StoreWithdrawalTransactionInput struct {
-	UserID    int64 `json:"user_id" binding:"required,gt=0"`
-	Amount    int64 `json:"amount" binding:"required,gt=0"`
-	ServiceID int64 `json:"service_id" binding:"required,gt=0"`
-	OrderID   int64 `json:"order_id" binding:"required,gt=0"`
+	UserID    int64  `json:"user_id" binding:"required,gt=0"`
+	Amount    int64  `json:"amount" binding:"required_unless=Final true,omitempty,gt=0"`
+	Currency  string `json:"currency" binding:"omitempty,iso4217"`
+	ServiceID int64  `json:"service_id" binding:"required,gt=0"`
+	OrderID   int64  `json:"order_id" binding:"required,gt=0"`
+	Final     bool   `json:"final"`
+}
+
+type StoreCancellationTransactionInput struct {
+	UserID    int64  `json:"user_id" binding:"required,gt=0"`
+	Amount    int64  `json:"amount" binding:"required,gt=0"`
+	Currency  string `json:"currency" binding:"omitempty,iso4217"`
+	ServiceID int64  `json:"service_id" binding:"required,gt=0"`
+	OrderID   int64  `json:"order_id" binding:"required,gt=0"`
+}
+
+type StoreRefundTransactionInput struct {
+	UserID    int64  `json:"user_id" binding:"required,gt=0"`
+	Amount    int64  `json:"amount" binding:"required,gt=0"`
+	Currency  string `json:"currency" binding:"omitempty,iso4217"`
+	ServiceID int64  `json:"service_id" binding:"required,gt=0"`
+	OrderID   int64  `json:"order_id" binding:"required,gt=0"`
+}
+
+type StoreTransferTransactionInput struct {
+	FromUserID int64  `json:"from_user_id" binding:"required,gt=0"`
+	ToUserID   int64  `json:"to_user_id" binding:"required,gt=0"`
+	Amount     int64  `json:"amount" binding:"required,gt=0"`
+	Currency   string `json:"currency" binding:"omitempty,iso4217"`
+}
+
+type TransactionController struct {
+	transactions *services.TransactionService
+}
+
+func NewTransactionController(transactions *services.TransactionService) *TransactionController {
+	return &TransactionController{transactions: transactions}
 }
 
-func StoreReplenishmentTransaction(c *gin.Context) {
+func (ctrl *TransactionController) StoreReplenishmentTransaction(c *gin.Context) {
 	var json StoreReplenishmentTransactionInput
 	if err := c.ShouldBindJSON(&json); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
 		return
 	}
 
-	user, err := services.StoreReplenishmentTransaction(json.UserID, json.Amount)
+	balance, err := ctrl.transactions.StoreReplenishmentTransaction(c.Request.Context(), json.UserID, json.Amount, json.Currency)
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -40,21 +91,62 @@ func StoreReplenishmentTransaction(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"user_id": user.ID,
-		"balance": user.Balance,
+		"user_id":  balance.UserID,
+		"balance":  balance.Balance,
+		"currency": balance.Currency,
 	})
 }
 
-func StoreReservationTransaction(c *gin.Context) {
+func (ctrl *TransactionController) StoreReservationTransaction(c *gin.Context) {
 	var json StoreReservationTransactionInput
 	if err := c.ShouldBindJSON(&json); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
 		return
 	}
 
-	user, err := services.StoreReservationTransaction(json.UserID, json.Amount, json.OrderID, json.ServiceID)
+	var expiresAt time.Time
+	if json.ExpiresAt != nil {
+		expiresAt = *json.ExpiresAt
+	}
+	if json.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(json.ExpiresIn) * time.Second)
+	}
+
+	balance, expiry, err := ctrl.transactions.StoreReservationTransaction(c.Request.Context(), json.UserID, json.Amount, json.Currency, json.OrderID, json.ServiceID, expiresAt)
+
+	if err == services.ErrInsufficientBalance || err == services.ErrTransactionAlreadyProcessed || err == services.ErrReservationExpiryInPast {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{
+		"user_id":    balance.UserID,
+		"balance":    balance.Balance,
+		"currency":   balance.Currency,
+		"expires_at": nil,
+	}
+	if expiry.Valid {
+		response["expires_at"] = expiry.Time
+	}
+
+	c.JSON(http.StatusCreated, response)
+}
+
+func (ctrl *TransactionController) AdjustReservation(c *gin.Context) {
+	var json AdjustReservationInput
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	balance, capture, err := ctrl.transactions.AdjustReservation(c.Request.Context(), json.UserID, json.Amount, json.Currency, json.OrderID, json.ServiceID)
 
-	if err == services.ErrInsufficientBalance || err == services.ErrTransactionAlreadyProcessed {
+	if err == services.ErrAdjustedReservationNotFound || err == services.ErrInsufficientBalance || err == services.ErrReservationBelowCaptured || err == services.ErrTransactionWrongCurrency || err == services.ErrTransactionAlreadyCancelled || err == services.ErrTransactionAlreadyWithdrawn || err == services.ErrReservationExpired {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -65,21 +157,110 @@ func StoreReservationTransaction(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"user_id": user.ID,
-		"balance": user.Balance,
+		"user_id":   balance.UserID,
+		"balance":   balance.Balance,
+		"currency":  balance.Currency,
+		"reserved":  capture.Reserved,
+		"captured":  capture.Captured,
+		"remaining": capture.Remaining(),
 	})
 }
 
-func StoreWithdrawalTransaction(c *gin.Context) {
+func (ctrl *TransactionController) StoreWithdrawalTransaction(c *gin.Context) {
 	var json StoreWithdrawalTransactionInput
 	if err := c.ShouldBindJSON(&json); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
 		return
 	}
 
-	user, err := services.StoreWithdrawalTransaction(json.UserID, json.Amount, json.OrderID, json.ServiceID)
+	balance, capture, err := ctrl.transactions.StoreWithdrawalTransaction(c.Request.Context(), json.UserID, json.Amount, json.Currency, json.OrderID, json.ServiceID, json.Final)
+
+	if err == services.ErrTransactionNotFound || err == services.ErrReservationExceeded || err == services.ErrTransactionWrongCurrency || err == services.ErrTransactionAlreadyCancelled || err == services.ErrTransactionAlreadyWithdrawn || err == services.ErrReservationExpired {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"user_id":   balance.UserID,
+		"balance":   balance.Balance,
+		"currency":  balance.Currency,
+		"reserved":  capture.Reserved,
+		"captured":  capture.Captured,
+		"released":  capture.Released,
+		"remaining": capture.Remaining(),
+	})
+}
+
+func (ctrl *TransactionController) StoreCancellationTransaction(c *gin.Context) {
+	var json StoreCancellationTransactionInput
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	balance, err := ctrl.transactions.StoreCancellationTransaction(c.Request.Context(), json.UserID, json.Amount, json.Currency, json.OrderID, json.ServiceID)
+
+	if err == services.ErrReservationNotFound || err == services.ErrTransactionWrongAmount || err == services.ErrTransactionWrongCurrency || err == services.ErrTransactionAlreadyCancelled || err == services.ErrTransactionAlreadyWithdrawn || err == services.ErrReservationExpired {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"user_id":  balance.UserID,
+		"balance":  balance.Balance,
+		"currency": balance.Currency,
+	})
+}
+
+func (ctrl *TransactionController) StoreRefundTransaction(c *gin.Context) {
+	var json StoreRefundTransactionInput
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	balance, refund, err := ctrl.transactions.StoreRefundTransaction(c.Request.Context(), json.UserID, json.Amount, json.Currency, json.OrderID, json.ServiceID)
+
+	if err == services.ErrRefundedOrderNotFound || err == services.ErrRefundExceedsCaptured || err == services.ErrTransactionWrongCurrency {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"user_id":    balance.UserID,
+		"balance":    balance.Balance,
+		"currency":   balance.Currency,
+		"captured":   refund.Captured,
+		"refunded":   refund.Refunded,
+		"refundable": refund.Refundable(),
+	})
+}
+
+func (ctrl *TransactionController) StoreTransferTransaction(c *gin.Context) {
+	var json StoreTransferTransactionInput
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	fromBalance, toBalance, err := ctrl.transactions.StoreTransferTransaction(c.Request.Context(), json.FromUserID, json.ToUserID, json.Amount, json.Currency)
 
-	if err == services.ErrTransactionNotFound || err == services.ErrTransactionWrongAmount || err == services.ErrTransactionAlreadyCancelled {
+	if err == services.ErrInsufficientBalance || err == services.ErrTransferToSelf {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -90,7 +271,15 @@ func StoreWithdrawalTransaction(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"user_id": user.ID,
-		"balance": user.Balance,
+		"from": gin.H{
+			"user_id":  fromBalance.UserID,
+			"balance":  fromBalance.Balance,
+			"currency": fromBalance.Currency,
+		},
+		"to": gin.H{
+			"user_id":  toBalance.UserID,
+			"balance":  toBalance.Balance,
+			"currency": toBalance.Currency,
+		},
 	})
 }
@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type transactionRequest struct {
+	path string
+	body gin.H
+}
+
+func TestTransactionEndpoints(t *testing.T) {
+	replenish := transactionRequest{"/v1/transactions/replenish", gin.H{"user_id": 1, "amount": 100}}
+	reserve := transactionRequest{"/v1/transactions/reserve", gin.H{"user_id": 1, "amount": 40, "service_id": 1, "order_id": 1}}
+	withdraw := transactionRequest{"/v1/transactions/withdraw", gin.H{"user_id": 1, "amount": 40, "service_id": 1, "order_id": 1}}
+	cancel := transactionRequest{"/v1/transactions/cancel", gin.H{"user_id": 1, "amount": 40, "service_id": 1, "order_id": 1}}
+
+	tests := []struct {
+		name       string
+		setup      []transactionRequest
+		request    transactionRequest
+		wantStatus int
+		// want is the subset of the response fields to check
+		want gin.H
+	}{
+		{
+			name:       "replenish",
+			request:    replenish,
+			wantStatus: http.StatusCreated,
+			want:       gin.H{"user_id": 1, "balance": 100, "currency": "RUB"},
+		},
+		{
+			name:       "replenish in a currency",
+			request:    transactionRequest{"/v1/transactions/replenish", gin.H{"user_id": 1, "amount": 100, "currency": "USD"}},
+			wantStatus: http.StatusCreated,
+			want:       gin.H{"balance": 100, "currency": "USD"},
+		},
+		{
+			name:       "replenish with negative amount",
+			request:    transactionRequest{"/v1/transactions/replenish", gin.H{"user_id": 1, "amount": -1}},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "replenish in an unknown currency",
+			request:    transactionRequest{"/v1/transactions/replenish", gin.H{"user_id": 1, "amount": 1, "currency": "XYZ"}},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "reserve",
+			setup:      []transactionRequest{replenish},
+			request:    reserve,
+			wantStatus: http.StatusCreated,
+			want:       gin.H{"balance": 60, "expires_at": nil},
+		},
+		{
+			name:       "reserve over the balance",
+			setup:      []transactionRequest{replenish},
+			request:    transactionRequest{"/v1/transactions/reserve", gin.H{"user_id": 1, "amount": 101, "service_id": 1, "order_id": 1}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "reserve twice",
+			setup:      []transactionRequest{replenish, reserve},
+			request:    reserve,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "reserve with expiry in the past",
+			setup:      []transactionRequest{replenish},
+			request:    transactionRequest{"/v1/transactions/reserve", gin.H{"user_id": 1, "amount": 40, "service_id": 1, "order_id": 1, "expires_at": time.Now().Add(-time.Hour)}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "reserve with both lifetime and expiry",
+			setup:      []transactionRequest{replenish},
+			request:    transactionRequest{"/v1/transactions/reserve", gin.H{"user_id": 1, "amount": 40, "service_id": 1, "order_id": 1, "expires_in": 60, "expires_at": time.Now().Add(time.Hour)}},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "reserve for longer than a year",
+			setup:      []transactionRequest{replenish},
+			request:    transactionRequest{"/v1/transactions/reserve", gin.H{"user_id": 1, "amount": 40, "service_id": 1, "order_id": 1, "expires_in": int64(1) << 62}},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "reserve without order",
+			setup:      []transactionRequest{replenish},
+			request:    transactionRequest{"/v1/transactions/reserve", gin.H{"user_id": 1, "amount": 40, "service_id": 1}},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "adjust reservation",
+			setup:      []transactionRequest{replenish, reserve},
+			request:    transactionRequest{"/v1/transactions/reserve/adjust", gin.H{"user_id": 1, "amount": 70, "service_id": 1, "order_id": 1}},
+			wantStatus: http.StatusCreated,
+			want:       gin.H{"balance": 30, "reserved": 70, "captured": 0, "remaining": 70},
+		},
+		{
+			name:       "adjust missing reservation",
+			setup:      []transactionRequest{replenish},
+			request:    transactionRequest{"/v1/transactions/reserve/adjust", gin.H{"user_id": 1, "amount": 70, "service_id": 1, "order_id": 1}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "withdraw",
+			setup:      []transactionRequest{replenish, reserve},
+			request:    withdraw,
+			wantStatus: http.StatusCreated,
+			want:       gin.H{"balance": 60, "reserved": 40, "captured": 40, "released": 0, "remaining": 0},
+		},
+		{
+			name:       "final partial withdrawal",
+			setup:      []transactionRequest{replenish, reserve},
+			request:    transactionRequest{"/v1/transactions/withdraw", gin.H{"user_id": 1, "amount": 10, "service_id": 1, "order_id": 1, "final": true}},
+			wantStatus: http.StatusCreated,
+			want:       gin.H{"balance": 90, "captured": 10, "released": 30, "remaining": 0},
+		},
+		{
+			name:       "withdraw over the hold",
+			setup:      []transactionRequest{replenish, reserve},
+			request:    transactionRequest{"/v1/transactions/withdraw", gin.H{"user_id": 1, "amount": 41, "service_id": 1, "order_id": 1}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "withdraw twice",
+			setup:      []transactionRequest{replenish, reserve, withdraw},
+			request:    withdraw,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "withdraw cancelled",
+			setup:      []transactionRequest{replenish, reserve, cancel},
+			request:    withdraw,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "withdraw without reservation",
+			setup:      []transactionRequest{replenish},
+			request:    withdraw,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "withdraw without amount",
+			setup:      []transactionRequest{replenish, reserve},
+			request:    transactionRequest{"/v1/transactions/withdraw", gin.H{"user_id": 1, "service_id": 1, "order_id": 1}},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "cancel",
+			setup:      []transactionRequest{replenish, reserve},
+			request:    cancel,
+			wantStatus: http.StatusCreated,
+			want:       gin.H{"balance": 100},
+		},
+		{
+			name:       "cancel twice",
+			setup:      []transactionRequest{replenish, reserve, cancel},
+			request:    cancel,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "cancel withdrawn",
+			setup:      []transactionRequest{replenish, reserve, withdraw},
+			request:    cancel,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "cancel with wrong amount",
+			setup:      []transactionRequest{replenish, reserve},
+			request:    transactionRequest{"/v1/transactions/cancel", gin.H{"user_id": 1, "amount": 30, "service_id": 1, "order_id": 1}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "refund",
+			setup:      []transactionRequest{replenish, reserve, withdraw},
+			request:    transactionRequest{"/v1/transactions/refund", gin.H{"user_id": 1, "amount": 15, "service_id": 1, "order_id": 1}},
+			wantStatus: http.StatusCreated,
+			want:       gin.H{"balance": 75, "captured": 40, "refunded": 15, "refundable": 25},
+		},
+		{
+			name:       "refund over the captured",
+			setup:      []transactionRequest{replenish, reserve, withdraw},
+			request:    transactionRequest{"/v1/transactions/refund", gin.H{"user_id": 1, "amount": 41, "service_id": 1, "order_id": 1}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "refund of an order without revenue",
+			setup:      []transactionRequest{replenish, reserve},
+			request:    transactionRequest{"/v1/transactions/refund", gin.H{"user_id": 1, "amount": 10, "service_id": 1, "order_id": 1}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "transfer",
+			setup:      []transactionRequest{replenish},
+			request:    transactionRequest{"/v1/transactions/transfer", gin.H{"from_user_id": 1, "to_user_id": 2, "amount": 30}},
+			wantStatus: http.StatusCreated,
+			want:       gin.H{"from": map[string]interface{}{"user_id": 1.0, "balance": 70.0, "currency": "RUB"}, "to": map[string]interface{}{"user_id": 2.0, "balance": 30.0, "currency": "RUB"}},
+		},
+		{
+			name:       "transfer to self",
+			setup:      []transactionRequest{replenish},
+			request:    transactionRequest{"/v1/transactions/transfer", gin.H{"from_user_id": 1, "to_user_id": 1, "amount": 30}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "transfer over the balance",
+			setup:      []transactionRequest{replenish},
+			request:    transactionRequest{"/v1/transactions/transfer", gin.H{"from_user_id": 1, "to_user_id": 2, "amount": 101}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "malformed body",
+			request:    transactionRequest{"/v1/transactions/replenish", nil},
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			for _, request := range tt.setup {
+				s.mustPost(t, request.path, request.body)
+			}
+
+			var body interface{} = tt.request.body
+			if tt.request.body == nil {
+				body = "{"
+			}
+			w := s.post(t, tt.request.path, body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+
+			response := decode(t, w)
+			if tt.wantStatus != http.StatusCreated {
+				if _, ok := response["error"]; !ok {
+					t.Errorf("response = %v, want an error", response)
+				}
+				return
+			}
+			assertFields(t, response, tt.want)
+		})
+	}
+}
+
+// assertFields compares the fields of the decoded response, numbers are compared as float64
+func assertFields(t *testing.T, response map[string]interface{}, want gin.H) {
+	t.Helper()
+
+	for name, value := range want {
+		if number, ok := value.(int); ok {
+			value = float64(number)
+		}
+		if got := response[name]; !reflect.DeepEqual(got, value) {
+			t.Errorf("%s = %v, want %v", name, got, value)
+		}
+	}
+}
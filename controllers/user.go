@@ -2,22 +2,53 @@ package controllers
 
 import (
 	"balance-service/services"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"log"
 	"net/http"
+	"time"
 )
 
 type GetUserBalanceInput struct {
-	ID int64 `form:"id" binding:"required,gt=0"`
+	ID       int64  `form:"id" binding:"required,gt=0"`
+	Currency string `form:"currency" binding:"omitempty,iso4217"`
 }
 
-func GetUserBalance(c *gin.Context) {
+type GetUserTransactionsURI struct {
+	ID int64 `uri:"id" binding:"required,gt=0"`
+}
+
+type GetUserTransactionsInput struct {
+	Sort   string `form:"sort" binding:"omitempty,oneof=created_at amount"`
+	Order  string `form:"order" binding:"omitempty,oneof=asc desc"`
+	Limit  int    `form:"limit" binding:"omitempty,min=1,max=100"`
+	Offset int    `form:"offset" binding:"omitempty,min=0"`
+}
+
+type GetUserStatementInput struct {
+	Currency string    `form:"currency" binding:"omitempty,iso4217"`
+	From     time.Time `form:"from" binding:"required" time_format:"2006-01-02" time_utc:"1"`
+	To       time.Time `form:"to" binding:"required" time_format:"2006-01-02" time_utc:"1"`
+	Format   string    `form:"format" binding:"omitempty,oneof=csv json txt"`
+}
+
+type UserController struct {
+	users *services.UserService
+}
+
+func NewUserController(users *services.UserService) *UserController {
+	return &UserController{users: users}
+}
+
+func (ctrl *UserController) GetUserBalance(c *gin.Context) {
 	var input GetUserBalanceInput
 	if err := c.ShouldBind(&input); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
 		return
 	}
 
-	user, reserved, err := services.GetUserBalance(input.ID)
+	balances, err := ctrl.users.GetUserBalance(c.Request.Context(), input.ID)
 
 	if err == services.ErrUserNotExists {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -29,9 +60,168 @@ func GetUserBalance(c *gin.Context) {
 		return
 	}
 
+	// Top level balance and reserved amount are kept in the base currency for clients unaware of currencies
+	response := gin.H{
+		"id":       input.ID,
+		"currency": ctrl.users.BaseCurrency(),
+	}
+
+	items := make([]gin.H, 0, len(balances))
+	for _, e := range balances {
+		items = append(items, gin.H{
+			"currency": e.Currency,
+			"balance":  e.Balance,
+			"reserved": e.Reserved,
+		})
+
+		if e.Currency == ctrl.users.BaseCurrency() {
+			response["balance"] = e.Balance
+			response["reserved"] = e.Reserved
+		}
+	}
+	response["balances"] = items
+
+	if input.Currency != "" {
+		total, err := ctrl.users.ConvertBalance(c.Request.Context(), balances, input.Currency)
+
+		if errors.Is(err, services.ErrRateUnavailable) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		response["currency"] = total.Currency
+		response["balance"] = total.Balance
+		response["reserved"] = total.Reserved
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (ctrl *UserController) GetUserTransactions(c *gin.Context) {
+	var uri GetUserTransactionsURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	input := GetUserTransactionsInput{Sort: "created_at", Order: "desc", Limit: 20}
+	if err := c.ShouldBindQuery(&input); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	transactions, total, err := ctrl.users.GetUserTransactions(c.Request.Context(), uri.ID, input.Sort, input.Order == "desc", input.Limit, input.Offset)
+
+	if err == services.ErrUserNotExists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	items := make([]gin.H, 0, len(transactions))
+	for _, e := range transactions {
+		item := gin.H{
+			"id":                 e.ID,
+			"amount":             e.Amount,
+			"currency":           e.Currency,
+			"is_reserve_account": e.IsReserveAccount(),
+			"created_at":         e.CreatedAt,
+			"service_id":         nil,
+			"order_id":           nil,
+			"description":        services.DescribeTransaction(e),
+			"reason":             nil,
+		}
+		if e.ServiceID.Valid {
+			item["service_id"] = e.ServiceID.Int64
+		}
+		if e.OrderID.Valid {
+			item["order_id"] = e.OrderID.Int64
+		}
+		if e.Reason.Valid {
+			item["reason"] = e.Reason.String
+		}
+
+		items = append(items, item)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"id":       user.ID,
-		"balance":  user.Balance,
-		"reserved": reserved,
+		"transactions": items,
+		"total":        total,
+		"limit":        input.Limit,
+		"offset":       input.Offset,
 	})
 }
+
+func (ctrl *UserController) GetUserStatement(c *gin.Context) {
+	var uri GetUserTransactionsURI
+	if err := c.ShouldBindUri(&uri); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	input := GetUserStatementInput{Format: "csv"}
+	if err := c.ShouldBindQuery(&input); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Headers are sent with the first statement line, so validation errors are still reported as JSON
+	w := &statementResponseWriter{
+		c:           c,
+		contentType: services.StatementFormats[input.Format],
+		fileName:    fmt.Sprintf("statement-%d-%s-%s.%s", uri.ID, input.From.Format("20060102"), input.To.Format("20060102"), input.Format),
+	}
+
+	statementWriter, err := services.NewStatementWriter(input.Format, w)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The last day of the period is included
+	err = ctrl.users.WriteStatement(c.Request.Context(), uri.ID, input.Currency, input.From, input.To.AddDate(0, 0, 1), statementWriter)
+
+	if w.started {
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if err == services.ErrUserNotExists || err == services.ErrInvalidStatementPeriod {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+}
+
+type statementResponseWriter struct {
+	c           *gin.Context
+	contentType string
+	fileName    string
+	started     bool
+}
+
+func (w *statementResponseWriter) Write(data []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.c.Header("Content-Type", w.contentType)
+		w.c.Header("Content-Disposition", `attachment; filename="`+w.fileName+`"`)
+		w.c.Status(http.StatusOK)
+	}
+
+	return w.c.Writer.Write(data)
+}
@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetUserBalance(t *testing.T) {
+	s := newTestServer(t)
+	s.mustPost(t, "/v1/transactions/replenish", gin.H{"user_id": 1, "amount": 100})
+	s.mustPost(t, "/v1/transactions/replenish", gin.H{"user_id": 1, "amount": 500, "currency": "USD"})
+	s.mustPost(t, "/v1/transactions/reserve", gin.H{"user_id": 1, "amount": 40, "service_id": 1, "order_id": 1})
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		want       gin.H
+	}{
+		{name: "base currency", query: "id=1", wantStatus: http.StatusOK, want: gin.H{"id": 1, "currency": "RUB", "balance": 60, "reserved": 40}},
+		{name: "unknown user", query: "id=2", wantStatus: http.StatusBadRequest},
+		{name: "without id", query: "", wantStatus: http.StatusUnprocessableEntity},
+		{name: "invalid currency", query: "id=1&currency=rub", wantStatus: http.StatusUnprocessableEntity},
+		{name: "conversion without rates", query: "id=1&currency=EUR", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.request(t, http.MethodGet, "/v1/users?"+tt.query, s.readKey, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			response := decode(t, w)
+			assertFields(t, response, tt.want)
+
+			if tt.wantStatus == http.StatusOK {
+				if balances, _ := response["balances"].([]interface{}); len(balances) != 2 {
+					t.Errorf("balances = %v, want RUB and USD", response["balances"])
+				}
+			}
+		})
+	}
+}
+
+func TestGetUserTransactions(t *testing.T) {
+	s := newTestServer(t)
+	s.mustPost(t, "/v1/transactions/replenish", gin.H{"user_id": 1, "amount": 100})
+	s.mustPost(t, "/v1/transactions/reserve", gin.H{"user_id": 1, "amount": 40, "service_id": 1, "order_id": 1})
+	s.mustPost(t, "/v1/transactions/withdraw", gin.H{"user_id": 1, "amount": 40, "service_id": 1, "order_id": 1})
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantCount  int
+		// wantFirst is the description of the first listed transaction
+		wantFirst string
+	}{
+		{name: "latest first", path: "/v1/users/1/transactions", wantStatus: http.StatusOK, wantCount: 4, wantFirst: "revenue recognized for order 1 of service 1"},
+		{name: "earliest first", path: "/v1/users/1/transactions?order=asc", wantStatus: http.StatusOK, wantCount: 4, wantFirst: "replenishment"},
+		{name: "largest first", path: "/v1/users/1/transactions?sort=amount&order=desc", wantStatus: http.StatusOK, wantCount: 4, wantFirst: "replenishment"},
+		{name: "page", path: "/v1/users/1/transactions?order=asc&limit=2&offset=1", wantStatus: http.StatusOK, wantCount: 2, wantFirst: "moved to reserve for order 1 of service 1"},
+		{name: "unknown user", path: "/v1/users/2/transactions", wantStatus: http.StatusBadRequest},
+		{name: "invalid id", path: "/v1/users/x/transactions", wantStatus: http.StatusUnprocessableEntity},
+		{name: "unknown sort", path: "/v1/users/1/transactions?sort=id", wantStatus: http.StatusUnprocessableEntity},
+		{name: "limit too large", path: "/v1/users/1/transactions?limit=101", wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.request(t, http.MethodGet, tt.path, s.readKey, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			response := decode(t, w)
+			transactions, _ := response["transactions"].([]interface{})
+			if len(transactions) != tt.wantCount || response["total"] != 4.0 {
+				t.Fatalf("got %d of %v transactions, want %d of 4", len(transactions), response["total"], tt.wantCount)
+			}
+			if first := transactions[0].(map[string]interface{}); first["description"] != tt.wantFirst {
+				t.Errorf("first = %v, want %q", first, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestGetUserStatement(t *testing.T) {
+	s := newTestServer(t)
+	s.mustPost(t, "/v1/transactions/replenish", gin.H{"user_id": 1, "amount": 100})
+	s.mustPost(t, "/v1/transactions/reserve", gin.H{"user_id": 1, "amount": 40, "service_id": 1, "order_id": 1})
+	today := time.Now().UTC().Format("2006-01-02")
+	period := fmt.Sprintf("from=%s&to=%s", today, today)
+
+	tests := []struct {
+		name            string
+		query           string
+		wantStatus      int
+		wantContentType string
+		wantContent     string
+	}{
+		{name: "csv by default", query: period, wantStatus: http.StatusOK, wantContentType: "text/csv; charset=utf-8", wantContent: "moved to reserve for order 1 of service 1,-40,60,RUB"},
+		{name: "json", query: period + "&format=json", wantStatus: http.StatusOK, wantContentType: "application/json; charset=utf-8", wantContent: `"closing_balance":60}`},
+		{name: "txt", query: period + "&format=txt", wantStatus: http.StatusOK, wantContentType: "text/plain; charset=utf-8", wantContent: "Closing balance: 60"},
+		{name: "unsupported format", query: period + "&format=pdf", wantStatus: http.StatusUnprocessableEntity},
+		{name: "without period", query: "format=csv", wantStatus: http.StatusUnprocessableEntity},
+		{name: "period ends before it starts", query: fmt.Sprintf("from=%s&to=2000-01-01", today), wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.request(t, http.MethodGet, "/v1/users/1/statement?"+tt.query, s.readKey, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				decode(t, w)
+				return
+			}
+
+			if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			if !strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment; filename=\"statement-1-") {
+				t.Errorf("Content-Disposition = %q", w.Header().Get("Content-Disposition"))
+			}
+			if !strings.Contains(w.Body.String(), tt.wantContent) {
+				t.Errorf("statement = %s, want %q in it", w.Body, tt.wantContent)
+			}
+		})
+	}
+
+	if w := s.request(t, http.MethodGet, "/v1/users/2/statement?"+period, s.readKey, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("statement of unknown user = %d %s, want %d", w.Code, w.Body, http.StatusBadRequest)
+	}
+}
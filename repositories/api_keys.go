@@ -0,0 +1,109 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"time"
+)
+
+type APIKey struct {
+	ID   int64  `db:"id"`
+	Name string `db:"name"`
+	// KeyPrefix is the beginning of the key which is kept to tell the keys apart
+	KeyPrefix  string         `db:"key_prefix"`
+	KeyHash    string         `db:"key_hash"`
+	Scopes     pq.StringArray `db:"scopes"`
+	ServiceIDs pq.Int64Array  `db:"service_ids"`
+	CreatedAt  time.Time      `db:"created_at"`
+	RevokedAt  sql.NullTime   `db:"revoked_at"`
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsService reports whether the key is bound to the service
+func (k *APIKey) AllowsService(serviceID int64) bool {
+	for _, ID := range k.ServiceIDs {
+		if ID == serviceID {
+			return true
+		}
+	}
+
+	return false
+}
+
+type PostgresAPIKeyRepository struct {
+	db sqlx.ExtContext
+}
+
+func NewPostgresAPIKeyRepository(db sqlx.ExtContext) *PostgresAPIKeyRepository {
+	return &PostgresAPIKeyRepository{db: db}
+}
+
+func (r *PostgresAPIKeyRepository) StoreAPIKey(ctx context.Context, key *APIKey) error {
+	insertQuery := "INSERT INTO api_keys (name, key_prefix, key_hash, scopes, service_ids, created_at) VALUES (:name, :key_prefix, :key_hash, :scopes, :service_ids, :created_at) RETURNING id"
+	rows, err := sqlx.NamedQueryContext(ctx, r.db, insertQuery, key)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		if err := rows.Scan(&key.ID); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (r *PostgresAPIKeyRepository) GetActiveAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	var key APIKey
+	selectQuery := "SELECT * FROM api_keys WHERE key_hash=$1 AND revoked_at IS NULL LIMIT 1"
+
+	err := sqlx.GetContext(ctx, r.db, &key, selectQuery, keyHash)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &key, nil
+}
+
+func (r *PostgresAPIKeyRepository) GetAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+	selectQuery := "SELECT * FROM api_keys ORDER BY id"
+
+	err := sqlx.SelectContext(ctx, r.db, &keys, selectQuery)
+
+	return keys, err
+}
+
+func (r *PostgresAPIKeyRepository) RevokeAPIKey(ctx context.Context, ID int64, at time.Time) (bool, error) {
+	updateQuery := "UPDATE api_keys SET revoked_at=$1 WHERE id=$2 AND revoked_at IS NULL"
+
+	result, err := r.db.ExecContext(ctx, updateQuery, at, ID)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
@@ -0,0 +1,114 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"time"
+)
+
+type IdempotencyKey struct {
+	// APIKeyID is the client which claimed the key, zero for keys claimed without an API key
+	APIKeyID     int64         `db:"api_key_id"`
+	Key          string        `db:"key"`
+	Endpoint     string        `db:"endpoint"`
+	RequestHash  string        `db:"request_hash"`
+	StatusCode   sql.NullInt32 `db:"status_code"`
+	ResponseBody []byte        `db:"response_body"`
+	// ClaimToken identifies the request which claimed the key the last time
+	ClaimToken string `db:"claim_token"`
+	// AppliedAt is set together with the balance changes of the request, the key is never claimed again after that
+	AppliedAt sql.NullTime `db:"applied_at"`
+	CreatedAt time.Time    `db:"created_at"`
+}
+
+type PostgresIdempotencyKeyRepository struct {
+	db sqlx.ExtContext
+}
+
+func NewPostgresIdempotencyKeyRepository(db sqlx.ExtContext) *PostgresIdempotencyKeyRepository {
+	return &PostgresIdempotencyKeyRepository{db: db}
+}
+
+func (r *PostgresIdempotencyKeyRepository) StoreIdempotencyKeyIfNotExists(ctx context.Context, idempotencyKey *IdempotencyKey) (bool, error) {
+	insertQuery := "INSERT INTO idempotency_keys (api_key_id, key, endpoint, request_hash, claim_token, created_at) VALUES (:api_key_id, :key, :endpoint, :request_hash, :claim_token, :created_at) ON CONFLICT DO NOTHING"
+
+	result, err := sqlx.NamedExecContext(ctx, r.db, insertQuery, idempotencyKey)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (r *PostgresIdempotencyKeyRepository) GetIdempotencyKey(ctx context.Context, apiKeyID int64, key string, endpoint string) (*IdempotencyKey, error) {
+	var idempotencyKey IdempotencyKey
+	selectQuery := "SELECT * FROM idempotency_keys WHERE api_key_id=$1 AND key=$2 AND endpoint=$3 LIMIT 1"
+
+	err := sqlx.GetContext(ctx, r.db, &idempotencyKey, selectQuery, apiKeyID, key, endpoint)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &idempotencyKey, nil
+}
+
+func (r *PostgresIdempotencyKeyRepository) ReclaimStaleIdempotencyKey(ctx context.Context, apiKeyID int64, key string, endpoint string, staleBefore time.Time, claimedAt time.Time, claimToken string) (bool, error) {
+	updateQuery := "UPDATE idempotency_keys SET created_at=$1, claim_token=$2 WHERE api_key_id=$3 AND key=$4 AND endpoint=$5 AND status_code IS NULL AND applied_at IS NULL AND created_at < $6"
+
+	result, err := r.db.ExecContext(ctx, updateQuery, claimedAt, claimToken, apiKeyID, key, endpoint, staleBefore)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (r *PostgresIdempotencyKeyRepository) MarkIdempotencyKeyApplied(ctx context.Context, apiKeyID int64, key string, endpoint string, claimToken string, at time.Time) (bool, error) {
+	updateQuery := "UPDATE idempotency_keys SET applied_at=$1 WHERE api_key_id=$2 AND key=$3 AND endpoint=$4 AND claim_token=$5 AND status_code IS NULL"
+
+	result, err := r.db.ExecContext(ctx, updateQuery, at, apiKeyID, key, endpoint, claimToken)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (r *PostgresIdempotencyKeyRepository) UpdateIdempotencyKeyResponse(ctx context.Context, apiKeyID int64, key string, endpoint string, claimToken string, statusCode int, responseBody []byte) error {
+	updateQuery := "UPDATE idempotency_keys SET status_code=$1, response_body=$2 WHERE api_key_id=$3 AND key=$4 AND endpoint=$5 AND claim_token=$6"
+
+	_, err := r.db.ExecContext(ctx, updateQuery, statusCode, responseBody, apiKeyID, key, endpoint, claimToken)
+
+	return err
+}
+
+func (r *PostgresIdempotencyKeyRepository) DeleteIdempotencyKey(ctx context.Context, apiKeyID int64, key string, endpoint string, claimToken string) error {
+	deleteQuery := "DELETE FROM idempotency_keys WHERE api_key_id=$1 AND key=$2 AND endpoint=$3 AND claim_token=$4 AND applied_at IS NULL"
+
+	_, err := r.db.ExecContext(ctx, deleteQuery, apiKeyID, key, endpoint, claimToken)
+
+	return err
+}
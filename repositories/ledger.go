@@ -0,0 +1,235 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"time"
+)
+
+const (
+	AccountUserMain       = "user_main"
+	AccountUserReserve    = "user_reserve"
+	AccountServiceRevenue = "service_revenue"
+	AccountExternalCash   = "external_cash"
+	AccountAdjustment     = "adjustment"
+)
+
+const (
+	EntryReplenishment         = "replenishment"
+	EntryReservation           = "reservation"
+	EntryReservationAdjustment = "reservation_adjustment"
+	EntryWithdrawal            = "withdrawal"
+	EntryCancellation          = "cancellation"
+	EntryRelease               = "release"
+	EntryExpiration            = "expiration"
+	EntryRefund                = "refund"
+	EntryTransfer              = "transfer"
+	EntryAdjustment            = "adjustment"
+)
+
+var ErrUnbalancedJournalEntry = errors.New("journal entry postings should sum to zero in every currency")
+
+type Account struct {
+	ID        int64         `db:"id"`
+	Type      string        `db:"type"`
+	UserID    sql.NullInt64 `db:"user_id"`
+	ServiceID sql.NullInt64 `db:"service_id"`
+	Currency  string        `db:"currency"`
+	// Balance is materialized for user accounts only, system accounts are summed from postings to avoid a hot row
+	Balance int64 `db:"balance"`
+}
+
+// AccountKey identifies an account, zero ids mean the account is not owned by a user or a service
+type AccountKey struct {
+	Type      string
+	UserID    int64
+	ServiceID int64
+	Currency  string
+}
+
+func UserMainAccount(userID int64, currency string) AccountKey {
+	return AccountKey{Type: AccountUserMain, UserID: userID, Currency: currency}
+}
+
+func UserReserveAccount(userID int64, currency string) AccountKey {
+	return AccountKey{Type: AccountUserReserve, UserID: userID, Currency: currency}
+}
+
+func ServiceRevenueAccount(serviceID int64, currency string) AccountKey {
+	return AccountKey{Type: AccountServiceRevenue, ServiceID: serviceID, Currency: currency}
+}
+
+func ExternalCashAccount(currency string) AccountKey {
+	return AccountKey{Type: AccountExternalCash, Currency: currency}
+}
+
+func AdjustmentAccount(currency string) AccountKey {
+	return AccountKey{Type: AccountAdjustment, Currency: currency}
+}
+
+// IsUserAccount reports whether the account belongs to a user and so can't go below zero
+func IsUserAccount(accountType string) bool {
+	return accountType == AccountUserMain || accountType == AccountUserReserve
+}
+
+// JournalEntry is a single business operation, postings are rows of the transactions table
+type JournalEntry struct {
+	ID        int64     `db:"id"`
+	Type      string    `db:"type"`
+	CreatedAt time.Time `db:"created_at"`
+	// Reason explains entries the system stores on its own, like expiration of reservations
+	Reason   sql.NullString `db:"reason"`
+	Postings []Transaction  `db:"-"`
+}
+
+// IsBalanced checks the postings sum to zero in every currency
+func (e *JournalEntry) IsBalanced() bool {
+	sums := map[string]int64{}
+	for _, posting := range e.Postings {
+		sums[posting.Currency] += posting.Amount
+	}
+
+	for _, sum := range sums {
+		if sum != 0 {
+			return false
+		}
+	}
+
+	return len(e.Postings) > 0
+}
+
+// AccountCheck compares the materialized balance of a user account with the sum of its postings
+type AccountCheck struct {
+	Account
+	ComputedBalance int64 `db:"computed_balance"`
+}
+
+type PostgresLedgerRepository struct {
+	db sqlx.ExtContext
+}
+
+func NewPostgresLedgerRepository(db sqlx.ExtContext) *PostgresLedgerRepository {
+	return &PostgresLedgerRepository{db: db}
+}
+
+func (r *PostgresLedgerRepository) GetAccount(ctx context.Context, key AccountKey) (*Account, error) {
+	var account Account
+	accountQuery := `SELECT * FROM accounts
+			WHERE type=$1 AND coalesce(user_id, 0)=$2 AND coalesce(service_id, 0)=$3 AND currency=$4`
+
+	err := sqlx.GetContext(ctx, r.db, &account, accountQuery, key.Type, key.UserID, key.ServiceID, key.Currency)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &account, nil
+}
+
+func (r *PostgresLedgerRepository) GetOrCreateAccount(ctx context.Context, key AccountKey) (*Account, error) {
+	insertAccountQuery := `INSERT INTO accounts (type, user_id, service_id, currency) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (type, coalesce(user_id, 0), coalesce(service_id, 0), currency) DO NOTHING`
+
+	userID := sql.NullInt64{Int64: key.UserID, Valid: key.UserID != 0}
+	serviceID := sql.NullInt64{Int64: key.ServiceID, Valid: key.ServiceID != 0}
+
+	if _, err := r.db.ExecContext(ctx, insertAccountQuery, key.Type, userID, serviceID, key.Currency); err != nil {
+		return nil, err
+	}
+
+	return r.GetAccount(ctx, key)
+}
+
+func (r *PostgresLedgerRepository) StoreJournalEntry(ctx context.Context, entry *JournalEntry) error {
+	return r.storeJournalEntry(ctx, entry, true)
+}
+
+func (r *PostgresLedgerRepository) StoreAdjustmentEntry(ctx context.Context, entry *JournalEntry) error {
+	return r.storeJournalEntry(ctx, entry, false)
+}
+
+func (r *PostgresLedgerRepository) storeJournalEntry(ctx context.Context, entry *JournalEntry, materialize bool) error {
+	if !entry.IsBalanced() {
+		return ErrUnbalancedJournalEntry
+	}
+
+	insertEntryQuery := "INSERT INTO journal_entries (type, created_at, reason) VALUES ($1, $2, $3) RETURNING id"
+	if err := r.db.QueryRowxContext(ctx, insertEntryQuery, entry.Type, entry.CreatedAt, entry.Reason).Scan(&entry.ID); err != nil {
+		return err
+	}
+
+	insertPostingQuery := "INSERT INTO transactions (entry_id, account_id, user_id, created_at, amount, currency, service_id, order_id, canceled_transaction_id, related_transaction_id, expires_at) VALUES (:entry_id, :account_id, :user_id, :created_at, :amount, :currency, :service_id, :order_id, :canceled_transaction_id, :related_transaction_id, :expires_at) RETURNING id"
+	updateBalanceQuery := "UPDATE accounts SET balance = balance + $1 WHERE id=$2"
+
+	for i := range entry.Postings {
+		posting := &entry.Postings[i]
+		posting.EntryID = entry.ID
+		posting.CreatedAt = entry.CreatedAt
+
+		if err := storePosting(ctx, r.db, insertPostingQuery, posting); err != nil {
+			return err
+		}
+
+		if !materialize || !IsUserAccount(posting.AccountType) {
+			continue
+		}
+
+		if _, err := r.db.ExecContext(ctx, updateBalanceQuery, posting.Amount, posting.AccountID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *PostgresLedgerRepository) GetUserAccountChecks(ctx context.Context, afterAccountID int64, limit int) ([]AccountCheck, error) {
+	var checks []AccountCheck
+	checksQuery := `select a.*, coalesce(sum(t.amount), 0) as computed_balance
+			from accounts a
+			         left join transactions t on t.account_id = a.id
+			where a.type in ('user_main', 'user_reserve')
+			  and a.id > $1
+			group by a.id
+			order by a.id
+			limit $2`
+
+	if err := sqlx.SelectContext(ctx, r.db, &checks, checksQuery, afterAccountID, limit); err != nil {
+		return nil, err
+	}
+
+	return checks, nil
+}
+
+func (r *PostgresLedgerRepository) GetAccountComputedBalance(ctx context.Context, accountID int64) (int64, error) {
+	var sum int64
+	err := r.db.QueryRowxContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE account_id=$1", accountID).Scan(&sum)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return sum, nil
+}
+
+func storePosting(ctx context.Context, db sqlx.ExtContext, query string, posting *Transaction) error {
+	rows, err := sqlx.NamedQueryContext(ctx, db, query, posting)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		if err := rows.Scan(&posting.ID); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
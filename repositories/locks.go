@@ -0,0 +1,47 @@
+package repositories
+
+import (
+	"context"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// Locker takes locks shared by all replicas of the service
+type Locker interface {
+	// TryLock takes the lock without waiting, release should be called once the work is done
+	TryLock(ctx context.Context, key int64) (release func(), acquired bool, err error)
+}
+
+// PostgresLocker holds session advisory locks, each lock keeps its own connection until released
+type PostgresLocker struct {
+	db *sqlx.DB
+}
+
+func NewPostgresLocker(db *sqlx.DB) *PostgresLocker {
+	return &PostgresLocker{db: db}
+}
+
+func (l *PostgresLocker) TryLock(ctx context.Context, key int64) (func(), bool, error) {
+	conn, err := l.db.Connx(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var acquired bool
+	if err := conn.QueryRowxContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired); err != nil {
+		_ = conn.Close()
+		return nil, false, err
+	}
+
+	if !acquired {
+		_ = conn.Close()
+		return nil, false, nil
+	}
+
+	release := func() {
+		_, _ = conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+		_ = conn.Close()
+	}
+
+	return release, true, nil
+}
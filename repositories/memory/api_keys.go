@@ -0,0 +1,58 @@
+package memory
+
+import (
+	"balance-service/repositories"
+	"context"
+	"database/sql"
+	"time"
+)
+
+type APIKeyRepository struct {
+	session *session
+}
+
+func (r *APIKeyRepository) StoreAPIKey(ctx context.Context, key *repositories.APIKey) error {
+	return r.session.do(func(st *state) error {
+		key.ID = int64(len(st.apiKeys)) + 1
+		st.apiKeys = append(st.apiKeys, *key)
+		return nil
+	})
+}
+
+func (r *APIKeyRepository) GetActiveAPIKeyByHash(ctx context.Context, keyHash string) (*repositories.APIKey, error) {
+	var key *repositories.APIKey
+	err := r.session.do(func(st *state) error {
+		for _, found := range st.apiKeys {
+			if found.KeyHash == keyHash && !found.RevokedAt.Valid {
+				key = &found
+				break
+			}
+		}
+		return nil
+	})
+
+	return key, err
+}
+
+func (r *APIKeyRepository) GetAPIKeys(ctx context.Context) ([]repositories.APIKey, error) {
+	var keys []repositories.APIKey
+	err := r.session.do(func(st *state) error {
+		keys = append(keys, st.apiKeys...)
+		return nil
+	})
+
+	return keys, err
+}
+
+func (r *APIKeyRepository) RevokeAPIKey(ctx context.Context, ID int64, at time.Time) (bool, error) {
+	var revoked bool
+	err := r.session.do(func(st *state) error {
+		if ID >= 1 && ID <= int64(len(st.apiKeys)) && !st.apiKeys[ID-1].RevokedAt.Valid {
+			st.apiKeys[ID-1].RevokedAt = sql.NullTime{Time: at, Valid: true}
+			revoked = true
+		}
+		return nil
+	})
+
+	return revoked, err
+}
@@ -0,0 +1,93 @@
+package memory
+
+import (
+	"balance-service/repositories"
+	"context"
+	"database/sql"
+	"time"
+)
+
+type IdempotencyKeyRepository struct {
+	session *session
+}
+
+func (r *IdempotencyKeyRepository) StoreIdempotencyKeyIfNotExists(ctx context.Context, idempotencyKey *repositories.IdempotencyKey) (bool, error) {
+	var stored bool
+	err := r.session.do(func(st *state) error {
+		id := idempotencyKeyID{apiKeyID: idempotencyKey.APIKeyID, key: idempotencyKey.Key, endpoint: idempotencyKey.Endpoint}
+		if _, ok := st.idempotencyKeys[id]; ok {
+			return nil
+		}
+
+		st.idempotencyKeys[id] = *idempotencyKey
+		stored = true
+		return nil
+	})
+
+	return stored, err
+}
+
+func (r *IdempotencyKeyRepository) GetIdempotencyKey(ctx context.Context, apiKeyID int64, key string, endpoint string) (*repositories.IdempotencyKey, error) {
+	var idempotencyKey *repositories.IdempotencyKey
+	err := r.session.do(func(st *state) error {
+		if found, ok := st.idempotencyKeys[idempotencyKeyID{apiKeyID: apiKeyID, key: key, endpoint: endpoint}]; ok {
+			idempotencyKey = &found
+		}
+		return nil
+	})
+
+	return idempotencyKey, err
+}
+
+func (r *IdempotencyKeyRepository) ReclaimStaleIdempotencyKey(ctx context.Context, apiKeyID int64, key string, endpoint string, staleBefore time.Time, claimedAt time.Time, claimToken string) (bool, error) {
+	var reclaimed bool
+	err := r.session.do(func(st *state) error {
+		id := idempotencyKeyID{apiKeyID: apiKeyID, key: key, endpoint: endpoint}
+		if found, ok := st.idempotencyKeys[id]; ok && !found.StatusCode.Valid && !found.AppliedAt.Valid && found.CreatedAt.Before(staleBefore) {
+			found.CreatedAt = claimedAt
+			found.ClaimToken = claimToken
+			st.idempotencyKeys[id] = found
+			reclaimed = true
+		}
+		return nil
+	})
+
+	return reclaimed, err
+}
+
+func (r *IdempotencyKeyRepository) MarkIdempotencyKeyApplied(ctx context.Context, apiKeyID int64, key string, endpoint string, claimToken string, at time.Time) (bool, error) {
+	var applied bool
+	err := r.session.do(func(st *state) error {
+		id := idempotencyKeyID{apiKeyID: apiKeyID, key: key, endpoint: endpoint}
+		if found, ok := st.idempotencyKeys[id]; ok && found.ClaimToken == claimToken && !found.StatusCode.Valid {
+			found.AppliedAt = sql.NullTime{Time: at, Valid: true}
+			st.idempotencyKeys[id] = found
+			applied = true
+		}
+		return nil
+	})
+
+	return applied, err
+}
+
+func (r *IdempotencyKeyRepository) UpdateIdempotencyKeyResponse(ctx context.Context, apiKeyID int64, key string, endpoint string, claimToken string, statusCode int, responseBody []byte) error {
+	return r.session.do(func(st *state) error {
+		id := idempotencyKeyID{apiKeyID: apiKeyID, key: key, endpoint: endpoint}
+		if found, ok := st.idempotencyKeys[id]; ok && found.ClaimToken == claimToken {
+			found.StatusCode = sql.NullInt32{Int32: int32(statusCode), Valid: true}
+			found.ResponseBody = append([]byte(nil), responseBody...)
+			st.idempotencyKeys[id] = found
+		}
+		return nil
+	})
+}
+
+func (r *IdempotencyKeyRepository) DeleteIdempotencyKey(ctx context.Context, apiKeyID int64, key string, endpoint string, claimToken string) error {
+	return r.session.do(func(st *state) error {
+		id := idempotencyKeyID{apiKeyID: apiKeyID, key: key, endpoint: endpoint}
+		if found, ok := st.idempotencyKeys[id]; ok && found.ClaimToken == claimToken && !found.AppliedAt.Valid {
+			delete(st.idempotencyKeys, id)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,171 @@
+package memory
+
+import (
+	"balance-service/repositories"
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+type LedgerRepository struct {
+	session *session
+}
+
+func (r *LedgerRepository) GetAccount(ctx context.Context, key repositories.AccountKey) (*repositories.Account, error) {
+	var account *repositories.Account
+	err := r.session.do(func(st *state) error {
+		if found := st.account(st.accountIDs[key]); found != nil {
+			copied := *found
+			account = &copied
+		}
+		return nil
+	})
+
+	return account, err
+}
+
+func (r *LedgerRepository) GetOrCreateAccount(ctx context.Context, key repositories.AccountKey) (*repositories.Account, error) {
+	var account repositories.Account
+	err := r.session.do(func(st *state) error {
+		if found := st.account(st.accountIDs[key]); found != nil {
+			account = *found
+			return nil
+		}
+
+		if key.UserID != 0 {
+			if _, ok := st.users[key.UserID]; !ok {
+				return fmt.Errorf("user %d does not exist", key.UserID)
+			}
+		}
+
+		account = repositories.Account{
+			ID:        int64(len(st.accounts)) + 1,
+			Type:      key.Type,
+			UserID:    sql.NullInt64{Int64: key.UserID, Valid: key.UserID != 0},
+			ServiceID: sql.NullInt64{Int64: key.ServiceID, Valid: key.ServiceID != 0},
+			Currency:  key.Currency,
+		}
+		st.accounts = append(st.accounts, account)
+		st.accountIDs[key] = account.ID
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+func (r *LedgerRepository) StoreJournalEntry(ctx context.Context, entry *repositories.JournalEntry) error {
+	return r.storeJournalEntry(entry, true)
+}
+
+func (r *LedgerRepository) StoreAdjustmentEntry(ctx context.Context, entry *repositories.JournalEntry) error {
+	return r.storeJournalEntry(entry, false)
+}
+
+func (r *LedgerRepository) storeJournalEntry(entry *repositories.JournalEntry, materialize bool) error {
+	if !entry.IsBalanced() {
+		return repositories.ErrUnbalancedJournalEntry
+	}
+
+	return r.session.do(func(st *state) error {
+		// Balances are checked before anything is changed, so a failed entry leaves no trace outside of transactions
+		balances := map[int64]int64{}
+		for _, posting := range entry.Postings {
+			account := st.account(posting.AccountID)
+			if account == nil {
+				return fmt.Errorf("account %d does not exist", posting.AccountID)
+			}
+			if account.UserID.Valid && !r.session.isUserLocked(account.UserID.Int64) {
+				return fmt.Errorf("%w: user %d", ErrUserNotLocked, account.UserID.Int64)
+			}
+			if !materialize || !repositories.IsUserAccount(account.Type) {
+				continue
+			}
+
+			if _, ok := balances[account.ID]; !ok {
+				balances[account.ID] = account.Balance
+			}
+			balances[account.ID] += posting.Amount
+			if balances[account.ID] < 0 {
+				return ErrNegativeBalance
+			}
+		}
+
+		entry.ID = int64(len(st.entries)) + 1
+		st.entries = append(st.entries, repositories.JournalEntry{ID: entry.ID, Type: entry.Type, CreatedAt: entry.CreatedAt, Reason: entry.Reason})
+
+		for i := range entry.Postings {
+			posting := &entry.Postings[i]
+			posting.ID = int64(len(st.transactions)) + 1
+			posting.EntryID = entry.ID
+			posting.AccountType = st.account(posting.AccountID).Type
+			posting.CreatedAt = entry.CreatedAt
+			st.transactions = append(st.transactions, *posting)
+		}
+
+		for id, balance := range balances {
+			st.account(id).Balance = balance
+		}
+
+		return nil
+	})
+}
+
+func (r *LedgerRepository) GetUserAccountChecks(ctx context.Context, afterAccountID int64, limit int) ([]repositories.AccountCheck, error) {
+	var checks []repositories.AccountCheck
+	err := r.session.do(func(st *state) error {
+		for _, account := range st.accounts {
+			if len(checks) == limit {
+				break
+			}
+			if account.ID <= afterAccountID || !repositories.IsUserAccount(account.Type) {
+				continue
+			}
+
+			checks = append(checks, repositories.AccountCheck{Account: account, ComputedBalance: st.computedBalance(account.ID)})
+		}
+		return nil
+	})
+
+	return checks, err
+}
+
+func (r *LedgerRepository) GetAccountComputedBalance(ctx context.Context, accountID int64) (int64, error) {
+	var sum int64
+	err := r.session.do(func(st *state) error {
+		sum = st.computedBalance(accountID)
+		return nil
+	})
+
+	return sum, err
+}
+
+func (st *state) computedBalance(accountID int64) int64 {
+	var sum int64
+	for _, t := range st.transactions {
+		if t.AccountID == accountID {
+			sum += t.Amount
+		}
+	}
+
+	return sum
+}
+
+func (st *state) account(ID int64) *repositories.Account {
+	if ID < 1 || ID > int64(len(st.accounts)) {
+		return nil
+	}
+
+	return &st.accounts[ID-1]
+}
+
+func (st *state) entry(ID int64) *repositories.JournalEntry {
+	if ID < 1 || ID > int64(len(st.entries)) {
+		return nil
+	}
+
+	return &st.entries[ID-1]
+}
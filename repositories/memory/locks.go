@@ -0,0 +1,35 @@
+package memory
+
+import (
+	"context"
+	"sync"
+)
+
+// Locker keeps locks in process memory, so it only guards against concurrent runs within a single process
+type Locker struct {
+	mu   sync.Mutex
+	held map[int64]bool
+}
+
+func NewLocker() *Locker {
+	return &Locker{held: map[int64]bool{}}
+}
+
+func (l *Locker) TryLock(ctx context.Context, key int64) (func(), bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.held[key] {
+		return nil, false, nil
+	}
+	l.held[key] = true
+
+	release := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		delete(l.held, key)
+	}
+
+	return release, true, nil
+}
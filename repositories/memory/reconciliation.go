@@ -0,0 +1,74 @@
+package memory
+
+import (
+	"balance-service/repositories"
+	"context"
+)
+
+type ReconciliationRepository struct {
+	session *session
+}
+
+func (r *ReconciliationRepository) StoreReconciliationRun(ctx context.Context, run *repositories.ReconciliationRun) error {
+	return r.session.do(func(st *state) error {
+		run.ID = int64(len(st.reconciliations)) + 1
+		st.reconciliations = append(st.reconciliations, *run)
+		return nil
+	})
+}
+
+func (r *ReconciliationRepository) UpdateReconciliationRun(ctx context.Context, run *repositories.ReconciliationRun) error {
+	return r.session.do(func(st *state) error {
+		if run.ID >= 1 && run.ID <= int64(len(st.reconciliations)) {
+			st.reconciliations[run.ID-1] = *run
+		}
+		return nil
+	})
+}
+
+func (r *ReconciliationRepository) GetReconciliationRun(ctx context.Context, ID int64) (*repositories.ReconciliationRun, error) {
+	var run *repositories.ReconciliationRun
+	err := r.session.do(func(st *state) error {
+		if ID >= 1 && ID <= int64(len(st.reconciliations)) {
+			found := st.reconciliations[ID-1]
+			run = &found
+		}
+		return nil
+	})
+
+	return run, err
+}
+
+func (r *ReconciliationRepository) GetReconciliationRuns(ctx context.Context, limit int) ([]repositories.ReconciliationRun, error) {
+	var runs []repositories.ReconciliationRun
+	err := r.session.do(func(st *state) error {
+		for i := len(st.reconciliations) - 1; i >= 0 && len(runs) < limit; i-- {
+			runs = append(runs, st.reconciliations[i])
+		}
+		return nil
+	})
+
+	return runs, err
+}
+
+func (r *ReconciliationRepository) StoreReconciliationMismatch(ctx context.Context, mismatch *repositories.ReconciliationMismatch) error {
+	return r.session.do(func(st *state) error {
+		mismatch.ID = int64(len(st.mismatches)) + 1
+		st.mismatches = append(st.mismatches, *mismatch)
+		return nil
+	})
+}
+
+func (r *ReconciliationRepository) GetReconciliationMismatches(ctx context.Context, runID int64) ([]repositories.ReconciliationMismatch, error) {
+	var mismatches []repositories.ReconciliationMismatch
+	err := r.session.do(func(st *state) error {
+		for _, mismatch := range st.mismatches {
+			if mismatch.RunID == runID {
+				mismatches = append(mismatches, mismatch)
+			}
+		}
+		return nil
+	})
+
+	return mismatches, err
+}
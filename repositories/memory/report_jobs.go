@@ -0,0 +1,95 @@
+package memory
+
+import (
+	"balance-service/repositories"
+	"context"
+	"database/sql"
+	"time"
+)
+
+type ReportJobRepository struct {
+	session *session
+}
+
+func (r *ReportJobRepository) StoreReportJobIfNotInFlight(ctx context.Context, job *repositories.ReportJob) (bool, error) {
+	var stored bool
+	err := r.session.do(func(st *state) error {
+		if job.IsInFlight() && st.inFlightReportJob(job.ReportPeriod, job.GroupBy, job.Format, job.LastTransactionID) != nil {
+			return nil
+		}
+
+		job.ID = int64(len(st.reportJobs)) + 1
+		st.reportJobs = append(st.reportJobs, *job)
+		stored = true
+		return nil
+	})
+
+	return stored, err
+}
+
+func (r *ReportJobRepository) GetInFlightReportJob(ctx context.Context, period repositories.ReportPeriod, groupBy string, format string, lastTransactionID sql.NullInt64) (*repositories.ReportJob, error) {
+	var job *repositories.ReportJob
+	err := r.session.do(func(st *state) error {
+		if found := st.inFlightReportJob(period, groupBy, format, lastTransactionID); found != nil {
+			copied := *found
+			job = &copied
+		}
+		return nil
+	})
+
+	return job, err
+}
+
+func (r *ReportJobRepository) GetReportJob(ctx context.Context, ID int64) (*repositories.ReportJob, error) {
+	var job *repositories.ReportJob
+	err := r.session.do(func(st *state) error {
+		if ID >= 1 && ID <= int64(len(st.reportJobs)) {
+			found := st.reportJobs[ID-1]
+			job = &found
+		}
+		return nil
+	})
+
+	return job, err
+}
+
+func (r *ReportJobRepository) ClaimReportJob(ctx context.Context, now time.Time, staleBefore time.Time) (*repositories.ReportJob, error) {
+	var job *repositories.ReportJob
+	err := r.session.do(func(st *state) error {
+		for i := range st.reportJobs {
+			e := &st.reportJobs[i]
+			stale := e.Status == repositories.ReportJobRunning && e.StartedAt.Time.Before(staleBefore)
+			if e.Status != repositories.ReportJobPending && !stale {
+				continue
+			}
+
+			e.Status = repositories.ReportJobRunning
+			e.StartedAt = sql.NullTime{Time: now, Valid: true}
+			claimed := *e
+			job = &claimed
+			return nil
+		}
+		return nil
+	})
+
+	return job, err
+}
+
+func (r *ReportJobRepository) UpdateReportJob(ctx context.Context, job *repositories.ReportJob) error {
+	return r.session.do(func(st *state) error {
+		if job.ID >= 1 && job.ID <= int64(len(st.reportJobs)) {
+			st.reportJobs[job.ID-1] = *job
+		}
+		return nil
+	})
+}
+
+func (st *state) inFlightReportJob(period repositories.ReportPeriod, groupBy string, format string, lastTransactionID sql.NullInt64) *repositories.ReportJob {
+	for i, e := range st.reportJobs {
+		if e.ReportPeriod.Equal(period) && e.GroupBy == groupBy && e.Format == format && e.LastTransactionID == lastTransactionID && e.IsInFlight() {
+			return &st.reportJobs[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package memory
+
+import (
+	"balance-service/repositories"
+	"context"
+	"sort"
+)
+
+type ReportRunRepository struct {
+	session *session
+}
+
+func (r *ReportRunRepository) GetReportRun(ctx context.Context, month int, year int) (*repositories.ReportRun, error) {
+	var run *repositories.ReportRun
+	err := r.session.do(func(st *state) error {
+		for _, e := range st.reportRuns {
+			if e.Month == month && e.Year == year {
+				found := e
+				run = &found
+				return nil
+			}
+		}
+		return nil
+	})
+
+	return run, err
+}
+
+func (r *ReportRunRepository) GetReportRuns(ctx context.Context, limit int) ([]repositories.ReportRun, error) {
+	var runs []repositories.ReportRun
+	err := r.session.do(func(st *state) error {
+		runs = append(runs, st.reportRuns...)
+		return nil
+	})
+
+	sort.Slice(runs, func(i, j int) bool {
+		if runs[i].Year != runs[j].Year {
+			return runs[i].Year > runs[j].Year
+		}
+		return runs[i].Month > runs[j].Month
+	})
+	if limit < len(runs) {
+		runs = runs[:limit]
+	}
+
+	return runs, err
+}
+
+func (r *ReportRunRepository) SaveReportRun(ctx context.Context, run *repositories.ReportRun) error {
+	return r.session.do(func(st *state) error {
+		for i, e := range st.reportRuns {
+			if e.Month == run.Month && e.Year == run.Year {
+				run.ID = e.ID
+				st.reportRuns[i] = *run
+				return nil
+			}
+		}
+
+		run.ID = int64(len(st.reportRuns)) + 1
+		st.reportRuns = append(st.reportRuns, *run)
+		return nil
+	})
+}
@@ -0,0 +1,84 @@
+package memory
+
+import (
+	"balance-service/repositories"
+	"context"
+	"database/sql"
+)
+
+type ReportRepository struct {
+	session *session
+}
+
+func (r *ReportRepository) FindReport(ctx context.Context, period repositories.ReportPeriod, groupBy string, format string, lastTransactionID sql.NullInt64) (*repositories.Report, error) {
+	var report *repositories.Report
+	err := r.session.do(func(st *state) error {
+		for _, e := range st.reports {
+			if e.ReportPeriod.Equal(period) && e.GroupBy == groupBy && e.Format == format && e.LastTransactionID == lastTransactionID {
+				found := e
+				report = &found
+				return nil
+			}
+		}
+		return nil
+	})
+
+	return report, err
+}
+
+func (r *ReportRepository) GetReport(ctx context.Context, ID int64) (*repositories.Report, error) {
+	var report *repositories.Report
+	err := r.session.do(func(st *state) error {
+		if ID >= 1 && ID <= int64(len(st.reports)) && st.reports[ID-1].GroupBy != "" {
+			found := st.reports[ID-1]
+			report = &found
+		}
+		return nil
+	})
+
+	return report, err
+}
+
+func (r *ReportRepository) GetReports(ctx context.Context, limit int, offset int) ([]repositories.Report, error) {
+	var reports []repositories.Report
+	err := r.session.do(func(st *state) error {
+		for i := len(st.reports) - 1; i >= 0; i-- {
+			if st.reports[i].GroupBy == "" {
+				continue
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+			if len(reports) == limit {
+				break
+			}
+			reports = append(reports, st.reports[i])
+		}
+		return nil
+	})
+
+	return reports, err
+}
+
+func (r *ReportRepository) CountReports(ctx context.Context) (int64, error) {
+	var count int64
+	err := r.session.do(func(st *state) error {
+		for _, e := range st.reports {
+			if e.GroupBy != "" {
+				count++
+			}
+		}
+		return nil
+	})
+
+	return count, err
+}
+
+func (r *ReportRepository) StoreReport(ctx context.Context, report *repositories.Report) error {
+	return r.session.do(func(st *state) error {
+		report.ID = int64(len(st.reports)) + 1
+		st.reports = append(st.reports, *report)
+		return nil
+	})
+}
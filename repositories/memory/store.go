@@ -0,0 +1,160 @@
+// Package memory implements repositories in process memory, so services can be used without Postgres
+package memory
+
+import (
+	"balance-service/repositories"
+	"context"
+	"fmt"
+	"sync"
+)
+
+type idempotencyKeyID struct {
+	apiKeyID int64
+	key      string
+	endpoint string
+}
+
+type state struct {
+	users           map[int64]repositories.User
+	accounts        []repositories.Account
+	accountIDs      map[repositories.AccountKey]int64
+	entries         []repositories.JournalEntry
+	transactions    []repositories.Transaction
+	reports         []repositories.Report
+	reportRuns      []repositories.ReportRun
+	reportJobs      []repositories.ReportJob
+	reconciliations []repositories.ReconciliationRun
+	mismatches      []repositories.ReconciliationMismatch
+	idempotencyKeys map[idempotencyKeyID]repositories.IdempotencyKey
+	apiKeys         []repositories.APIKey
+}
+
+func (s *state) clone() *state {
+	cloned := &state{
+		users:           make(map[int64]repositories.User, len(s.users)),
+		accounts:        append([]repositories.Account(nil), s.accounts...),
+		accountIDs:      make(map[repositories.AccountKey]int64, len(s.accountIDs)),
+		entries:         append([]repositories.JournalEntry(nil), s.entries...),
+		transactions:    append([]repositories.Transaction(nil), s.transactions...),
+		reports:         append([]repositories.Report(nil), s.reports...),
+		reportRuns:      append([]repositories.ReportRun(nil), s.reportRuns...),
+		reportJobs:      append([]repositories.ReportJob(nil), s.reportJobs...),
+		reconciliations: append([]repositories.ReconciliationRun(nil), s.reconciliations...),
+		mismatches:      append([]repositories.ReconciliationMismatch(nil), s.mismatches...),
+		idempotencyKeys: make(map[idempotencyKeyID]repositories.IdempotencyKey, len(s.idempotencyKeys)),
+		apiKeys:         append([]repositories.APIKey(nil), s.apiKeys...),
+	}
+
+	for id, user := range s.users {
+		cloned.users[id] = user
+	}
+	for key, id := range s.accountIDs {
+		cloned.accountIDs[key] = id
+	}
+	for id, idempotencyKey := range s.idempotencyKeys {
+		cloned.idempotencyKeys[id] = idempotencyKey
+	}
+
+	return cloned
+}
+
+// Store keeps all the data guarded by a single mutex, transactions hold it until they finish,
+// which is the strictest form of the row locks taken by the Postgres repositories. As the mutex hides missing
+// row locks, transactions also check that users are locked in ascending id order before their accounts are changed.
+type Store struct {
+	mu    sync.Mutex
+	state *state
+}
+
+func NewStore() *Store {
+	return &Store{
+		state: &state{
+			users:           map[int64]repositories.User{},
+			accountIDs:      map[repositories.AccountKey]int64{},
+			idempotencyKeys: map[idempotencyKeyID]repositories.IdempotencyKey{},
+		},
+	}
+}
+
+// Repositories returns repositories working outside of transactions
+func (s *Store) Repositories() repositories.Repositories {
+	return newRepositories(&session{store: s})
+}
+
+func (s *Store) RunInTransaction(ctx context.Context, fn func(repos repositories.Repositories) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := s.state.clone()
+
+	err := fn(newRepositories(&session{store: s, inTransaction: true}))
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		s.state = snapshot
+	}
+
+	return err
+}
+
+type session struct {
+	store         *Store
+	inTransaction bool
+	// lockedUsers are the users locked by the transaction of the session in the order of locking
+	lockedUsers []int64
+}
+
+// lockUser records the lock of the user taken by the transaction, the same as the row lock of Postgres it is
+// released only when the transaction finishes
+func (s *session) lockUser(userID int64) error {
+	if !s.inTransaction || s.isUserLocked(userID) {
+		return nil
+	}
+	if n := len(s.lockedUsers); n > 0 && s.lockedUsers[n-1] > userID {
+		return fmt.Errorf("%w: user %d after user %d", ErrUserLockOrder, userID, s.lockedUsers[n-1])
+	}
+
+	s.lockedUsers = append(s.lockedUsers, userID)
+
+	return nil
+}
+
+// isUserLocked reports whether the user may be changed by the session, sessions outside of transactions change
+// a single row at a time, so they don't need the lock
+func (s *session) isUserLocked(userID int64) bool {
+	if !s.inTransaction {
+		return true
+	}
+	for _, ID := range s.lockedUsers {
+		if ID == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// do runs fn against the current state, taking the store lock unless the session already holds it
+func (s *session) do(fn func(st *state) error) error {
+	if !s.inTransaction {
+		s.store.mu.Lock()
+		defer s.store.mu.Unlock()
+	}
+
+	return fn(s.store.state)
+}
+
+func newRepositories(s *session) repositories.Repositories {
+	return repositories.Repositories{
+		Users:           &UserRepository{session: s},
+		Ledger:          &LedgerRepository{session: s},
+		Transactions:    &TransactionRepository{session: s},
+		Reports:         &ReportRepository{session: s},
+		ReportRuns:      &ReportRunRepository{session: s},
+		ReportJobs:      &ReportJobRepository{session: s},
+		Reconciliations: &ReconciliationRepository{session: s},
+		IdempotencyKeys: &IdempotencyKeyRepository{session: s},
+		APIKeys:         &APIKeyRepository{session: s},
+	}
+}
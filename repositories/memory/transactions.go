@@ -0,0 +1,432 @@
+package memory
+
+import (
+	"balance-service/repositories"
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type TransactionRepository struct {
+	session *session
+}
+
+func (r *TransactionRepository) LinkTransaction(ctx context.Context, transactionID int64, relatedTransactionID int64) error {
+	return r.session.do(func(st *state) error {
+		if transaction := st.transaction(transactionID); transaction != nil {
+			transaction.RelatedTransactionID = sql.NullInt64{Int64: relatedTransactionID, Valid: true}
+		}
+		return nil
+	})
+}
+
+func (r *TransactionRepository) GetServiceTransaction(ctx context.Context, userID int64, serviceID int64, orderID int64, accountType string) (*repositories.Transaction, error) {
+	return r.find(func(t repositories.Transaction) bool {
+		return t.UserID == sql.NullInt64{Int64: userID, Valid: true} &&
+			t.ServiceID == sql.NullInt64{Int64: serviceID, Valid: true} &&
+			t.OrderID == sql.NullInt64{Int64: orderID, Valid: true} &&
+			t.AccountType == accountType
+	})
+}
+
+func (r *TransactionRepository) GetReservationSettlement(ctx context.Context, reservationID int64) (*repositories.ReservationSettlement, error) {
+	settlement := &repositories.ReservationSettlement{}
+	err := r.session.do(func(st *state) error {
+		for _, t := range st.transactions {
+			if t.CancelledTransactionId != (sql.NullInt64{Int64: reservationID, Valid: true}) {
+				continue
+			}
+
+			switch entry := st.entry(t.EntryID); entry.Type {
+			case repositories.EntryReservationAdjustment:
+				settlement.Adjusted += t.Amount
+			case repositories.EntryWithdrawal:
+				settlement.Captures++
+				settlement.Captured -= t.Amount
+			case repositories.EntryRelease:
+				settlement.Released -= t.Amount
+			case repositories.EntryCancellation:
+				settlement.IsCancelled = true
+			case repositories.EntryExpiration:
+				settlement.IsExpired = true
+			}
+		}
+		return nil
+	})
+
+	return settlement, err
+}
+
+func (r *TransactionRepository) GetRefundedAmount(ctx context.Context, userID int64, serviceID int64, orderID int64) (int64, error) {
+	var refunded int64
+	err := r.session.do(func(st *state) error {
+		for _, t := range st.transactions {
+			if t.UserID.Int64 != userID || t.ServiceID.Int64 != serviceID || t.OrderID.Int64 != orderID {
+				continue
+			}
+			if entry := st.entry(t.EntryID); entry != nil && entry.Type == repositories.EntryRefund {
+				refunded += t.Amount
+			}
+		}
+		return nil
+	})
+
+	return refunded, err
+}
+
+func (r *TransactionRepository) ClearReservationExpiry(ctx context.Context, reservationID int64) error {
+	return r.session.do(func(st *state) error {
+		if transaction := st.transaction(reservationID); transaction != nil {
+			transaction.ExpiresAt = sql.NullTime{}
+		}
+		return nil
+	})
+}
+
+func (r *TransactionRepository) SetReservationExpiry(ctx context.Context, reservationID int64, expiresAt time.Time) error {
+	return r.session.do(func(st *state) error {
+		if transaction := st.transaction(reservationID); transaction != nil {
+			transaction.ExpiresAt = sql.NullTime{Time: expiresAt, Valid: true}
+		}
+		return nil
+	})
+}
+
+func (r *TransactionRepository) GetExpiredReservations(ctx context.Context, now time.Time, afterID int64, limit int) ([]repositories.Transaction, error) {
+	var reservations []repositories.Transaction
+	err := r.session.do(func(st *state) error {
+		held := map[int64]int64{}
+		for _, t := range st.transactions {
+			if t.ExpiresAt.Valid && !t.ExpiresAt.Time.After(now) {
+				held[t.ID] += t.Amount
+			}
+			if t.CancelledTransactionId.Valid {
+				held[t.CancelledTransactionId.Int64] += t.Amount
+			}
+		}
+
+		for _, t := range st.transactions {
+			if t.ID > afterID && t.ExpiresAt.Valid && !t.ExpiresAt.Time.After(now) && held[t.ID] > 0 {
+				reservations = append(reservations, t)
+			}
+		}
+		return nil
+	})
+
+	if limit < len(reservations) {
+		reservations = reservations[:limit]
+	}
+
+	return reservations, err
+}
+
+func (r *TransactionRepository) GetUserReservedAmount(ctx context.Context, userID int64, currency string) (int64, error) {
+	reserved, err := r.GetUserReservedAmounts(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return reserved[currency], nil
+}
+
+func (r *TransactionRepository) GetUserReservedAmounts(ctx context.Context, userID int64) (map[string]int64, error) {
+	reserved := map[string]int64{}
+	err := r.session.do(func(st *state) error {
+		for _, account := range st.accounts {
+			if account.Type == repositories.AccountUserReserve && account.UserID.Int64 == userID {
+				reserved[account.Currency] = account.Balance
+			}
+		}
+		return nil
+	})
+
+	return reserved, err
+}
+
+func (r *TransactionRepository) GetUserTransactions(ctx context.Context, userID int64, sortColumn string, desc bool, limit int, offset int) ([]repositories.TransactionHistoryItem, error) {
+	var less func(a, b repositories.Transaction) bool
+	switch sortColumn {
+	case "created_at":
+		less = func(a, b repositories.Transaction) bool { return a.CreatedAt.Before(b.CreatedAt) }
+	case "amount":
+		less = func(a, b repositories.Transaction) bool { return a.Amount < b.Amount }
+	default:
+		return nil, fmt.Errorf("unsupported sort column %q", sortColumn)
+	}
+
+	var items []repositories.TransactionHistoryItem
+	err := r.session.do(func(st *state) error {
+		for _, t := range st.transactions {
+			if t.UserID.Int64 != userID {
+				continue
+			}
+
+			items = append(items, st.historyItem(t))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i].Transaction, items[j].Transaction
+		if desc {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return a.ID < b.ID
+	})
+
+	if offset >= len(items) {
+		return nil, nil
+	}
+	items = items[offset:]
+	if limit < len(items) {
+		items = items[:limit]
+	}
+
+	return items, nil
+}
+
+func (r *TransactionRepository) CountUserTransactions(ctx context.Context, userID int64) (int64, error) {
+	var count int64
+	err := r.session.do(func(st *state) error {
+		for _, t := range st.transactions {
+			if t.UserID.Int64 == userID {
+				count++
+			}
+		}
+		return nil
+	})
+
+	return count, err
+}
+
+func (r *TransactionRepository) GetUserBalanceAt(ctx context.Context, userID int64, currency string, at time.Time) (int64, error) {
+	var sum int64
+	err := r.session.do(func(st *state) error {
+		for _, t := range st.transactions {
+			if t.UserID.Int64 == userID && t.Currency == currency && t.AccountType == repositories.AccountUserMain && t.CreatedAt.Before(at) {
+				sum += t.Amount
+			}
+		}
+		return nil
+	})
+
+	return sum, err
+}
+
+func (r *TransactionRepository) EachUserMainAccountTransaction(ctx context.Context, userID int64, currency string, from time.Time, to time.Time, fn func(item repositories.TransactionHistoryItem) error) error {
+	var items []repositories.TransactionHistoryItem
+	err := r.session.do(func(st *state) error {
+		for _, t := range st.transactions {
+			if t.UserID.Int64 != userID || t.Currency != currency || t.AccountType != repositories.AccountUserMain || t.CreatedAt.Before(from) || !t.CreatedAt.Before(to) {
+				continue
+			}
+
+			items = append(items, st.historyItem(t))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if !items[i].CreatedAt.Equal(items[j].CreatedAt) {
+			return items[i].CreatedAt.Before(items[j].CreatedAt)
+		}
+		return items[i].ID < items[j].ID
+	})
+
+	// fn is called outside of the store lock, so it may be slow without blocking writers
+	for _, item := range items {
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *TransactionRepository) GetLastTransactionIDForReport(ctx context.Context, period repositories.ReportPeriod) (sql.NullInt64, error) {
+	begin, end, err := period.Bounds()
+	if err != nil {
+		return sql.NullInt64{}, err
+	}
+
+	var lastID sql.NullInt64
+	err = r.session.do(func(st *state) error {
+		for _, t := range st.transactions {
+			if st.isReportPosting(t, begin, end) && (!lastID.Valid || lastID.Int64 < t.ID) {
+				lastID = sql.NullInt64{Int64: t.ID, Valid: true}
+			}
+		}
+		return nil
+	})
+
+	return lastID, err
+}
+
+func (r *TransactionRepository) GetReport(ctx context.Context, period repositories.ReportPeriod, groupBy string) ([]repositories.TransactionReport, error) {
+	byService := groupBy == repositories.ReportGroupByService || groupBy == repositories.ReportGroupByServiceDay
+	byDay := groupBy == repositories.ReportGroupByDay || groupBy == repositories.ReportGroupByServiceDay
+	if !byService && !byDay {
+		return nil, fmt.Errorf("unsupported report grouping %q", groupBy)
+	}
+
+	begin, end, err := period.Bounds()
+	if err != nil {
+		return nil, err
+	}
+	location, _ := time.LoadLocation(period.Timezone)
+
+	var transactionReports []repositories.TransactionReport
+	err = r.session.do(func(st *state) error {
+		type group struct {
+			serviceID sql.NullInt64
+			day       sql.NullTime
+			currency  string
+		}
+		type order struct {
+			serviceID int64
+			orderID   int64
+		}
+
+		groups := map[group]int{}
+		orders := map[group]map[order]bool{}
+		for _, t := range st.transactions {
+			if !st.isReportPosting(t, begin, end) {
+				continue
+			}
+
+			key := group{currency: t.Currency}
+			if byService {
+				key.serviceID = t.ServiceID
+			}
+			if byDay {
+				local := t.CreatedAt.In(location)
+				key.day = sql.NullTime{Time: time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC), Valid: true}
+			}
+
+			i, ok := groups[key]
+			if !ok {
+				i = len(transactionReports)
+				groups[key] = i
+				orders[key] = map[order]bool{}
+				transactionReports = append(transactionReports, repositories.TransactionReport{ServiceID: key.serviceID, Day: key.day, Currency: t.Currency})
+			}
+
+			if t.AccountType == repositories.AccountServiceRevenue {
+				if entry := st.entry(t.EntryID); entry != nil && entry.Type == repositories.EntryRefund {
+					transactionReports[i].Refunded -= t.Amount
+				} else {
+					orders[key][order{serviceID: t.ServiceID.Int64, orderID: t.OrderID.Int64}] = true
+					transactionReports[i].Orders = int64(len(orders[key]))
+					transactionReports[i].Gross += t.Amount
+				}
+			} else {
+				switch st.entry(t.EntryID).Type {
+				case repositories.EntryCancellation:
+					transactionReports[i].Cancelled += t.Amount
+				case repositories.EntryRelease:
+					transactionReports[i].Released += t.Amount
+				case repositories.EntryExpiration:
+					transactionReports[i].Expired += t.Amount
+				}
+			}
+			if transactionReports[i].LastTransactionID < t.ID {
+				transactionReports[i].LastTransactionID = t.ID
+			}
+		}
+		return nil
+	})
+
+	sort.Slice(transactionReports, func(i, j int) bool {
+		a, b := transactionReports[i], transactionReports[j]
+		if a.ServiceID.Int64 != b.ServiceID.Int64 {
+			return a.ServiceID.Int64 < b.ServiceID.Int64
+		}
+		if !a.Day.Time.Equal(b.Day.Time) {
+			return a.Day.Time.Before(b.Day.Time)
+		}
+		return a.Currency < b.Currency
+	})
+
+	return transactionReports, err
+}
+
+func (r *TransactionRepository) find(match func(t repositories.Transaction) bool) (*repositories.Transaction, error) {
+	var transaction *repositories.Transaction
+	err := r.session.do(func(st *state) error {
+		for _, t := range st.transactions {
+			if match(t) {
+				found := t
+				transaction = &found
+				return nil
+			}
+		}
+		return nil
+	})
+
+	return transaction, err
+}
+
+func (st *state) transaction(ID int64) *repositories.Transaction {
+	if ID < 1 || ID > int64(len(st.transactions)) {
+		return nil
+	}
+
+	return &st.transactions[ID-1]
+}
+
+func (st *state) historyItem(t repositories.Transaction) repositories.TransactionHistoryItem {
+	item := repositories.TransactionHistoryItem{Transaction: t, IsReleased: st.isReleased(t)}
+	if entry := st.entry(t.EntryID); entry != nil {
+		item.EntryType = entry.Type
+		item.Reason = entry.Reason
+	}
+	if t.RelatedTransactionID.Valid {
+		if related := st.transaction(t.RelatedTransactionID.Int64); related != nil {
+			item.RelatedUserID = related.UserID
+		}
+	}
+
+	return item
+}
+
+// isReportPosting matches the postings the Postgres report query sums: recognized and refunded revenue and money
+// returned to users on cancellation, completion and expiration of reservations
+func (st *state) isReportPosting(t repositories.Transaction, begin time.Time, end time.Time) bool {
+	if t.CreatedAt.Before(begin) || !t.CreatedAt.Before(end) {
+		return false
+	}
+	if t.AccountType == repositories.AccountServiceRevenue {
+		return true
+	}
+
+	entry := st.entry(t.EntryID)
+	if t.AccountType != repositories.AccountUserMain || entry == nil {
+		return false
+	}
+
+	return entry.Type == repositories.EntryCancellation || entry.Type == repositories.EntryRelease || entry.Type == repositories.EntryExpiration
+}
+
+// isReleased reports whether a reserve account debit returned the money to the main account
+func (st *state) isReleased(t repositories.Transaction) bool {
+	if !t.IsReserveAccount() || t.Amount >= 0 {
+		return false
+	}
+
+	entry := st.entry(t.EntryID)
+	return entry != nil && (entry.Type == repositories.EntryCancellation || entry.Type == repositories.EntryRelease || entry.Type == repositories.EntryExpiration)
+}
@@ -0,0 +1,87 @@
+package memory
+
+import (
+	"balance-service/repositories"
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+)
+
+// ErrNegativeBalance mirrors the check constraint on accounts.balance of the user accounts
+var ErrNegativeBalance = errors.New("user account balance cannot be negative")
+
+// ErrUserNotLocked means a transaction changes accounts of a user without locking the user first,
+// which lets concurrent transactions of Postgres overwrite each other
+var ErrUserNotLocked = errors.New("user should be locked before the accounts are changed")
+
+// ErrUserLockOrder means a transaction locks users out of ascending id order, which can deadlock in Postgres
+var ErrUserLockOrder = errors.New("users should be locked in ascending id order")
+
+type UserRepository struct {
+	session *session
+}
+
+func (r *UserRepository) GetUser(ctx context.Context, ID int64) (*repositories.User, error) {
+	var user *repositories.User
+	err := r.session.do(func(st *state) error {
+		if found, ok := st.users[ID]; ok {
+			user = &found
+		}
+		return nil
+	})
+
+	return user, err
+}
+
+func (r *UserRepository) LockUser(ctx context.Context, userID int64) (*repositories.User, error) {
+	user, err := r.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, sql.ErrNoRows
+	}
+	if err := r.session.lockUser(userID); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (r *UserRepository) StoreUserIfNotExists(ctx context.Context, userID int64) error {
+	return r.session.do(func(st *state) error {
+		if _, ok := st.users[userID]; !ok {
+			st.users[userID] = repositories.User{ID: userID}
+		}
+		return nil
+	})
+}
+
+func (r *UserRepository) GetUserBalance(ctx context.Context, userID int64, currency string) (*repositories.Balance, error) {
+	var balance *repositories.Balance
+	err := r.session.do(func(st *state) error {
+		if account := st.account(st.accountIDs[repositories.UserMainAccount(userID, currency)]); account != nil {
+			balance = &repositories.Balance{UserID: userID, Currency: currency, Balance: account.Balance}
+		}
+		return nil
+	})
+
+	return balance, err
+}
+
+func (r *UserRepository) GetUserBalances(ctx context.Context, userID int64) ([]repositories.Balance, error) {
+	var balances []repositories.Balance
+	err := r.session.do(func(st *state) error {
+		for _, account := range st.accounts {
+			if account.Type == repositories.AccountUserMain && account.UserID.Int64 == userID {
+				balances = append(balances, repositories.Balance{UserID: userID, Currency: account.Currency, Balance: account.Balance})
+			}
+		}
+		return nil
+	})
+
+	sort.Slice(balances, func(i, j int) bool { return balances[i].Currency < balances[j].Currency })
+
+	return balances, err
+}
@@ -0,0 +1,255 @@
+package repositories
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Arbitrary key of the advisory lock held while migrations are applied
+const migrationsLockKey = 7_240_113_001
+
+// baseCurrencySetting passes the base currency of the service to migrations which convert data kept
+// before currencies were introduced
+const baseCurrencySetting = "balance_service.base_currency"
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+type appliedMigration struct {
+	Version   int       `db:"version"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+// LoadMigrations reads embedded migrations named as <version>_<name>.<up|down>.sql ordered by version
+func LoadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		fileName := entry.Name()
+		base := strings.TrimSuffix(fileName, ".sql")
+
+		direction := path.Ext(base)
+		base = strings.TrimSuffix(base, direction)
+
+		versionPart, name, found := strings.Cut(base, "_")
+		if !found || (direction != ".up" && direction != ".down") {
+			return nil, fmt.Errorf("invalid migration file name %q", fileName)
+		}
+
+		version, err := strconv.Atoi(versionPart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %q: %w", fileName, err)
+		}
+
+		content, err := migrationFiles.ReadFile("migrations/" + fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: name}
+			byVersion[version] = migration
+		}
+
+		if direction == ".up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d should have both up and down files", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// MigrateUp applies all pending migrations, returns the applied ones. Balances kept before currencies were
+// introduced are moved to the base currency.
+func MigrateUp(ctx context.Context, db *sqlx.DB, baseCurrency string) ([]Migration, error) {
+	var applied []Migration
+
+	err := withMigrationsLock(ctx, db, func(conn *sqlx.Conn) error {
+		migrations, appliedAt, err := loadMigrationsState(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			if _, ok := appliedAt[migration.Version]; ok {
+				continue
+			}
+
+			err := runMigration(ctx, conn, baseCurrency, migration.Up, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)", migration.Version, migration.Name, time.Now().UTC())
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+
+			applied = append(applied, migration)
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// MigrateDown rolls back the given number of the latest applied migrations, returns the rolled back ones.
+// Only balances in the base currency are kept once currencies are rolled back.
+func MigrateDown(ctx context.Context, db *sqlx.DB, steps int, baseCurrency string) ([]Migration, error) {
+	var rolledBack []Migration
+
+	err := withMigrationsLock(ctx, db, func(conn *sqlx.Conn) error {
+		migrations, appliedAt, err := loadMigrationsState(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(rolledBack) < steps; i-- {
+			migration := migrations[i]
+			if _, ok := appliedAt[migration.Version]; !ok {
+				continue
+			}
+
+			err := runMigration(ctx, conn, baseCurrency, migration.Down, "DELETE FROM schema_migrations WHERE version=$1", migration.Version)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+
+			rolledBack = append(rolledBack, migration)
+		}
+
+		return nil
+	})
+
+	return rolledBack, err
+}
+
+func GetMigrationsStatus(ctx context.Context, db *sqlx.DB) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+
+	err := withMigrationsLock(ctx, db, func(conn *sqlx.Conn) error {
+		migrations, appliedAt, err := loadMigrationsState(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			status := MigrationStatus{Migration: migration}
+			if at, ok := appliedAt[migration.Version]; ok {
+				at := at
+				status.AppliedAt = &at
+			}
+			statuses = append(statuses, status)
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+// withMigrationsLock runs fn on a single connection holding the session advisory lock,
+// so concurrently started replicas apply migrations one after another
+func withMigrationsLock(ctx context.Context, db *sqlx.DB, fn func(conn *sqlx.Conn) error) error {
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationsLockKey); err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationsLockKey)
+	}()
+
+	createQuery := `CREATE TABLE IF NOT EXISTS "schema_migrations"
+			(
+			    version    int          not null primary key,
+			    name       varchar(255) not null,
+			    applied_at timestamp    not null
+			)`
+	if _, err := conn.ExecContext(ctx, createQuery); err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+func loadMigrationsState(ctx context.Context, conn *sqlx.Conn) ([]Migration, map[int]time.Time, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var applied []appliedMigration
+	if err := conn.SelectContext(ctx, &applied, "SELECT version, applied_at FROM schema_migrations"); err != nil {
+		return nil, nil, err
+	}
+
+	appliedAt := make(map[int]time.Time, len(applied))
+	for _, e := range applied {
+		appliedAt[e.Version] = e.AppliedAt
+	}
+
+	return migrations, appliedAt, nil
+}
+
+func runMigration(ctx context.Context, conn *sqlx.Conn, baseCurrency string, script string, bookkeepingQuery string, args ...interface{}) error {
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// The setting is local to the transaction of the migration
+	if _, err := tx.ExecContext(ctx, "SELECT set_config($1, $2, true)", baseCurrencySetting, baseCurrency); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, bookkeepingQuery, args...); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS "reports";
+
+DROP TABLE IF EXISTS "transactions";
+
+DROP TABLE IF EXISTS "users";
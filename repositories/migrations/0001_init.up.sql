@@ -1,10 +1,10 @@
-CREATE TABLE "users"
+CREATE TABLE IF NOT EXISTS "users"
 (
     id      bigint not null primary key,
     balance bigint not null check ( balance >= 0)
 );
 
-CREATE TABLE "transactions"
+CREATE TABLE IF NOT EXISTS "transactions"
 (
     id                      serial    not null
         constraint transactions_pk
@@ -22,7 +22,7 @@ CREATE TABLE "transactions"
             references transactions
 );
 
-CREATE TABLE "reports"
+CREATE TABLE IF NOT EXISTS "reports"
 (
     id                  serial    not null primary key,
     month               int       not null,
@@ -36,8 +36,3 @@ CREATE TABLE "reports"
     constraint reports_unique_date_transaction_id
         unique (year, month, last_transaction_id)
 );
-
-
-
-
-
@@ -0,0 +1,2 @@
+ALTER TABLE "transactions"
+    DROP COLUMN IF EXISTS related_transaction_id;
@@ -0,0 +1,4 @@
+ALTER TABLE "transactions"
+    ADD COLUMN IF NOT EXISTS related_transaction_id bigint
+        constraint transactions_related_fk0
+            references transactions;
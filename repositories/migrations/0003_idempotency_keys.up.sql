@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS "idempotency_keys"
+(
+    key           varchar(255) not null,
+    endpoint      varchar(255) not null,
+    request_hash  char(64)     not null,
+    status_code   int,
+    response_body bytea,
+    created_at    timestamp    not null,
+    constraint idempotency_keys_pk
+        primary key (key, endpoint)
+);
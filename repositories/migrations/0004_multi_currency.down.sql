@@ -0,0 +1,17 @@
+ALTER TABLE "transactions"
+    DROP COLUMN currency;
+
+ALTER TABLE "users"
+    ADD COLUMN balance bigint not null default 0 check ( balance >= 0);
+
+ALTER TABLE "users"
+    ALTER COLUMN balance DROP DEFAULT;
+
+-- Only balances in the base currency fit into the single currency schema
+UPDATE users
+SET balance = b.balance
+FROM balances b
+WHERE b.user_id = users.id
+  AND b.currency = current_setting('balance_service.base_currency');
+
+DROP TABLE "balances";
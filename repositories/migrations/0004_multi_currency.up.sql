@@ -0,0 +1,28 @@
+CREATE TABLE "balances"
+(
+    user_id  bigint  not null
+        constraint balances_users_fk0
+            references users,
+    currency char(3) not null,
+    balance  bigint  not null check ( balance >= 0),
+    constraint balances_pk
+        primary key (user_id, currency)
+);
+
+-- Balances kept before currencies were introduced are in the base currency of the service, which MigrateUp passes
+-- in the balance_service.base_currency setting
+INSERT INTO balances (user_id, currency, balance)
+SELECT id, current_setting('balance_service.base_currency'), balance
+FROM users;
+
+ALTER TABLE "users"
+    DROP COLUMN balance;
+
+ALTER TABLE "transactions"
+    ADD COLUMN currency char(3);
+
+UPDATE transactions
+SET currency = current_setting('balance_service.base_currency');
+
+ALTER TABLE "transactions"
+    ALTER COLUMN currency SET NOT NULL;
@@ -0,0 +1,42 @@
+DROP TRIGGER transactions_journal_entry_balanced ON transactions;
+
+DROP FUNCTION check_journal_entry_balanced();
+
+CREATE TABLE "balances"
+(
+    user_id  bigint  not null
+        constraint balances_users_fk0
+            references users,
+    currency char(3) not null,
+    balance  bigint  not null check ( balance >= 0),
+    constraint balances_pk
+        primary key (user_id, currency)
+);
+
+INSERT INTO balances (user_id, currency, balance)
+SELECT user_id, currency, balance
+FROM accounts
+WHERE type = 'user_main';
+
+ALTER TABLE "transactions"
+    ADD COLUMN is_reserve_account boolean;
+
+UPDATE transactions t
+SET is_reserve_account = a.type = 'user_reserve'
+FROM accounts a
+WHERE a.id = t.account_id;
+
+-- Postings of system accounts did not exist before, reports pointing at them are removed by the cascade
+DELETE
+FROM transactions
+WHERE user_id IS NULL;
+
+ALTER TABLE "transactions"
+    ALTER COLUMN is_reserve_account SET NOT NULL,
+    ALTER COLUMN user_id SET NOT NULL,
+    DROP COLUMN entry_id,
+    DROP COLUMN account_id;
+
+DROP TABLE "journal_entries";
+
+DROP TABLE "accounts";
@@ -0,0 +1,181 @@
+CREATE TABLE "accounts"
+(
+    id         bigserial   not null primary key,
+    type       varchar(32) not null
+        check ( type in ('user_main', 'user_reserve', 'service_revenue', 'external_cash') ),
+    user_id    bigint
+        constraint accounts_users_fk0
+            references users,
+    service_id bigint,
+    currency   char(3)     not null,
+    -- Materialized for user accounts only, system accounts are summed from postings to avoid a hot row
+    balance    bigint      not null default 0,
+    constraint accounts_user_balance_check
+        check ( type not in ('user_main', 'user_reserve') or balance >= 0 ),
+    constraint accounts_owner_check
+        check ( (type in ('user_main', 'user_reserve')) = (user_id is not null) and
+                (type = 'service_revenue') = (service_id is not null) )
+);
+
+CREATE UNIQUE INDEX accounts_key_uindex
+    ON accounts (type, coalesce(user_id, 0), coalesce(service_id, 0), currency);
+
+CREATE TABLE "journal_entries"
+(
+    id         bigserial   not null primary key,
+    type       varchar(32) not null,
+    created_at timestamp   not null
+);
+
+-- Transactions become postings, rows of system accounts have no user
+ALTER TABLE "transactions"
+    ADD COLUMN entry_id bigint
+        constraint transactions_journal_entries_fk0
+            references journal_entries,
+    ADD COLUMN account_id bigint
+        constraint transactions_accounts_fk0
+            references accounts,
+    ALTER COLUMN user_id DROP NOT NULL;
+
+-- Existing rows are grouped into the operations that stored them, the smallest row id becomes the entry id
+CREATE TEMPORARY TABLE legacy_entries ON COMMIT DROP AS
+SELECT t.id AS transaction_id,
+       CASE
+           -- Both legs of a transfer reference each other
+           WHEN t.related_transaction_id IS NOT NULL THEN least(t.id, t.related_transaction_id)
+           -- Reserve credit goes with the main account debit of the order
+           WHEN t.is_reserve_account AND t.amount >= 0 AND t.canceled_transaction_id IS NULL THEN
+               coalesce((SELECT min(m.id)
+                         FROM transactions m
+                         WHERE m.user_id = t.user_id
+                           AND m.service_id = t.service_id
+                           AND m.order_id = t.order_id
+                           AND NOT m.is_reserve_account
+                           AND m.amount <= 0
+                           AND m.canceled_transaction_id IS NULL), t.id)
+           -- Refund goes with the reserve debit stored right before it by the cancellation
+           WHEN NOT t.is_reserve_account AND t.canceled_transaction_id IS NOT NULL THEN
+               coalesce((SELECT max(r.id)
+                         FROM transactions r
+                         WHERE r.user_id = t.user_id
+                           AND r.service_id = t.service_id
+                           AND r.order_id = t.order_id
+                           AND r.is_reserve_account
+                           AND r.canceled_transaction_id IS NOT NULL
+                           AND r.id < t.id), t.id)
+           ELSE t.id
+           END AS entry_id
+FROM transactions t;
+
+INSERT INTO journal_entries (id, type, created_at)
+SELECT l.entry_id,
+       CASE
+           WHEN bool_or(t.related_transaction_id IS NOT NULL) THEN 'transfer'
+           WHEN bool_or(NOT t.is_reserve_account AND t.canceled_transaction_id IS NOT NULL) THEN 'cancellation'
+           WHEN bool_or(t.is_reserve_account AND t.canceled_transaction_id IS NOT NULL) THEN 'withdrawal'
+           WHEN bool_or(t.service_id IS NOT NULL) THEN 'reservation'
+           ELSE 'replenishment'
+           END,
+       min(t.created_at)
+FROM legacy_entries l
+         JOIN transactions t ON t.id = l.transaction_id
+GROUP BY l.entry_id;
+
+SELECT setval(pg_get_serial_sequence('journal_entries', 'id'), coalesce(max(id), 0) + 1, false)
+FROM journal_entries;
+
+INSERT INTO accounts (type, user_id, currency)
+SELECT CASE WHEN is_reserve_account THEN 'user_reserve' ELSE 'user_main' END, user_id, currency
+FROM transactions
+UNION
+SELECT 'user_main', user_id, currency
+FROM balances;
+
+UPDATE transactions t
+SET entry_id   = l.entry_id,
+    account_id = a.id
+FROM legacy_entries l,
+     accounts a
+WHERE l.transaction_id = t.id
+  AND a.user_id = t.user_id
+  AND a.currency = t.currency
+  AND a.type = CASE WHEN t.is_reserve_account THEN 'user_reserve' ELSE 'user_main' END;
+
+-- Replenishments and withdrawals were stored one-sided, the missing legs go to the system accounts
+CREATE TEMPORARY TABLE legacy_residuals ON COMMIT DROP AS
+SELECT t.entry_id,
+       e.type            AS entry_type,
+       e.created_at,
+       t.currency,
+       -sum(t.amount)    AS amount,
+       max(t.service_id) AS service_id,
+       max(t.order_id)   AS order_id
+FROM transactions t
+         JOIN journal_entries e ON e.id = t.entry_id
+GROUP BY t.entry_id, e.type, e.created_at, t.currency
+HAVING sum(t.amount) <> 0;
+
+INSERT INTO accounts (type, service_id, currency)
+SELECT DISTINCT 'service_revenue', service_id, currency
+FROM legacy_residuals
+WHERE entry_type = 'withdrawal';
+
+INSERT INTO accounts (type, currency)
+SELECT DISTINCT 'external_cash', currency
+FROM legacy_residuals
+WHERE entry_type <> 'withdrawal';
+
+INSERT INTO transactions (created_at, amount, currency, service_id, order_id, is_reserve_account, entry_id, account_id)
+SELECT r.created_at,
+       r.amount,
+       r.currency,
+       CASE WHEN r.entry_type = 'withdrawal' THEN r.service_id END,
+       CASE WHEN r.entry_type = 'withdrawal' THEN r.order_id END,
+       false,
+       r.entry_id,
+       a.id
+FROM legacy_residuals r
+         JOIN accounts a ON a.currency = r.currency AND
+                            ((r.entry_type = 'withdrawal' AND a.type = 'service_revenue' AND a.service_id = r.service_id) OR
+                             (r.entry_type <> 'withdrawal' AND a.type = 'external_cash'))
+ORDER BY r.entry_id;
+
+UPDATE accounts a
+SET balance = coalesce((SELECT sum(t.amount) FROM transactions t WHERE t.account_id = a.id), 0)
+WHERE a.type IN ('user_main', 'user_reserve');
+
+ALTER TABLE "transactions"
+    ALTER COLUMN entry_id SET NOT NULL,
+    ALTER COLUMN account_id SET NOT NULL,
+    DROP COLUMN is_reserve_account;
+
+CREATE INDEX transactions_entry_id_index
+    ON transactions (entry_id);
+
+CREATE INDEX transactions_account_id_index
+    ON transactions (account_id);
+
+DROP TABLE "balances";
+
+CREATE FUNCTION check_journal_entry_balanced() RETURNS trigger AS
+$$
+BEGIN
+    IF EXISTS(SELECT 1
+              FROM transactions
+              WHERE entry_id = NEW.entry_id
+              GROUP BY currency
+              HAVING sum(amount) <> 0) THEN
+        RAISE EXCEPTION 'postings of journal entry % do not sum to zero', NEW.entry_id;
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Checked at commit, so that all the postings of an entry are inserted first
+CREATE CONSTRAINT TRIGGER transactions_journal_entry_balanced
+    AFTER INSERT OR UPDATE OF amount, currency, entry_id
+    ON transactions
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW
+EXECUTE FUNCTION check_journal_entry_balanced();
@@ -0,0 +1,23 @@
+DROP TABLE "reconciliation_mismatches";
+
+DROP TABLE "reconciliation_runs";
+
+-- Adjusted user accounts drift from their postings again once the adjustments are gone
+DELETE
+FROM transactions
+WHERE entry_id IN (SELECT id FROM journal_entries WHERE type = 'adjustment');
+
+DELETE
+FROM journal_entries
+WHERE type = 'adjustment';
+
+DELETE
+FROM accounts
+WHERE type = 'adjustment';
+
+ALTER TABLE "accounts"
+    DROP CONSTRAINT accounts_type_check;
+
+ALTER TABLE "accounts"
+    ADD CONSTRAINT accounts_type_check
+        check ( type in ('user_main', 'user_reserve', 'service_revenue', 'external_cash') );
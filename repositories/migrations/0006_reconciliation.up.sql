@@ -0,0 +1,41 @@
+-- Adjustments written by the reconciliation are balanced against a dedicated system account
+ALTER TABLE "accounts"
+    DROP CONSTRAINT accounts_type_check;
+
+ALTER TABLE "accounts"
+    ADD CONSTRAINT accounts_type_check
+        check ( type in ('user_main', 'user_reserve', 'service_revenue', 'external_cash', 'adjustment') );
+
+CREATE TABLE "reconciliation_runs"
+(
+    id               bigserial   not null primary key,
+    started_at       timestamp   not null,
+    finished_at      timestamp,
+    fix              boolean     not null,
+    status           varchar(32) not null,
+    checked_accounts bigint      not null default 0,
+    mismatches       bigint      not null default 0,
+    fixed            bigint      not null default 0,
+    error            text
+);
+
+CREATE TABLE "reconciliation_mismatches"
+(
+    id               bigserial   not null primary key,
+    run_id           bigint      not null
+        constraint reconciliation_mismatches_runs_fk0
+            references reconciliation_runs
+            on delete cascade,
+    account_id       bigint      not null
+        constraint reconciliation_mismatches_accounts_fk0
+            references accounts,
+    account_type     varchar(32) not null,
+    user_id          bigint      not null,
+    currency         char(3)     not null,
+    stored_balance   bigint      not null,
+    computed_balance bigint      not null,
+    fixed            boolean     not null
+);
+
+CREATE INDEX reconciliation_mismatches_run_id_index
+    ON reconciliation_mismatches (run_id);
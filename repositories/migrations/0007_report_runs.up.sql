@@ -0,0 +1,14 @@
+CREATE TABLE "report_runs"
+(
+    id          bigserial   not null primary key,
+    month       int         not null,
+    year        int         not null,
+    status      varchar(32) not null,
+    attempts    int         not null,
+    started_at  timestamp   not null,
+    finished_at timestamp,
+    file_path   text,
+    error       text,
+    constraint report_runs_unique_date
+        unique (year, month)
+);
@@ -0,0 +1,21 @@
+CREATE TABLE "report_jobs"
+(
+    id                  bigserial   not null primary key,
+    month               int         not null,
+    year                int         not null,
+    last_transaction_id bigint,
+    status              varchar(32) not null,
+    file_path           text,
+    error               text,
+    created_at          timestamp   not null,
+    started_at          timestamp,
+    finished_at         timestamp
+);
+
+-- A single job at a time builds the report of the period as of the same last transaction
+CREATE UNIQUE INDEX report_jobs_in_flight_uindex
+    ON report_jobs (year, month, coalesce(last_transaction_id, 0))
+    WHERE status in ('pending', 'running');
+
+CREATE INDEX report_jobs_status_index
+    ON report_jobs (status, id);
@@ -0,0 +1,10 @@
+UPDATE reports SET file_key = 'data/' || file_key WHERE file_key IS NOT NULL;
+UPDATE report_runs SET file_key = 'data/' || file_key WHERE file_key IS NOT NULL;
+UPDATE report_jobs SET file_key = 'data/' || file_key WHERE file_key IS NOT NULL;
+
+ALTER TABLE "reports"
+    RENAME COLUMN file_key TO file_path;
+ALTER TABLE "report_runs"
+    RENAME COLUMN file_key TO file_path;
+ALTER TABLE "report_jobs"
+    RENAME COLUMN file_key TO file_path;
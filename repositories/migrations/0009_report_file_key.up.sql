@@ -0,0 +1,11 @@
+-- Reports are kept in a pluggable storage, so rows keep the key of the file instead of a path next to the binary
+ALTER TABLE "reports"
+    RENAME COLUMN file_path TO file_key;
+ALTER TABLE "report_runs"
+    RENAME COLUMN file_path TO file_key;
+ALTER TABLE "report_jobs"
+    RENAME COLUMN file_path TO file_key;
+
+UPDATE reports SET file_key = substr(file_key, length('data/') + 1) WHERE file_key LIKE 'data/%';
+UPDATE report_runs SET file_key = substr(file_key, length('data/') + 1) WHERE file_key LIKE 'data/%';
+UPDATE report_jobs SET file_key = substr(file_key, length('data/') + 1) WHERE file_key LIKE 'data/%';
@@ -0,0 +1,14 @@
+DELETE FROM reports WHERE group_by IS NOT NULL;
+DELETE FROM report_jobs WHERE group_by <> 'service';
+
+DROP INDEX report_jobs_in_flight_uindex;
+
+CREATE UNIQUE INDEX report_jobs_in_flight_uindex
+    ON report_jobs (year, month, coalesce(last_transaction_id, 0))
+    WHERE status in ('pending', 'running');
+
+ALTER TABLE "report_jobs"
+    DROP COLUMN group_by;
+
+ALTER TABLE "reports"
+    DROP COLUMN group_by;
@@ -0,0 +1,12 @@
+-- Reports built before the breakdown have no grouping, so they are never reused for the new format
+ALTER TABLE "reports"
+    ADD COLUMN group_by varchar(32);
+
+ALTER TABLE "report_jobs"
+    ADD COLUMN group_by varchar(32) not null default 'service';
+
+DROP INDEX report_jobs_in_flight_uindex;
+
+CREATE UNIQUE INDEX report_jobs_in_flight_uindex
+    ON report_jobs (year, month, group_by, coalesce(last_transaction_id, 0))
+    WHERE status in ('pending', 'running');
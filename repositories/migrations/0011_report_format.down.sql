@@ -0,0 +1,14 @@
+DELETE FROM reports WHERE format <> 'csv';
+DELETE FROM report_jobs WHERE format <> 'csv';
+
+DROP INDEX report_jobs_in_flight_uindex;
+
+CREATE UNIQUE INDEX report_jobs_in_flight_uindex
+    ON report_jobs (year, month, group_by, coalesce(last_transaction_id, 0))
+    WHERE status in ('pending', 'running');
+
+ALTER TABLE "report_jobs"
+    DROP COLUMN format;
+
+ALTER TABLE "reports"
+    DROP COLUMN format;
@@ -0,0 +1,12 @@
+-- Reports built before the export formats are CSV files
+ALTER TABLE "reports"
+    ADD COLUMN format varchar(16) not null default 'csv';
+
+ALTER TABLE "report_jobs"
+    ADD COLUMN format varchar(16) not null default 'csv';
+
+DROP INDEX report_jobs_in_flight_uindex;
+
+CREATE UNIQUE INDEX report_jobs_in_flight_uindex
+    ON report_jobs (year, month, group_by, format, coalesce(last_transaction_id, 0))
+    WHERE status in ('pending', 'running');
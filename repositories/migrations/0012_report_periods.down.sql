@@ -0,0 +1,45 @@
+-- Only reports of calendar months in UTC can be kept
+DELETE FROM reports
+WHERE timezone <> 'UTC'
+   OR date_from <> date_trunc('month', date_from)::date
+   OR date_to <> (date_trunc('month', date_from) + interval '1 month' - interval '1 day')::date;
+
+DELETE FROM report_jobs
+WHERE timezone <> 'UTC'
+   OR date_from <> date_trunc('month', date_from)::date
+   OR date_to <> (date_trunc('month', date_from) + interval '1 month' - interval '1 day')::date;
+
+ALTER TABLE "reports"
+    ADD COLUMN month int,
+    ADD COLUMN year  int;
+
+UPDATE reports SET month = date_part('month', date_from), year = date_part('year', date_from);
+
+ALTER TABLE "reports"
+    DROP CONSTRAINT reports_unique_period_transaction_id,
+    ALTER COLUMN month SET NOT NULL,
+    ALTER COLUMN year SET NOT NULL,
+    DROP COLUMN date_from,
+    DROP COLUMN date_to,
+    DROP COLUMN timezone,
+    ADD CONSTRAINT reports_unique_date_transaction_id
+        unique (year, month, group_by, format, last_transaction_id);
+
+ALTER TABLE "report_jobs"
+    ADD COLUMN month int,
+    ADD COLUMN year  int;
+
+UPDATE report_jobs SET month = date_part('month', date_from), year = date_part('year', date_from);
+
+DROP INDEX report_jobs_in_flight_uindex;
+
+ALTER TABLE "report_jobs"
+    ALTER COLUMN month SET NOT NULL,
+    ALTER COLUMN year SET NOT NULL,
+    DROP COLUMN date_from,
+    DROP COLUMN date_to,
+    DROP COLUMN timezone;
+
+CREATE UNIQUE INDEX report_jobs_in_flight_uindex
+    ON report_jobs (year, month, group_by, format, coalesce(last_transaction_id, 0))
+    WHERE status in ('pending', 'running');
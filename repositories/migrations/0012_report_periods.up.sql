@@ -0,0 +1,39 @@
+-- Reports cover a range of days instead of a calendar month, the days begin at midnight in the timezone
+ALTER TABLE "reports"
+    ADD COLUMN date_from date,
+    ADD COLUMN date_to   date,
+    ADD COLUMN timezone  varchar(64) not null default 'UTC';
+
+UPDATE reports
+SET date_from = make_date(year, month, 1),
+    date_to   = (make_date(year, month, 1) + interval '1 month' - interval '1 day')::date;
+
+ALTER TABLE "reports"
+    DROP CONSTRAINT reports_unique_date_transaction_id,
+    ALTER COLUMN date_from SET NOT NULL,
+    ALTER COLUMN date_to SET NOT NULL,
+    DROP COLUMN month,
+    DROP COLUMN year,
+    ADD CONSTRAINT reports_unique_period_transaction_id
+        unique (date_from, date_to, timezone, group_by, format, last_transaction_id);
+
+ALTER TABLE "report_jobs"
+    ADD COLUMN date_from date,
+    ADD COLUMN date_to   date,
+    ADD COLUMN timezone  varchar(64) not null default 'UTC';
+
+UPDATE report_jobs
+SET date_from = make_date(year, month, 1),
+    date_to   = (make_date(year, month, 1) + interval '1 month' - interval '1 day')::date;
+
+DROP INDEX report_jobs_in_flight_uindex;
+
+ALTER TABLE "report_jobs"
+    ALTER COLUMN date_from SET NOT NULL,
+    ALTER COLUMN date_to SET NOT NULL,
+    DROP COLUMN month,
+    DROP COLUMN year;
+
+CREATE UNIQUE INDEX report_jobs_in_flight_uindex
+    ON report_jobs (date_from, date_to, timezone, group_by, format, coalesce(last_transaction_id, 0))
+    WHERE status in ('pending', 'running');
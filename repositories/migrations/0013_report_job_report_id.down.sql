@@ -0,0 +1,10 @@
+ALTER TABLE "report_jobs"
+    ADD COLUMN file_key text;
+
+UPDATE report_jobs j
+SET file_key = r.file_key
+FROM reports r
+WHERE r.id = j.report_id;
+
+ALTER TABLE "report_jobs"
+    DROP COLUMN report_id;
@@ -0,0 +1,16 @@
+-- Reports are downloaded by id, so jobs reference the report instead of its file
+ALTER TABLE "report_jobs"
+    ADD COLUMN report_id bigint
+        constraint report_jobs_reports_null_fk
+            references reports
+            on update cascade on delete set null;
+
+-- Reports built before the breakdown are not served anymore, so jobs which built them are left without a report
+UPDATE report_jobs j
+SET report_id = r.id
+FROM reports r
+WHERE r.file_key = j.file_key
+  AND r.group_by IS NOT NULL;
+
+ALTER TABLE "report_jobs"
+    DROP COLUMN file_key;
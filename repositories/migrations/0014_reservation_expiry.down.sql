@@ -0,0 +1,7 @@
+DROP INDEX transactions_expires_at_index;
+
+ALTER TABLE "journal_entries"
+    DROP COLUMN reason;
+
+ALTER TABLE "transactions"
+    DROP COLUMN expires_at;
@@ -0,0 +1,10 @@
+-- Expiry is set on the reserve account credit of the reservation only
+ALTER TABLE "transactions"
+    ADD COLUMN expires_at timestamp;
+
+ALTER TABLE "journal_entries"
+    ADD COLUMN reason text;
+
+CREATE INDEX transactions_expires_at_index
+    ON transactions (expires_at)
+    WHERE expires_at IS NOT NULL;
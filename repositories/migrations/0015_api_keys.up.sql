@@ -0,0 +1,14 @@
+-- Only the SHA-256 of a key is stored, the key itself is shown once when it is created
+CREATE TABLE "api_keys"
+(
+    id          bigserial     not null primary key,
+    name        varchar(128)  not null,
+    key_prefix  varchar(16)   not null,
+    key_hash    char(64)      not null,
+    scopes      varchar(16)[] not null,
+    service_ids bigint[]      not null default '{}',
+    created_at  timestamp     not null,
+    revoked_at  timestamp,
+    constraint api_keys_key_hash_uindex
+        unique (key_hash)
+);
@@ -0,0 +1,10 @@
+ALTER TABLE "report_runs"
+    ADD COLUMN file_key text;
+
+UPDATE report_runs r
+SET file_key = reports.file_key
+FROM reports
+WHERE reports.id = r.report_id;
+
+ALTER TABLE "report_runs"
+    DROP COLUMN report_id;
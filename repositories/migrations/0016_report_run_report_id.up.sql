@@ -0,0 +1,16 @@
+-- Reports are downloaded by id, so scheduled runs reference the report instead of its file
+ALTER TABLE "report_runs"
+    ADD COLUMN report_id bigint
+        constraint report_runs_reports_null_fk
+            references reports
+            on update cascade on delete set null;
+
+-- Reports built before the breakdown are not served anymore, so runs which built them are left without a report
+UPDATE report_runs r
+SET report_id = reports.id
+FROM reports
+WHERE reports.file_key = r.file_key
+  AND reports.group_by IS NOT NULL;
+
+ALTER TABLE "report_runs"
+    DROP COLUMN file_key;
@@ -0,0 +1,8 @@
+DELETE FROM idempotency_keys
+WHERE api_key_id <> 0;
+
+ALTER TABLE "idempotency_keys"
+    DROP CONSTRAINT idempotency_keys_pk,
+    DROP COLUMN api_key_id,
+    ADD CONSTRAINT idempotency_keys_pk
+        primary key (key, endpoint);
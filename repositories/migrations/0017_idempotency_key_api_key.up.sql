@@ -0,0 +1,6 @@
+-- Keys are chosen by clients, so every API key has its own keys. Keys claimed before API keys belong to none.
+ALTER TABLE "idempotency_keys"
+    ADD COLUMN api_key_id bigint not null default 0,
+    DROP CONSTRAINT idempotency_keys_pk,
+    ADD CONSTRAINT idempotency_keys_pk
+        primary key (api_key_id, key, endpoint);
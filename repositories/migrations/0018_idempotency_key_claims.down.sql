@@ -0,0 +1,3 @@
+ALTER TABLE "idempotency_keys"
+    DROP COLUMN applied_at,
+    DROP COLUMN claim_token;
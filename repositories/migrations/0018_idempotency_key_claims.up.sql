@@ -0,0 +1,5 @@
+-- Every claim of a key has its own token, so a request whose claim was taken over by a retry can't complete or release it.
+-- applied_at is set in the transaction which changes balances, such claims are never taken over.
+ALTER TABLE "idempotency_keys"
+    ADD COLUMN claim_token varchar(36) not null default '',
+    ADD COLUMN applied_at  timestamp;
@@ -0,0 +1,123 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"time"
+)
+
+const (
+	ReconciliationRunning   = "running"
+	ReconciliationCompleted = "completed"
+	ReconciliationFailed    = "failed"
+)
+
+type ReconciliationRun struct {
+	ID              int64          `db:"id"`
+	StartedAt       time.Time      `db:"started_at"`
+	FinishedAt      sql.NullTime   `db:"finished_at"`
+	Fix             bool           `db:"fix"`
+	Status          string         `db:"status"`
+	CheckedAccounts int64          `db:"checked_accounts"`
+	Mismatches      int64          `db:"mismatches"`
+	Fixed           int64          `db:"fixed"`
+	Error           sql.NullString `db:"error"`
+}
+
+type ReconciliationMismatch struct {
+	ID              int64  `db:"id"`
+	RunID           int64  `db:"run_id"`
+	AccountID       int64  `db:"account_id"`
+	AccountType     string `db:"account_type"`
+	UserID          int64  `db:"user_id"`
+	Currency        string `db:"currency"`
+	StoredBalance   int64  `db:"stored_balance"`
+	ComputedBalance int64  `db:"computed_balance"`
+	Fixed           bool   `db:"fixed"`
+}
+
+type PostgresReconciliationRepository struct {
+	db sqlx.ExtContext
+}
+
+func NewPostgresReconciliationRepository(db sqlx.ExtContext) *PostgresReconciliationRepository {
+	return &PostgresReconciliationRepository{db: db}
+}
+
+func (r *PostgresReconciliationRepository) StoreReconciliationRun(ctx context.Context, run *ReconciliationRun) error {
+	insertQuery := "INSERT INTO reconciliation_runs (started_at, finished_at, fix, status, checked_accounts, mismatches, fixed, error) VALUES (:started_at, :finished_at, :fix, :status, :checked_accounts, :mismatches, :fixed, :error) RETURNING id"
+	rows, err := sqlx.NamedQueryContext(ctx, r.db, insertQuery, run)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		if err := rows.Scan(&run.ID); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (r *PostgresReconciliationRepository) UpdateReconciliationRun(ctx context.Context, run *ReconciliationRun) error {
+	updateQuery := "UPDATE reconciliation_runs SET finished_at=:finished_at, status=:status, checked_accounts=:checked_accounts, mismatches=:mismatches, fixed=:fixed, error=:error WHERE id=:id"
+	_, err := sqlx.NamedExecContext(ctx, r.db, updateQuery, run)
+	return err
+}
+
+func (r *PostgresReconciliationRepository) GetReconciliationRun(ctx context.Context, ID int64) (*ReconciliationRun, error) {
+	var run ReconciliationRun
+
+	err := sqlx.GetContext(ctx, r.db, &run, "SELECT * FROM reconciliation_runs WHERE id=$1", ID)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &run, nil
+}
+
+func (r *PostgresReconciliationRepository) GetReconciliationRuns(ctx context.Context, limit int) ([]ReconciliationRun, error) {
+	var runs []ReconciliationRun
+
+	if err := sqlx.SelectContext(ctx, r.db, &runs, "SELECT * FROM reconciliation_runs ORDER BY id DESC LIMIT $1", limit); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+func (r *PostgresReconciliationRepository) StoreReconciliationMismatch(ctx context.Context, mismatch *ReconciliationMismatch) error {
+	insertQuery := "INSERT INTO reconciliation_mismatches (run_id, account_id, account_type, user_id, currency, stored_balance, computed_balance, fixed) VALUES (:run_id, :account_id, :account_type, :user_id, :currency, :stored_balance, :computed_balance, :fixed) RETURNING id"
+	rows, err := sqlx.NamedQueryContext(ctx, r.db, insertQuery, mismatch)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		if err := rows.Scan(&mismatch.ID); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (r *PostgresReconciliationRepository) GetReconciliationMismatches(ctx context.Context, runID int64) ([]ReconciliationMismatch, error) {
+	var mismatches []ReconciliationMismatch
+
+	if err := sqlx.SelectContext(ctx, r.db, &mismatches, "SELECT * FROM reconciliation_mismatches WHERE run_id=$1 ORDER BY id", runID); err != nil {
+		return nil, err
+	}
+
+	return mismatches, nil
+}
@@ -1,39 +1,143 @@
 package repositories
 
 import (
+	"context"
 	"database/sql"
+	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"time"
 )
 
+// ReportPeriod is the range of days from From to To inclusive, the days begin at midnight in the timezone
+type ReportPeriod struct {
+	From     time.Time `db:"date_from"`
+	To       time.Time `db:"date_to"`
+	Timezone string    `db:"timezone"`
+}
+
+// MonthReportPeriod is the calendar month in the timezone
+func MonthReportPeriod(month int, year int, timezone string) ReportPeriod {
+	from := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+
+	return ReportPeriod{From: from, To: from.AddDate(0, 1, -1), Timezone: timezone}
+}
+
+// Bounds returns the moment the period begins at and the moment it ends before, both in UTC
+// as transactions are stored
+func (p ReportPeriod) Bounds() (time.Time, time.Time, error) {
+	location, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	begin := time.Date(p.From.Year(), p.From.Month(), p.From.Day(), 0, 0, 0, 0, location)
+	end := time.Date(p.To.Year(), p.To.Month(), p.To.Day()+1, 0, 0, 0, 0, location)
+
+	return begin.UTC(), end.UTC(), nil
+}
+
+// Equal reports whether both periods cover the same days in the same timezone
+func (p ReportPeriod) Equal(other ReportPeriod) bool {
+	return p.From.Equal(other.From) && p.To.Equal(other.To) && p.Timezone == other.Timezone
+}
+
 type Report struct {
-	ID                int64         `db:"id"`
-	Month             int           `db:"month"`
-	Year              int           `db:"year"`
+	ID int64 `db:"id"`
+	ReportPeriod
+	GroupBy           string        `db:"group_by"`
+	Format            string        `db:"format"`
 	CreatedAt         time.Time     `db:"created_at"`
-	FilePath          string        `db:"file_path"`
+	FileKey           string        `db:"file_key"`
 	LastTransactionID sql.NullInt64 `db:"last_transaction_id"`
 }
 
-func FindReport(month int, year int, lastTransactionID sql.NullInt64) (string, error) {
-	var filePath string
+// currentReportsCondition skips reports built before the breakdown, they have an outdated layout and no grouping
+const currentReportsCondition = "group_by IS NOT NULL"
+
+type PostgresReportRepository struct {
+	db sqlx.ExtContext
+}
+
+func NewPostgresReportRepository(db sqlx.ExtContext) *PostgresReportRepository {
+	return &PostgresReportRepository{db: db}
+}
+
+func (r *PostgresReportRepository) FindReport(ctx context.Context, period ReportPeriod, groupBy string, format string, lastTransactionID sql.NullInt64) (*Report, error) {
+	var report Report
 
 	var err error
 	if lastTransactionID.Valid {
-		err = DB.QueryRow("SELECT file_path FROM reports WHERE year=$1 AND month=$2 AND last_transaction_id=$3 LIMIT 1", year, month, lastTransactionID).Scan(&filePath)
+		err = sqlx.GetContext(ctx, r.db, &report, "SELECT * FROM reports WHERE date_from=$1 AND date_to=$2 AND timezone=$3 AND group_by=$4 AND format=$5 AND last_transaction_id=$6 LIMIT 1", period.From, period.To, period.Timezone, groupBy, format, lastTransactionID)
 	} else {
-		err = DB.QueryRow("SELECT file_path FROM reports WHERE year=$1 AND month=$2 AND last_transaction_id IS NULL LIMIT 1", year, month).Scan(&filePath)
+		err = sqlx.GetContext(ctx, r.db, &report, "SELECT * FROM reports WHERE date_from=$1 AND date_to=$2 AND timezone=$3 AND group_by=$4 AND format=$5 AND last_transaction_id IS NULL LIMIT 1", period.From, period.To, period.Timezone, groupBy, format)
+	}
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &report, nil
+}
+
+func (r *PostgresReportRepository) GetReport(ctx context.Context, ID int64) (*Report, error) {
+	var report Report
+
+	err := sqlx.GetContext(ctx, r.db, &report, "SELECT * FROM reports WHERE id=$1 AND "+currentReportsCondition, ID)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
 
+	return &report, nil
+}
+
+func (r *PostgresReportRepository) GetReports(ctx context.Context, limit int, offset int) ([]Report, error) {
+	var reports []Report
+
+	err := sqlx.SelectContext(ctx, r.db, &reports, "SELECT * FROM reports WHERE "+currentReportsCondition+" ORDER BY id DESC LIMIT $1 OFFSET $2", limit, offset)
+
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return filePath, nil
+	return reports, nil
 }
 
-func StoreReport(report *Report) error {
-	insertQuery := "INSERT INTO reports (month, year, created_at, file_path, last_transaction_id) VALUES (:month, :year, :created_at, :file_path, :last_transaction_id)"
-	_, err := DB.NamedExec(insertQuery, report)
-	return err
+func (r *PostgresReportRepository) CountReports(ctx context.Context) (int64, error) {
+	var count int64
+
+	err := r.db.QueryRowxContext(ctx, "SELECT COUNT(*) FROM reports WHERE "+currentReportsCondition).Scan(&count)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (r *PostgresReportRepository) StoreReport(ctx context.Context, report *Report) error {
+	insertQuery := `INSERT INTO reports (date_from, date_to, timezone, group_by, format, created_at, file_key, last_transaction_id)
+			VALUES (:date_from, :date_to, :timezone, :group_by, :format, :created_at, :file_key, :last_transaction_id)
+			RETURNING id`
+	rows, err := sqlx.NamedQueryContext(ctx, r.db, insertQuery, report)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		if err := rows.Scan(&report.ID); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
 }
@@ -0,0 +1,133 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"time"
+)
+
+const (
+	ReportJobPending = "pending"
+	ReportJobRunning = "running"
+	ReportJobDone    = "done"
+	ReportJobFailed  = "failed"
+)
+
+// ReportJob is a request to build the report of the period as of the last transaction at the moment of the request
+type ReportJob struct {
+	ID int64 `db:"id"`
+	ReportPeriod
+	GroupBy           string         `db:"group_by"`
+	Format            string         `db:"format"`
+	LastTransactionID sql.NullInt64  `db:"last_transaction_id"`
+	Status            string         `db:"status"`
+	ReportID          sql.NullInt64  `db:"report_id"`
+	Error             sql.NullString `db:"error"`
+	CreatedAt         time.Time      `db:"created_at"`
+	StartedAt         sql.NullTime   `db:"started_at"`
+	FinishedAt        sql.NullTime   `db:"finished_at"`
+}
+
+// IsInFlight reports whether the job is waiting for a worker or being built
+func (j *ReportJob) IsInFlight() bool {
+	return j.Status == ReportJobPending || j.Status == ReportJobRunning
+}
+
+type PostgresReportJobRepository struct {
+	db sqlx.ExtContext
+}
+
+func NewPostgresReportJobRepository(db sqlx.ExtContext) *PostgresReportJobRepository {
+	return &PostgresReportJobRepository{db: db}
+}
+
+func (r *PostgresReportJobRepository) StoreReportJobIfNotInFlight(ctx context.Context, job *ReportJob) (bool, error) {
+	insertQuery := `INSERT INTO report_jobs (date_from, date_to, timezone, group_by, format, last_transaction_id, status, report_id, error, created_at, started_at, finished_at)
+			VALUES (:date_from, :date_to, :timezone, :group_by, :format, :last_transaction_id, :status, :report_id, :error, :created_at, :started_at, :finished_at)
+			ON CONFLICT (date_from, date_to, timezone, group_by, format, coalesce(last_transaction_id, 0)) WHERE status in ('pending', 'running') DO NOTHING
+			RETURNING id`
+	rows, err := sqlx.NamedQueryContext(ctx, r.db, insertQuery, job)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	stored := false
+	if rows.Next() {
+		if err := rows.Scan(&job.ID); err != nil {
+			return false, err
+		}
+		stored = true
+	}
+
+	return stored, rows.Err()
+}
+
+func (r *PostgresReportJobRepository) GetInFlightReportJob(ctx context.Context, period ReportPeriod, groupBy string, format string, lastTransactionID sql.NullInt64) (*ReportJob, error) {
+	var job ReportJob
+	inFlightQuery := `SELECT * FROM report_jobs
+			WHERE date_from=$1 AND date_to=$2 AND timezone=$3 AND group_by=$4 AND format=$5
+			  AND coalesce(last_transaction_id, 0)=coalesce($6::bigint, 0)
+			  AND status in ('pending', 'running')`
+
+	err := sqlx.GetContext(ctx, r.db, &job, inFlightQuery, period.From, period.To, period.Timezone, groupBy, format, lastTransactionID)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &job, nil
+}
+
+func (r *PostgresReportJobRepository) GetReportJob(ctx context.Context, ID int64) (*ReportJob, error) {
+	var job ReportJob
+
+	err := sqlx.GetContext(ctx, r.db, &job, "SELECT * FROM report_jobs WHERE id=$1", ID)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &job, nil
+}
+
+func (r *PostgresReportJobRepository) ClaimReportJob(ctx context.Context, now time.Time, staleBefore time.Time) (*ReportJob, error) {
+	var job ReportJob
+	claimQuery := `UPDATE report_jobs
+			SET status='running', started_at=$1
+			WHERE id = (SELECT id
+			            FROM report_jobs
+			            WHERE status = 'pending'
+			               OR (status = 'running' AND started_at < $2)
+			            ORDER BY id
+			            LIMIT 1 FOR UPDATE SKIP LOCKED)
+			RETURNING *`
+
+	err := sqlx.GetContext(ctx, r.db, &job, claimQuery, now, staleBefore)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &job, nil
+}
+
+func (r *PostgresReportJobRepository) UpdateReportJob(ctx context.Context, job *ReportJob) error {
+	updateQuery := "UPDATE report_jobs SET status=:status, report_id=:report_id, error=:error, started_at=:started_at, finished_at=:finished_at WHERE id=:id"
+	_, err := sqlx.NamedExecContext(ctx, r.db, updateQuery, job)
+	return err
+}
@@ -0,0 +1,83 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"time"
+)
+
+const (
+	ReportRunRunning   = "running"
+	ReportRunCompleted = "completed"
+	ReportRunFailed    = "failed"
+)
+
+// ReportRun is the outcome of the scheduled generation of a monthly report
+type ReportRun struct {
+	ID         int64          `db:"id"`
+	Month      int            `db:"month"`
+	Year       int            `db:"year"`
+	Status     string         `db:"status"`
+	Attempts   int            `db:"attempts"`
+	StartedAt  time.Time      `db:"started_at"`
+	FinishedAt sql.NullTime   `db:"finished_at"`
+	ReportID   sql.NullInt64  `db:"report_id"`
+	Error      sql.NullString `db:"error"`
+}
+
+type PostgresReportRunRepository struct {
+	db sqlx.ExtContext
+}
+
+func NewPostgresReportRunRepository(db sqlx.ExtContext) *PostgresReportRunRepository {
+	return &PostgresReportRunRepository{db: db}
+}
+
+func (r *PostgresReportRunRepository) GetReportRun(ctx context.Context, month int, year int) (*ReportRun, error) {
+	var run ReportRun
+
+	err := sqlx.GetContext(ctx, r.db, &run, "SELECT * FROM report_runs WHERE year=$1 AND month=$2", year, month)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &run, nil
+}
+
+func (r *PostgresReportRunRepository) GetReportRuns(ctx context.Context, limit int) ([]ReportRun, error) {
+	var runs []ReportRun
+
+	if err := sqlx.SelectContext(ctx, r.db, &runs, "SELECT * FROM report_runs ORDER BY year DESC, month DESC LIMIT $1", limit); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+func (r *PostgresReportRunRepository) SaveReportRun(ctx context.Context, run *ReportRun) error {
+	saveQuery := `INSERT INTO report_runs (month, year, status, attempts, started_at, finished_at, report_id, error)
+			VALUES (:month, :year, :status, :attempts, :started_at, :finished_at, :report_id, :error)
+			ON CONFLICT (year, month) DO UPDATE SET status=excluded.status, attempts=excluded.attempts, started_at=excluded.started_at,
+			    finished_at=excluded.finished_at, report_id=excluded.report_id, error=excluded.error
+			RETURNING id`
+	rows, err := sqlx.NamedQueryContext(ctx, r.db, saveQuery, run)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		if err := rows.Scan(&run.ID); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,145 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type UserRepository interface {
+	GetUser(ctx context.Context, ID int64) (*User, error)
+	// LockUser prevents concurrent changes of the user until the end of the transaction
+	LockUser(ctx context.Context, userID int64) (*User, error)
+	StoreUserIfNotExists(ctx context.Context, userID int64) error
+	// GetUserBalance returns the balance of the user main account, nil if the user has no account in the currency
+	GetUserBalance(ctx context.Context, userID int64, currency string) (*Balance, error)
+	GetUserBalances(ctx context.Context, userID int64) ([]Balance, error)
+}
+
+type LedgerRepository interface {
+	GetAccount(ctx context.Context, key AccountKey) (*Account, error)
+	GetOrCreateAccount(ctx context.Context, key AccountKey) (*Account, error)
+	// StoreJournalEntry stores the entry with its postings and updates materialized balances of the user accounts,
+	// entries whose postings don't sum to zero are rejected
+	StoreJournalEntry(ctx context.Context, entry *JournalEntry) error
+	// StoreAdjustmentEntry stores the entry keeping materialized balances as they are,
+	// so that postings of the accounts are brought in line with their balances
+	StoreAdjustmentEntry(ctx context.Context, entry *JournalEntry) error
+	// GetUserAccountChecks returns user accounts with id greater than the given one ordered by id
+	GetUserAccountChecks(ctx context.Context, afterAccountID int64, limit int) ([]AccountCheck, error)
+	// GetAccountComputedBalance sums the account postings
+	GetAccountComputedBalance(ctx context.Context, accountID int64) (int64, error)
+}
+
+type TransactionRepository interface {
+	LinkTransaction(ctx context.Context, transactionID int64, relatedTransactionID int64) error
+	GetServiceTransaction(ctx context.Context, userID int64, serviceID int64, orderID int64, accountType string) (*Transaction, error)
+	// GetReservationSettlement sums adjustments, withdrawals, cancellation, release and expiration of the reserved amount
+	GetReservationSettlement(ctx context.Context, reservationID int64) (*ReservationSettlement, error)
+	// GetRefundedAmount sums the revenue of the order refunded to the user
+	GetRefundedAmount(ctx context.Context, userID int64, serviceID int64, orderID int64) (int64, error)
+	// ClearReservationExpiry is called once nothing is held by the reservation anymore
+	ClearReservationExpiry(ctx context.Context, reservationID int64) error
+	// SetReservationExpiry is called once the reservation holds money again
+	SetReservationExpiry(ctx context.Context, reservationID int64, expiresAt time.Time) error
+	// GetExpiredReservations returns reservations with id greater than the given one, which expired by now and still
+	// hold money, ordered by id
+	GetExpiredReservations(ctx context.Context, now time.Time, afterID int64, limit int) ([]Transaction, error)
+	// GetUserReservedAmount returns the balance of the user reserve account
+	GetUserReservedAmount(ctx context.Context, userID int64, currency string) (int64, error)
+	// GetUserReservedAmounts returns the reserved amount per currency
+	GetUserReservedAmounts(ctx context.Context, userID int64) (map[string]int64, error)
+	GetUserTransactions(ctx context.Context, userID int64, sort string, desc bool, limit int, offset int) ([]TransactionHistoryItem, error)
+	CountUserTransactions(ctx context.Context, userID int64) (int64, error)
+	// GetUserBalanceAt sums the main account postings in the currency created before the moment
+	GetUserBalanceAt(ctx context.Context, userID int64, currency string, at time.Time) (int64, error)
+	// EachUserMainAccountTransaction streams the main account postings in the currency created in [from, to) ordered by creation
+	EachUserMainAccountTransaction(ctx context.Context, userID int64, currency string, from time.Time, to time.Time, fn func(item TransactionHistoryItem) error) error
+	GetLastTransactionIDForReport(ctx context.Context, period ReportPeriod) (sql.NullInt64, error)
+	// GetReport sums recognized and refunded revenue and cancelled reservations of the period grouped by one of ReportGroupBy values,
+	// days are taken in the timezone of the period
+	GetReport(ctx context.Context, period ReportPeriod, groupBy string) ([]TransactionReport, error)
+}
+
+type ReportRepository interface {
+	FindReport(ctx context.Context, period ReportPeriod, groupBy string, format string, lastTransactionID sql.NullInt64) (*Report, error)
+	GetReport(ctx context.Context, ID int64) (*Report, error)
+	// GetReports returns the latest reports first
+	GetReports(ctx context.Context, limit int, offset int) ([]Report, error)
+	CountReports(ctx context.Context) (int64, error)
+	StoreReport(ctx context.Context, report *Report) error
+}
+
+type ReportRunRepository interface {
+	GetReportRun(ctx context.Context, month int, year int) (*ReportRun, error)
+	// GetReportRuns returns runs of the latest months first
+	GetReportRuns(ctx context.Context, limit int) ([]ReportRun, error)
+	// SaveReportRun stores the run of the month or replaces the existing one
+	SaveReportRun(ctx context.Context, run *ReportRun) error
+}
+
+type ReportJobRepository interface {
+	// StoreReportJobIfNotInFlight stores the job, returns false if it is pending or running while another pending
+	// or running job of the same period, grouping, format and last transaction exists
+	StoreReportJobIfNotInFlight(ctx context.Context, job *ReportJob) (bool, error)
+	GetInFlightReportJob(ctx context.Context, period ReportPeriod, groupBy string, format string, lastTransactionID sql.NullInt64) (*ReportJob, error)
+	GetReportJob(ctx context.Context, ID int64) (*ReportJob, error)
+	// ClaimReportJob marks the oldest pending job as running, jobs running since before staleBefore are claimed again
+	// as their worker is considered gone. Returns nil if there is nothing to do
+	ClaimReportJob(ctx context.Context, now time.Time, staleBefore time.Time) (*ReportJob, error)
+	UpdateReportJob(ctx context.Context, job *ReportJob) error
+}
+
+type ReconciliationRepository interface {
+	StoreReconciliationRun(ctx context.Context, run *ReconciliationRun) error
+	UpdateReconciliationRun(ctx context.Context, run *ReconciliationRun) error
+	GetReconciliationRun(ctx context.Context, ID int64) (*ReconciliationRun, error)
+	// GetReconciliationRuns returns the latest runs first
+	GetReconciliationRuns(ctx context.Context, limit int) ([]ReconciliationRun, error)
+	StoreReconciliationMismatch(ctx context.Context, mismatch *ReconciliationMismatch) error
+	GetReconciliationMismatches(ctx context.Context, runID int64) ([]ReconciliationMismatch, error)
+}
+
+type IdempotencyKeyRepository interface {
+	// StoreIdempotencyKeyIfNotExists claims the key of the API key for the endpoint, returns false if it was already claimed
+	StoreIdempotencyKeyIfNotExists(ctx context.Context, idempotencyKey *IdempotencyKey) (bool, error)
+	GetIdempotencyKey(ctx context.Context, apiKeyID int64, key string, endpoint string) (*IdempotencyKey, error)
+	// ReclaimStaleIdempotencyKey claims the key again with the token if its request has neither completed nor applied
+	// its changes since before staleBefore, returns false if the key was claimed by someone else in the meantime
+	ReclaimStaleIdempotencyKey(ctx context.Context, apiKeyID int64, key string, endpoint string, staleBefore time.Time, claimedAt time.Time, claimToken string) (bool, error)
+	// MarkIdempotencyKeyApplied is called in the transaction which applies the request, it locks the key until the end
+	// of the transaction and returns false if the key is not claimed with the token anymore
+	MarkIdempotencyKeyApplied(ctx context.Context, apiKeyID int64, key string, endpoint string, claimToken string, at time.Time) (bool, error)
+	// UpdateIdempotencyKeyResponse stores the response if the key is still claimed with the token
+	UpdateIdempotencyKeyResponse(ctx context.Context, apiKeyID int64, key string, endpoint string, claimToken string, statusCode int, responseBody []byte) error
+	// DeleteIdempotencyKey releases the key if it is still claimed with the token and is not marked as applied
+	DeleteIdempotencyKey(ctx context.Context, apiKeyID int64, key string, endpoint string, claimToken string) error
+}
+
+type APIKeyRepository interface {
+	StoreAPIKey(ctx context.Context, key *APIKey) error
+	// GetActiveAPIKeyByHash returns the key with the hash unless it was revoked
+	GetActiveAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error)
+	GetAPIKeys(ctx context.Context) ([]APIKey, error)
+	// RevokeAPIKey returns false if there is no such key or it was already revoked
+	RevokeAPIKey(ctx context.Context, ID int64, at time.Time) (bool, error)
+}
+
+// Repositories share the same database session, either the whole database or a single transaction
+type Repositories struct {
+	Users           UserRepository
+	Ledger          LedgerRepository
+	Transactions    TransactionRepository
+	Reports         ReportRepository
+	ReportRuns      ReportRunRepository
+	ReportJobs      ReportJobRepository
+	Reconciliations ReconciliationRepository
+	IdempotencyKeys IdempotencyKeyRepository
+	APIKeys         APIKeyRepository
+}
+
+// TransactionRunner runs fn against repositories bound to a single transaction,
+// which is committed when fn succeeds and rolled back otherwise
+type TransactionRunner interface {
+	RunInTransaction(ctx context.Context, fn func(repos Repositories) error) error
+}
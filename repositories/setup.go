@@ -1,27 +1,21 @@
 package repositories
 
 import (
+	"context"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"os"
 )
 
-var DB *sqlx.DB
-
-func CreateConnection() error {
-	if DB != nil {
-		return nil
-	}
-
+func CreateConnection() (*sqlx.DB, error) {
 	host := os.Getenv("DB_HOST")
 	port := os.Getenv("DB_PORT")
 	database := os.Getenv("DB_DATABASE")
 	user := os.Getenv("DB_USERNAME")
 	password := os.Getenv("DB_PASSWORD")
 
-	var err error
-	DB, err = sqlx.Connect(
+	return sqlx.Connect(
 		"postgres",
 		fmt.Sprintf(
 			"host=%s port=%s dbname=%s user=%s password=%s sslmode=disable",
@@ -32,6 +26,41 @@ func CreateConnection() error {
 			password,
 		),
 	)
+}
+
+type PostgresTransactionRunner struct {
+	db *sqlx.DB
+}
+
+func NewPostgresTransactionRunner(db *sqlx.DB) *PostgresTransactionRunner {
+	return &PostgresTransactionRunner{db: db}
+}
 
-	return err
+func (r *PostgresTransactionRunner) RunInTransaction(ctx context.Context, fn func(repos Repositories) error) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(NewPostgresRepositories(tx)); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// NewPostgresRepositories binds repositories either to the whole database or to a single transaction
+func NewPostgresRepositories(db sqlx.ExtContext) Repositories {
+	return Repositories{
+		Users:           NewPostgresUserRepository(db),
+		Ledger:          NewPostgresLedgerRepository(db),
+		Transactions:    NewPostgresTransactionRepository(db),
+		Reports:         NewPostgresReportRepository(db),
+		ReportRuns:      NewPostgresReportRunRepository(db),
+		ReportJobs:      NewPostgresReportJobRepository(db),
+		Reconciliations: NewPostgresReconciliationRepository(db),
+		IdempotencyKeys: NewPostgresIdempotencyKeyRepository(db),
+		APIKeys:         NewPostgresAPIKeyRepository(db),
+	}
 }
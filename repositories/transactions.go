@@ -1,40 +1,129 @@
 package repositories
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"time"
 )
 
+// Transaction is a posting of a journal entry to a single account, user id is empty for system accounts
 type Transaction struct {
 	ID                     int64         `db:"id"`
-	UserID                 int64         `db:"user_id"`
+	EntryID                int64         `db:"entry_id"`
+	AccountID              int64         `db:"account_id"`
+	AccountType            string        `db:"account_type"`
+	UserID                 sql.NullInt64 `db:"user_id"`
 	Amount                 int64         `db:"amount"`
+	Currency               string        `db:"currency"`
 	ServiceID              sql.NullInt64 `db:"service_id"`
 	OrderID                sql.NullInt64 `db:"order_id"`
-	IsReserveAccount       bool          `db:"is_reserve_account"`
 	CreatedAt              time.Time     `db:"created_at"`
 	CancelledTransactionId sql.NullInt64 `db:"canceled_transaction_id"`
+	RelatedTransactionID   sql.NullInt64 `db:"related_transaction_id"`
+	// ExpiresAt is set on the reserve account credit of reservations which are released unless captured in time
+	ExpiresAt sql.NullTime `db:"expires_at"`
 }
 
+func (t Transaction) IsReserveAccount() bool {
+	return t.AccountType == AccountUserReserve
+}
+
+// ReservationSettlement sums the reserve account postings which adjusted or settled the reservation
+type ReservationSettlement struct {
+	// Adjusted is added to the originally reserved amount by adjustments of the reservation
+	Adjusted int64 `db:"adjusted"`
+	// Captures is the number of withdrawals, Captured is the revenue they recognized
+	Captures int64 `db:"captures"`
+	Captured int64 `db:"captured"`
+	// Released is the unused remainder returned to the user once the order is final
+	Released    int64 `db:"released"`
+	IsCancelled bool  `db:"is_cancelled"`
+	IsExpired   bool  `db:"is_expired"`
+}
+
+const (
+	ReportGroupByService    = "service"
+	ReportGroupByDay        = "day"
+	ReportGroupByServiceDay = "service_day"
+)
+
+// TransactionReport is a row of the accounting report, service and day are empty unless the report is grouped by them
 type TransactionReport struct {
-	ServiceID         int64 `db:"service_id"`
-	Total             int64 `db:"total"`
+	ServiceID sql.NullInt64 `db:"service_id"`
+	Day       sql.NullTime  `db:"day"`
+	Currency  string        `db:"currency"`
+	// Orders is the number of orders the revenue was recognized for
+	Orders int64 `db:"orders"`
+	// Gross is the revenue recognized on withdrawals, refunds are not deducted
+	Gross int64 `db:"gross"`
+	// Refunded is the revenue given back to users
+	Refunded int64 `db:"refunded"`
+	// Cancelled is the amount of cancelled reservations returned to users
+	Cancelled int64 `db:"cancelled"`
+	// Released is what is left of reservations returned to users once the order was completed
+	Released int64 `db:"released"`
+	// Expired is what is left of expired reservations returned to users
+	Expired           int64 `db:"expired"`
 	LastTransactionID int64 `db:"last_transaction_id"`
 }
 
-func StoreTransaction(tx *sqlx.Tx, transaction *Transaction) error {
-	insertTransactionQuery := "INSERT INTO transactions (user_id, created_at, amount, service_id, order_id, is_reserve_account, canceled_transaction_id) VALUES (:user_id, :created_at, :amount, :service_id, :order_id, :is_reserve_account, :canceled_transaction_id)"
-	_, err := tx.NamedExec(insertTransactionQuery, transaction)
+// Net is the recognized revenue less the refunds made in the same period
+func (r TransactionReport) Net() int64 {
+	return r.Gross - r.Refunded
+}
+
+// reportPostingsCondition matches postings the report accounts for: recognized and refunded revenue and money
+// returned to users on cancellation, completion and expiration of reservations
+const reportPostingsCondition = "(a.type = 'service_revenue' or (a.type = 'user_main' and e.type in ('cancellation', 'release', 'expiration')))"
+
+type reportGrouping struct {
+	byService bool
+	byDay     bool
+}
+
+var reportGroupings = map[string]reportGrouping{
+	ReportGroupByService:    {byService: true},
+	ReportGroupByDay:        {byDay: true},
+	ReportGroupByServiceDay: {byService: true, byDay: true},
+}
+
+type TransactionHistoryItem struct {
+	Transaction
+	EntryType     string         `db:"entry_type"`
+	RelatedUserID sql.NullInt64  `db:"related_user_id"`
+	IsReleased    bool           `db:"is_released"`
+	Reason        sql.NullString `db:"reason"`
+}
+
+// selectTransactionsQuery joins the account type, which is not stored in the transactions table
+const selectTransactionsQuery = "SELECT t.*, a.type AS account_type FROM transactions t JOIN accounts a ON a.id = t.account_id"
+
+var transactionSortColumns = map[string]string{
+	"created_at": "t.created_at",
+	"amount":     "t.amount",
+}
+
+type PostgresTransactionRepository struct {
+	db sqlx.ExtContext
+}
+
+func NewPostgresTransactionRepository(db sqlx.ExtContext) *PostgresTransactionRepository {
+	return &PostgresTransactionRepository{db: db}
+}
+
+func (r *PostgresTransactionRepository) LinkTransaction(ctx context.Context, transactionID int64, relatedTransactionID int64) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE transactions SET related_transaction_id=$1 WHERE id=$2", relatedTransactionID, transactionID)
 	return err
 }
 
-func GetServiceTransaction(tx *sqlx.Tx, userID int64, serviceID int64, orderID int64, isReserveAccount bool) (*Transaction, error) {
+func (r *PostgresTransactionRepository) GetServiceTransaction(ctx context.Context, userID int64, serviceID int64, orderID int64, accountType string) (*Transaction, error) {
 	var transaction Transaction
-	transactionQuery := "SELECT * FROM transactions WHERE user_id=$1 and service_id=$2 and order_id=$3 and is_reserve_account=$4 LIMIT 1"
+	transactionQuery := selectTransactionsQuery + " WHERE t.user_id=$1 and t.service_id=$2 and t.order_id=$3 and a.type=$4 ORDER BY t.id LIMIT 1"
 
-	err := tx.Get(&transaction, transactionQuery, userID, serviceID, orderID, isReserveAccount)
+	err := sqlx.GetContext(ctx, r.db, &transaction, transactionQuery, userID, serviceID, orderID, accountType)
 
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
@@ -47,33 +136,77 @@ func GetServiceTransaction(tx *sqlx.Tx, userID int64, serviceID int64, orderID i
 	return &transaction, nil
 }
 
-func GetCancellingTransaction(tx *sqlx.Tx, canceledTransactionID int64) (*Transaction, error) {
-	var transaction Transaction
-	transactionQuery := "SELECT * FROM transactions WHERE canceled_transaction_id=$1 LIMIT 1"
-	err := tx.Get(&transaction, transactionQuery, canceledTransactionID)
+func (r *PostgresTransactionRepository) GetReservationSettlement(ctx context.Context, reservationID int64) (*ReservationSettlement, error) {
+	var settlement ReservationSettlement
+	settlementQuery := `select coalesce(sum(t.amount) filter (where e.type = 'reservation_adjustment'), 0) as adjusted,
+			       count(*) filter (where e.type = 'withdrawal')                              as captures,
+			       coalesce(-sum(t.amount) filter (where e.type = 'withdrawal'), 0)             as captured,
+			       coalesce(-sum(t.amount) filter (where e.type = 'release'), 0)                as released,
+			       coalesce(bool_or(e.type = 'cancellation'), false)                           as is_cancelled,
+			       coalesce(bool_or(e.type = 'expiration'), false)                             as is_expired
+			from transactions t
+			         join journal_entries e on e.id = t.entry_id
+			where t.canceled_transaction_id = $1`
 
-	if err != nil && err != sql.ErrNoRows {
+	err := sqlx.GetContext(ctx, r.db, &settlement, settlementQuery, reservationID)
+
+	if err != nil {
 		return nil, err
 	}
 
-	if err == sql.ErrNoRows {
-		return nil, nil
+	return &settlement, nil
+}
+
+func (r *PostgresTransactionRepository) GetRefundedAmount(ctx context.Context, userID int64, serviceID int64, orderID int64) (int64, error) {
+	var refunded int64
+	refundedQuery := `select coalesce(sum(t.amount), 0)
+			from transactions t
+			         join journal_entries e on e.id = t.entry_id
+			where t.user_id = $1
+			  and t.service_id = $2
+			  and t.order_id = $3
+			  and e.type = 'refund'`
+
+	err := r.db.QueryRowxContext(ctx, refundedQuery, userID, serviceID, orderID).Scan(&refunded)
+
+	if err != nil {
+		return 0, err
 	}
 
-	return &transaction, nil
+	return refunded, nil
 }
 
-func GetUserReservedAmount(tx *sqlx.Tx, userID int64) (int64, error) {
-	var sum int64
-	selectReservedQuery := "SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id=$1 and is_reserve_account=true"
+func (r *PostgresTransactionRepository) ClearReservationExpiry(ctx context.Context, reservationID int64) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE transactions SET expires_at=NULL WHERE id=$1", reservationID)
+	return err
+}
 
-	var err error
-	if tx == nil {
-		err = DB.QueryRow(selectReservedQuery, userID).Scan(&sum)
-	} else {
-		err = tx.QueryRow(selectReservedQuery, userID).Scan(&sum)
+func (r *PostgresTransactionRepository) SetReservationExpiry(ctx context.Context, reservationID int64, expiresAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE transactions SET expires_at=$1 WHERE id=$2", expiresAt, reservationID)
+	return err
+}
+
+func (r *PostgresTransactionRepository) GetExpiredReservations(ctx context.Context, now time.Time, afterID int64, limit int) ([]Transaction, error) {
+	var reservations []Transaction
+	reservationsQuery := selectTransactionsQuery + ` WHERE t.expires_at <= $1
+			  AND t.id > $2
+			  AND t.amount + coalesce((SELECT sum(s.amount) FROM transactions s WHERE s.canceled_transaction_id = t.id), 0) > 0
+			ORDER BY t.id
+			LIMIT $3`
+
+	if err := sqlx.SelectContext(ctx, r.db, &reservations, reservationsQuery, now, afterID, limit); err != nil {
+		return nil, err
 	}
 
+	return reservations, nil
+}
+
+func (r *PostgresTransactionRepository) GetUserReservedAmount(ctx context.Context, userID int64, currency string) (int64, error) {
+	var sum int64
+	selectReservedQuery := "SELECT COALESCE(SUM(balance), 0) FROM accounts WHERE user_id=$1 and currency=$2 and type='user_reserve'"
+
+	err := r.db.QueryRowxContext(ctx, selectReservedQuery, userID, currency).Scan(&sum)
+
 	if err != nil {
 		return 0, err
 	}
@@ -81,29 +214,41 @@ func GetUserReservedAmount(tx *sqlx.Tx, userID int64) (int64, error) {
 	return sum, nil
 }
 
-func GetLastTransactionIDForReport(tx *sqlx.Tx, month int, year int) (sql.NullInt64, error) {
+func (r *PostgresTransactionRepository) GetUserReservedAmounts(ctx context.Context, userID int64) (map[string]int64, error) {
+	var sums []struct {
+		Currency string `db:"currency"`
+		Sum      int64  `db:"sum"`
+	}
+	selectReservedQuery := "SELECT currency, balance as sum FROM accounts WHERE user_id=$1 and type='user_reserve'"
+
+	if err := sqlx.SelectContext(ctx, r.db, &sums, selectReservedQuery, userID); err != nil {
+		return nil, err
+	}
+
+	reserved := make(map[string]int64, len(sums))
+	for _, e := range sums {
+		reserved[e.Currency] = e.Sum
+	}
+
+	return reserved, nil
+}
+
+func (r *PostgresTransactionRepository) GetLastTransactionIDForReport(ctx context.Context, period ReportPeriod) (sql.NullInt64, error) {
+	begin, end, err := period.Bounds()
+	if err != nil {
+		return sql.NullInt64{}, err
+	}
+
 	var lastID sql.NullInt64
-	selectLastIDQuery := `select max(id)
+	selectLastIDQuery := `select max(t.id)
 			from transactions t
-			where t.is_reserve_account = false
-			  and t.service_id is not null
-			  and t.order_id is not null
-			  and amount < 0
-			  and date_part('year', created_at)=$1 
-			  and date_part('month', created_at)=$2
-			  and exists(select 1
-						 from transactions t2
-						 where t.order_id = t2.order_id
-						   and t.service_id = t2.service_id
-						   and t2.is_reserve_account = true
-						   and t2.canceled_transaction_id is not null)`
-
-	var err error
-	if tx == nil {
-		err = DB.QueryRow(selectLastIDQuery, year, month).Scan(&lastID)
-	} else {
-		err = tx.QueryRow(selectLastIDQuery, year, month).Scan(&lastID)
-	}
+			         join accounts a on a.id = t.account_id
+			         join journal_entries e on e.id = t.entry_id
+			where ` + reportPostingsCondition + `
+			  and t.created_at >= $1
+			  and t.created_at < $2`
+
+	err = r.db.QueryRowxContext(ctx, selectLastIDQuery, begin, end).Scan(&lastID)
 
 	if err != nil {
 		return sql.NullInt64{}, err
@@ -112,30 +257,49 @@ func GetLastTransactionIDForReport(tx *sqlx.Tx, month int, year int) (sql.NullIn
 	return lastID, nil
 }
 
-func GetReport(tx *sqlx.Tx, month int, year int) ([]TransactionReport, error) {
+func (r *PostgresTransactionRepository) GetReport(ctx context.Context, period ReportPeriod, groupBy string) ([]TransactionReport, error) {
+	grouping, ok := reportGroupings[groupBy]
+	if !ok {
+		return nil, fmt.Errorf("unsupported report grouping %q", groupBy)
+	}
+
+	begin, end, err := period.Bounds()
+	if err != nil {
+		return nil, err
+	}
+
+	serviceID, day := "null::bigint", "null::date"
+	args := []interface{}{begin, end}
+	if grouping.byService {
+		serviceID = "t.service_id"
+	}
+	if grouping.byDay {
+		// created_at is stored in UTC without a zone, so it is converted to the timezone of the period
+		day = "(t.created_at at time zone 'UTC' at time zone $3)::date"
+		args = append(args, period.Timezone)
+	}
+
 	var transactionReports []TransactionReport
-	reportQuery := `select t.service_id, sum(abs(t.amount)) as total, max(t.id) as last_transaction_id
+	reportQuery := `select ` + serviceID + ` as service_id,
+			       ` + day + ` as day,
+			       t.currency,
+			       count(distinct (t.service_id, t.order_id)) filter (where a.type = 'service_revenue' and e.type = 'withdrawal') as orders,
+			       coalesce(sum(t.amount) filter (where a.type = 'service_revenue' and e.type <> 'refund'), 0) as gross,
+			       coalesce(-sum(t.amount) filter (where a.type = 'service_revenue' and e.type = 'refund'), 0) as refunded,
+			       coalesce(sum(t.amount) filter (where a.type = 'user_main' and e.type = 'cancellation'), 0) as cancelled,
+			       coalesce(sum(t.amount) filter (where a.type = 'user_main' and e.type = 'release'), 0) as released,
+			       coalesce(sum(t.amount) filter (where a.type = 'user_main' and e.type = 'expiration'), 0) as expired,
+			       max(t.id) as last_transaction_id
 			from transactions t
-			where t.is_reserve_account = false
-			  and t.service_id is not null
-			  and t.order_id is not null
-			  and amount < 0
-			  and date_part('year', created_at)=$1 
-			  and date_part('month', created_at)=$2
-			  and exists(select 1
-						 from transactions t2
-						 where t.order_id = t2.order_id
-						   and t.service_id = t2.service_id
-						   and t2.is_reserve_account = true
-						   and t2.canceled_transaction_id is not null)
-			group by t.service_id`
-
-	var err error
-	if tx == nil {
-		err = DB.Select(&transactionReports, reportQuery, year, month)
-	} else {
-		err = tx.Select(&transactionReports, reportQuery, year, month)
-	}
+			         join accounts a on a.id = t.account_id
+			         join journal_entries e on e.id = t.entry_id
+			where ` + reportPostingsCondition + `
+			  and t.created_at >= $1
+			  and t.created_at < $2
+			group by 1, 2, t.currency
+			order by 1, 2, t.currency`
+
+	err = sqlx.SelectContext(ctx, r.db, &transactionReports, reportQuery, args...)
 
 	if err != nil {
 		return nil, err
@@ -143,3 +307,101 @@ func GetReport(tx *sqlx.Tx, month int, year int) ([]TransactionReport, error) {
 
 	return transactionReports, nil
 }
+
+func (r *PostgresTransactionRepository) GetUserTransactions(ctx context.Context, userID int64, sort string, desc bool, limit int, offset int) ([]TransactionHistoryItem, error) {
+	column, ok := transactionSortColumns[sort]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sort column %q", sort)
+	}
+
+	direction := "asc"
+	if desc {
+		direction = "desc"
+	}
+
+	var items []TransactionHistoryItem
+	historyQuery := `select t.*,
+			       a.type    as account_type,
+			       e.type    as entry_type,
+			       r.user_id as related_user_id,
+			       a.type = 'user_reserve' and t.amount < 0 and e.type in ('cancellation', 'release', 'expiration') as is_released,
+			       e.reason  as reason
+			from transactions t
+			         join accounts a on a.id = t.account_id
+			         join journal_entries e on e.id = t.entry_id
+			         left join transactions r on r.id = t.related_transaction_id
+			where t.user_id = $1
+			order by ` + column + " " + direction + ", t.id " + direction + `
+			limit $2 offset $3`
+
+	err := sqlx.SelectContext(ctx, r.db, &items, historyQuery, userID, limit, offset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func (r *PostgresTransactionRepository) CountUserTransactions(ctx context.Context, userID int64) (int64, error) {
+	var count int64
+	countQuery := "SELECT COUNT(*) FROM transactions WHERE user_id=$1"
+
+	err := r.db.QueryRowxContext(ctx, countQuery, userID).Scan(&count)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (r *PostgresTransactionRepository) GetUserBalanceAt(ctx context.Context, userID int64, currency string, at time.Time) (int64, error) {
+	var sum int64
+	selectBalanceQuery := "SELECT COALESCE(SUM(t.amount), 0) FROM transactions t JOIN accounts a ON a.id = t.account_id WHERE t.user_id=$1 and t.currency=$2 and a.type='user_main' and t.created_at < $3"
+
+	err := r.db.QueryRowxContext(ctx, selectBalanceQuery, userID, currency, at).Scan(&sum)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return sum, nil
+}
+
+func (r *PostgresTransactionRepository) EachUserMainAccountTransaction(ctx context.Context, userID int64, currency string, from time.Time, to time.Time, fn func(item TransactionHistoryItem) error) error {
+	statementQuery := `select t.*,
+			       a.type    as account_type,
+			       e.type    as entry_type,
+			       r.user_id as related_user_id,
+			       false     as is_released
+			from transactions t
+			         join accounts a on a.id = t.account_id
+			         join journal_entries e on e.id = t.entry_id
+			         left join transactions r on r.id = t.related_transaction_id
+			where t.user_id = $1
+			  and t.currency = $2
+			  and a.type = 'user_main'
+			  and t.created_at >= $3
+			  and t.created_at < $4
+			order by t.created_at, t.id`
+
+	rows, err := r.db.QueryxContext(ctx, statementQuery, userID, currency, from, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item TransactionHistoryItem
+		if err := rows.StructScan(&item); err != nil {
+			return err
+		}
+
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
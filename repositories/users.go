@@ -1,38 +1,47 @@
 package repositories
 
 import (
+	"context"
 	"database/sql"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 )
 
 type User struct {
-	ID      int64 `db:"id"`
-	Balance int64 `db:"balance"`
+	ID int64 `db:"id"`
 }
 
-func LockUser(tx *sqlx.Tx, userID int64) (*User, error) {
+// Balance is the balance of the user main account in the currency
+type Balance struct {
+	UserID   int64  `db:"user_id"`
+	Currency string `db:"currency"`
+	Balance  int64  `db:"balance"`
+}
+
+type PostgresUserRepository struct {
+	db sqlx.ExtContext
+}
+
+func NewPostgresUserRepository(db sqlx.ExtContext) *PostgresUserRepository {
+	return &PostgresUserRepository{db: db}
+}
+
+func (r *PostgresUserRepository) LockUser(ctx context.Context, userID int64) (*User, error) {
 	var user User
 
 	// Preventing race condition by locking user record
 	lockUserQuery := "SELECT * FROM users WHERE id=$1 FOR UPDATE"
-	if err := tx.Get(&user, lockUserQuery, userID); err != nil {
-		_ = tx.Rollback()
+	if err := sqlx.GetContext(ctx, r.db, &user, lockUserQuery, userID); err != nil {
 		return nil, err
 	}
 
 	return &user, nil
 }
 
-func GetUser(tx *sqlx.Tx, ID int64) (*User, error) {
+func (r *PostgresUserRepository) GetUser(ctx context.Context, ID int64) (*User, error) {
 	var user User
 
-	var err error
-	if tx == nil {
-		err = DB.Get(&user, "SELECT * FROM users WHERE id=$1 LIMIT 1", ID)
-	} else {
-		err = tx.Get(&user, "SELECT * FROM users WHERE id=$1 LIMIT 1", ID)
-	}
+	err := sqlx.GetContext(ctx, r.db, &user, "SELECT * FROM users WHERE id=$1 LIMIT 1", ID)
 
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
@@ -45,22 +54,22 @@ func GetUser(tx *sqlx.Tx, ID int64) (*User, error) {
 	return &user, nil
 }
 
-func StoreUser(tx *sqlx.Tx, ID int64) error {
-	user := User{ID: ID, Balance: 0}
-	_, err := tx.NamedExec("INSERT INTO users (id, balance) VALUES (:id, :balance)", &user)
+func (r *PostgresUserRepository) StoreUser(ctx context.Context, ID int64) error {
+	user := User{ID: ID}
+	_, err := sqlx.NamedExecContext(ctx, r.db, "INSERT INTO users (id) VALUES (:id)", &user)
 
 	return err
 }
 
-func StoreUserIfNotExists(tx *sqlx.Tx, userID int64) error {
-	user, err := GetUser(tx, userID)
+func (r *PostgresUserRepository) StoreUserIfNotExists(ctx context.Context, userID int64) error {
+	user, err := r.GetUser(ctx, userID)
 
 	if err != nil {
 		return err
 	}
 
 	if user == nil {
-		if err = StoreUser(tx, userID); err != nil {
+		if err = r.StoreUser(ctx, userID); err != nil {
 			return err
 		}
 	}
@@ -68,13 +77,28 @@ func StoreUserIfNotExists(tx *sqlx.Tx, userID int64) error {
 	return nil
 }
 
-func UpdateUserBalance(tx *sqlx.Tx, userID int64, amount int64) (*User, error) {
-	var user User
-	updateUserQuery := "UPDATE users SET balance = balance + $1 WHERE id=$2 RETURNING *"
+func (r *PostgresUserRepository) GetUserBalance(ctx context.Context, userID int64, currency string) (*Balance, error) {
+	var balance Balance
+
+	err := sqlx.GetContext(ctx, r.db, &balance, "SELECT user_id, currency, balance FROM accounts WHERE type='user_main' AND user_id=$1 AND currency=$2", userID, currency)
 
-	if err := tx.QueryRowx(updateUserQuery, amount, userID).StructScan(&user); err != nil {
+	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
 
-	return &user, nil
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return &balance, nil
+}
+
+func (r *PostgresUserRepository) GetUserBalances(ctx context.Context, userID int64) ([]Balance, error) {
+	var balances []Balance
+
+	if err := sqlx.SelectContext(ctx, r.db, &balances, "SELECT user_id, currency, balance FROM accounts WHERE type='user_main' AND user_id=$1 ORDER BY currency", userID); err != nil {
+		return nil, err
+	}
+
+	return balances, nil
 }
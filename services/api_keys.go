@@ -0,0 +1,141 @@
+package services
+
+import (
+	"balance-service/repositories"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scopes of API keys, a key may have any of them
+const (
+	// ScopeRead allows reading balances and transactions of users
+	ScopeRead = "read"
+	// ScopeWrite allows storing transactions, the ones of services are limited to the services of the key
+	ScopeWrite = "write"
+	// ScopeReports allows building, listing and downloading reports
+	ScopeReports = "reports"
+	// ScopeAdmin allows reconciliations and the scheduled report status
+	ScopeAdmin = "admin"
+)
+
+var Scopes = []string{ScopeRead, ScopeWrite, ScopeReports, ScopeAdmin}
+
+// APIKeyPrefix starts every key, so leaked keys are easy to recognize
+const APIKeyPrefix = "bs_"
+
+var ErrAPIKeyNotExists = errors.New("api key does not exist or is already revoked")
+
+type APIKeyService struct {
+	keys repositories.APIKeyRepository
+}
+
+func NewAPIKeyService(keys repositories.APIKeyRepository) *APIKeyService {
+	return &APIKeyService{keys: keys}
+}
+
+// CreateAPIKey stores the hash of a new random key and returns the key itself, which can't be recovered later
+func (s *APIKeyService) CreateAPIKey(ctx context.Context, name string, scopes []string, serviceIDs []int64) (*repositories.APIKey, string, error) {
+	if name == "" {
+		return nil, "", fmt.Errorf("api key name is required")
+	}
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !isScope(scope) {
+			return nil, "", fmt.Errorf("invalid scope %q, one of %s is expected", scope, strings.Join(Scopes, ", "))
+		}
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, "", err
+	}
+	plaintext := APIKeyPrefix + hex.EncodeToString(random)
+
+	key := repositories.APIKey{
+		Name:       name,
+		KeyPrefix:  plaintext[:len(APIKeyPrefix)+8],
+		KeyHash:    hashAPIKey(plaintext),
+		Scopes:     scopes,
+		ServiceIDs: serviceIDs,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if key.ServiceIDs == nil {
+		key.ServiceIDs = []int64{}
+	}
+
+	if err := s.keys.StoreAPIKey(ctx, &key); err != nil {
+		return nil, "", err
+	}
+
+	return &key, plaintext, nil
+}
+
+// Authenticate returns the key unless it is unknown or revoked, nil otherwise
+func (s *APIKeyService) Authenticate(ctx context.Context, plaintext string) (*repositories.APIKey, error) {
+	if !strings.HasPrefix(plaintext, APIKeyPrefix) {
+		return nil, nil
+	}
+
+	return s.keys.GetActiveAPIKeyByHash(ctx, hashAPIKey(plaintext))
+}
+
+func (s *APIKeyService) GetAPIKeys(ctx context.Context) ([]repositories.APIKey, error) {
+	return s.keys.GetAPIKeys(ctx)
+}
+
+func (s *APIKeyService) RevokeAPIKey(ctx context.Context, ID int64) error {
+	revoked, err := s.keys.RevokeAPIKey(ctx, ID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrAPIKeyNotExists
+	}
+
+	return nil
+}
+
+// ParseServiceIDs parses a comma separated list of service ids like "1,2"
+func ParseServiceIDs(spec string) ([]int64, error) {
+	serviceIDs := []int64{}
+	for _, value := range strings.Split(spec, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		ID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ID <= 0 {
+			return nil, fmt.Errorf("invalid service id %q", value)
+		}
+		serviceIDs = append(serviceIDs, ID)
+	}
+
+	return serviceIDs, nil
+}
+
+func isScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hashAPIKey is a plain SHA-256 as keys are random enough to make brute forcing pointless
+func hashAPIKey(plaintext string) string {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	return hex.EncodeToString(hash[:])
+}
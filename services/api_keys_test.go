@@ -0,0 +1,125 @@
+package services
+
+import (
+	"balance-service/repositories/memory"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCreateAPIKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		keyName    string
+		scopes     []string
+		serviceIDs []int64
+		wantErr    bool
+	}{
+		{name: "service key", keyName: "billing", scopes: []string{ScopeWrite}, serviceIDs: []int64{1, 2}},
+		{name: "unrestricted key", keyName: "admin", scopes: []string{ScopeRead, ScopeAdmin}},
+		{name: "without name", scopes: []string{ScopeRead}, wantErr: true},
+		{name: "without scopes", keyName: "billing", wantErr: true},
+		{name: "unknown scope", keyName: "billing", scopes: []string{ScopeRead, "root"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := NewAPIKeyService(memory.NewStore().Repositories().APIKeys)
+
+			key, plaintext, err := s.CreateAPIKey(ctx, tt.keyName, tt.scopes, tt.serviceIDs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if !strings.HasPrefix(plaintext, APIKeyPrefix) || len(plaintext) != len(APIKeyPrefix)+64 {
+				t.Errorf("key = %q, want %s and 64 hex digits", plaintext, APIKeyPrefix)
+			}
+			if !strings.HasPrefix(plaintext, key.KeyPrefix) || key.KeyHash == plaintext {
+				t.Errorf("stored prefix %q and hash %q of key %q", key.KeyPrefix, key.KeyHash, plaintext)
+			}
+			if key.ServiceIDs == nil {
+				t.Error("service ids should be empty rather than nil")
+			}
+
+			authenticated, err := s.Authenticate(ctx, plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if authenticated == nil || authenticated.ID != key.ID || !reflect.DeepEqual(authenticated.Scopes, key.Scopes) || len(key.Scopes) != len(tt.scopes) {
+				t.Errorf("authenticated = %+v, want %+v", authenticated, key)
+			}
+		})
+	}
+}
+
+func TestAuthenticateAndRevokeAPIKey(t *testing.T) {
+	ctx := context.Background()
+	s := NewAPIKeyService(memory.NewStore().Repositories().APIKeys)
+
+	key, plaintext, err := s.CreateAPIKey(ctx, "billing", []string{ScopeWrite}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.CreateAPIKey(ctx, "reports", []string{ScopeReports}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, unknown := range []string{"", "secret", APIKeyPrefix + strings.Repeat("0", 64), strings.TrimPrefix(plaintext, APIKeyPrefix)} {
+		if authenticated, err := s.Authenticate(ctx, unknown); err != nil || authenticated != nil {
+			t.Errorf("key %q authenticated as %+v, %v", unknown, authenticated, err)
+		}
+	}
+
+	if err := s.RevokeAPIKey(ctx, key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if authenticated, err := s.Authenticate(ctx, plaintext); err != nil || authenticated != nil {
+		t.Errorf("revoked key authenticated as %+v, %v", authenticated, err)
+	}
+	if err := s.RevokeAPIKey(ctx, key.ID); err != ErrAPIKeyNotExists {
+		t.Errorf("second revoke err = %v, want %v", err, ErrAPIKeyNotExists)
+	}
+	if err := s.RevokeAPIKey(ctx, 100); err != ErrAPIKeyNotExists {
+		t.Errorf("revoke of unknown key err = %v, want %v", err, ErrAPIKeyNotExists)
+	}
+
+	keys, err := s.GetAPIKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !keys[0].RevokedAt.Valid || keys[1].RevokedAt.Valid {
+		t.Errorf("keys = %+v, want the revoked key listed with the active one", keys)
+	}
+}
+
+func TestParseServiceIDs(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []int64
+		wantErr bool
+	}{
+		{spec: "", want: []int64{}},
+		{spec: "1", want: []int64{1}},
+		{spec: " 1, 2,,3 ", want: []int64{1, 2, 3}},
+		{spec: "1,x", wantErr: true},
+		{spec: "0", wantErr: true},
+		{spec: "-2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseServiceIDs(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("service ids = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"log"
+	"strconv"
+	"time"
+)
+
+// BalanceCache keeps balances and reserved amounts of users between requests.
+// Errors of the cache are never fatal, the caller falls back to the database.
+type BalanceCache interface {
+	// GetBalances returns false if the user balances are not cached, along with the version of the user balances
+	// which is passed to SetBalances once they are read from the database
+	GetBalances(ctx context.Context, userID int64) ([]CurrencyBalance, int64, bool, error)
+	// SetBalances caches the balances unless they were invalidated since GetBalances returned the version,
+	// so balances read before a change are never cached after its invalidation
+	SetBalances(ctx context.Context, userID int64, version int64, balances []CurrencyBalance) error
+	// InvalidateBalances drops cached balances, it should be called once the change is committed
+	InvalidateBalances(ctx context.Context, userIDs ...int64) error
+}
+
+// NoBalanceCache is used when no cache is configured, every request goes to the database
+type NoBalanceCache struct{}
+
+func (NoBalanceCache) GetBalances(ctx context.Context, userID int64) ([]CurrencyBalance, int64, bool, error) {
+	return nil, 0, false, nil
+}
+
+func (NoBalanceCache) SetBalances(ctx context.Context, userID int64, version int64, balances []CurrencyBalance) error {
+	return nil
+}
+
+func (NoBalanceCache) InvalidateBalances(ctx context.Context, userIDs ...int64) error {
+	return nil
+}
+
+// setBalancesScript sets the balances only if the version is still the one the balances were read at,
+// a missing version counts as zero
+var setBalancesScript = redis.NewScript(2, `
+local version = redis.call("GET", KEYS[2]) or "0"
+if version ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+return 1
+`)
+
+// RedisBalanceCache stores balances of every user as a JSON value expiring after the TTL,
+// the TTL also bounds staleness if an invalidation is lost. Every invalidation bumps the version of the user
+// balances, which lives longer than the balances.
+type RedisBalanceCache struct {
+	pool *redis.Pool
+	ttl  time.Duration
+}
+
+func NewRedisBalanceCache(pool *redis.Pool, ttl time.Duration) *RedisBalanceCache {
+	return &RedisBalanceCache{pool: pool, ttl: ttl}
+}
+
+// NewRedisPool connects to the server given by a redis:// URL
+func NewRedisPool(url string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 5 * time.Minute,
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			return redis.DialURLContext(ctx, url, redis.DialConnectTimeout(time.Second), redis.DialReadTimeout(time.Second), redis.DialWriteTimeout(time.Second))
+		},
+	}
+}
+
+func (c *RedisBalanceCache) GetBalances(ctx context.Context, userID int64) ([]CurrencyBalance, int64, bool, error) {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(redis.DoContext(conn, ctx, "MGET", balancesKey(userID), balancesVersionKey(userID)))
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	var version int64
+	if values[1] != nil {
+		if version, err = strconv.ParseInt(string(values[1]), 10, 64); err != nil {
+			return nil, 0, false, err
+		}
+	}
+	if values[0] == nil {
+		return nil, version, false, nil
+	}
+
+	var balances []CurrencyBalance
+	if err := json.Unmarshal(values[0], &balances); err != nil {
+		return nil, version, false, err
+	}
+
+	return balances, version, true, nil
+}
+
+func (c *RedisBalanceCache) SetBalances(ctx context.Context, userID int64, version int64, balances []CurrencyBalance) error {
+	value, err := json.Marshal(balances)
+	if err != nil {
+		return err
+	}
+
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = setBalancesScript.DoContext(ctx, conn, balancesKey(userID), balancesVersionKey(userID), version, value, c.ttl.Milliseconds())
+	return err
+}
+
+func (c *RedisBalanceCache) InvalidateBalances(ctx context.Context, userIDs ...int64) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The version outlives any fill which may have started before the invalidation
+	versionTTL := 10 * c.ttl.Milliseconds()
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if err := conn.Send("DEL", balancesKey(userID)); err != nil {
+			return err
+		}
+		if err := conn.Send("INCR", balancesVersionKey(userID)); err != nil {
+			return err
+		}
+		if err := conn.Send("PEXPIRE", balancesVersionKey(userID), versionTTL); err != nil {
+			return err
+		}
+	}
+
+	_, err = redis.DoContext(conn, ctx, "EXEC")
+	return err
+}
+
+func balancesKey(userID int64) string {
+	return "balances:" + strconv.FormatInt(userID, 10)
+}
+
+func balancesVersionKey(userID int64) string {
+	return "balances_version:" + strconv.FormatInt(userID, 10)
+}
+
+// invalidateBalances drops cached balances after a committed change, a failure is only logged
+// as the entry expires by itself
+func invalidateBalances(cache BalanceCache, userIDs ...int64) {
+	// The change is already committed, so the invalidation shouldn't depend on the request being alive
+	if err := cache.InvalidateBalances(context.Background(), userIDs...); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"balance-service/repositories/memory"
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestRedisCache(t *testing.T) (*RedisBalanceCache, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	pool := &redis.Pool{
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			return redis.DialContext(ctx, "tcp", server.Addr())
+		},
+	}
+	t.Cleanup(func() { _ = pool.Close() })
+
+	return NewRedisBalanceCache(pool, time.Minute), server
+}
+
+func TestRedisBalanceCache(t *testing.T) {
+	ctx := context.Background()
+	cache, server := newTestRedisCache(t)
+	balances := []CurrencyBalance{{Currency: "RUB", Balance: 100, Reserved: 20}}
+
+	cached, version, ok, err := cache.GetBalances(ctx, 1)
+	if err != nil || ok || cached != nil {
+		t.Fatalf("miss = %v, %v, %v, want nothing cached", cached, ok, err)
+	}
+
+	if err := cache.SetBalances(ctx, 1, version, balances); err != nil {
+		t.Fatal(err)
+	}
+	cached, _, ok, err = cache.GetBalances(ctx, 1)
+	if err != nil || !ok || !reflect.DeepEqual(cached, balances) {
+		t.Fatalf("hit = %v, %v, %v, want %v", cached, ok, err, balances)
+	}
+	if ttl := server.TTL(balancesKey(1)); ttl != time.Minute {
+		t.Errorf("balances TTL = %v, want %v", ttl, time.Minute)
+	}
+
+	if err := cache.InvalidateBalances(ctx, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists(balancesKey(1)) {
+		t.Error("balances are still cached after the invalidation")
+	}
+
+	// Balances read before the invalidation are not cached after it
+	if err := cache.SetBalances(ctx, 1, version, balances); err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists(balancesKey(1)) {
+		t.Error("balances of the outdated version are cached")
+	}
+
+	_, version, _, err = cache.GetBalances(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.SetBalances(ctx, 1, version, balances); err != nil {
+		t.Fatal(err)
+	}
+	if !server.Exists(balancesKey(1)) {
+		t.Error("balances of the current version are not cached")
+	}
+}
+
+// interleavingCache runs the change between the read of balances from the database and the fill of the cache
+type interleavingCache struct {
+	BalanceCache
+	change func()
+}
+
+func (c *interleavingCache) SetBalances(ctx context.Context, userID int64, version int64, balances []CurrencyBalance) error {
+	if c.change != nil {
+		c.change()
+		c.change = nil
+	}
+
+	return c.BalanceCache.SetBalances(ctx, userID, version, balances)
+}
+
+func TestGetUserBalanceDoesNotCacheBalancesChangedDuringRead(t *testing.T) {
+	ctx := context.Background()
+	redisCache, _ := newTestRedisCache(t)
+	store := memory.NewStore()
+	repos := store.Repositories()
+
+	transactions := NewTransactionService(store, redisCache, "RUB", ReservationTTL{})
+	cache := &interleavingCache{BalanceCache: redisCache}
+	users := NewUserService(repos.Users, repos.Transactions, NoRatesProvider{}, cache, "RUB")
+
+	if _, err := transactions.StoreReplenishmentTransaction(ctx, 1, 100, "RUB"); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.change = func() {
+		if _, err := transactions.StoreReplenishmentTransaction(ctx, 1, 50, "RUB"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := users.GetUserBalance(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	balances, err := users.GetUserBalance(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balances[0].Balance != 150 {
+		t.Errorf("balance = %d, want 150", balances[0].Balance)
+	}
+}
+
+func TestBalanceCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// prepare runs before balances are cached
+		prepare func(s *TransactionService) error
+		change  func(s *TransactionService) error
+		// userIDs are the users whose cached balances should be dropped
+		userIDs []int64
+	}{
+		{
+			name: "replenishment",
+			change: func(s *TransactionService) error {
+				_, err := s.StoreReplenishmentTransaction(ctx, 1, 10, "RUB")
+				return err
+			},
+			userIDs: []int64{1},
+		},
+		{
+			name: "reservation",
+			change: func(s *TransactionService) error {
+				_, _, err := s.StoreReservationTransaction(ctx, 1, 10, "RUB", 1, 1, time.Time{})
+				return err
+			},
+			userIDs: []int64{1},
+		},
+		{
+			name: "reservation adjustment",
+			prepare: func(s *TransactionService) error {
+				_, _, err := s.StoreReservationTransaction(ctx, 1, 10, "RUB", 1, 1, time.Time{})
+				return err
+			},
+			change: func(s *TransactionService) error {
+				_, _, err := s.AdjustReservation(ctx, 1, 20, "RUB", 1, 1)
+				return err
+			},
+			userIDs: []int64{1},
+		},
+		{
+			name: "withdrawal",
+			prepare: func(s *TransactionService) error {
+				_, _, err := s.StoreReservationTransaction(ctx, 1, 10, "RUB", 1, 1, time.Time{})
+				return err
+			},
+			change: func(s *TransactionService) error {
+				_, _, err := s.StoreWithdrawalTransaction(ctx, 1, 10, "RUB", 1, 1, false)
+				return err
+			},
+			userIDs: []int64{1},
+		},
+		{
+			name: "cancellation",
+			prepare: func(s *TransactionService) error {
+				_, _, err := s.StoreReservationTransaction(ctx, 1, 10, "RUB", 1, 1, time.Time{})
+				return err
+			},
+			change: func(s *TransactionService) error {
+				_, err := s.StoreCancellationTransaction(ctx, 1, 10, "RUB", 1, 1)
+				return err
+			},
+			userIDs: []int64{1},
+		},
+		{
+			name: "refund",
+			prepare: func(s *TransactionService) error {
+				if _, _, err := s.StoreReservationTransaction(ctx, 1, 10, "RUB", 1, 1, time.Time{}); err != nil {
+					return err
+				}
+				_, _, err := s.StoreWithdrawalTransaction(ctx, 1, 10, "RUB", 1, 1, false)
+				return err
+			},
+			change: func(s *TransactionService) error {
+				_, _, err := s.StoreRefundTransaction(ctx, 1, 5, "RUB", 1, 1)
+				return err
+			},
+			userIDs: []int64{1},
+		},
+		{
+			name: "transfer",
+			change: func(s *TransactionService) error {
+				_, _, err := s.StoreTransferTransaction(ctx, 1, 2, 10, "RUB")
+				return err
+			},
+			userIDs: []int64{1, 2},
+		},
+		{
+			name: "expiration",
+			prepare: func(s *TransactionService) error {
+				_, _, err := s.StoreReservationTransaction(ctx, 1, 10, "RUB", 1, 1, time.Now().Add(time.Minute))
+				return err
+			},
+			change: func(s *TransactionService) error {
+				_, err := s.ExpireReservations(ctx, time.Now().Add(time.Hour), 10)
+				return err
+			},
+			userIDs: []int64{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, server := newTestRedisCache(t)
+			store := memory.NewStore()
+			repos := store.Repositories()
+			transactions := NewTransactionService(store, cache, "RUB", ReservationTTL{})
+			users := NewUserService(repos.Users, repos.Transactions, NoRatesProvider{}, cache, "RUB")
+
+			for _, userID := range []int64{1, 2} {
+				if _, err := transactions.StoreReplenishmentTransaction(ctx, userID, 100, "RUB"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.prepare != nil {
+				if err := tt.prepare(transactions); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, userID := range tt.userIDs {
+				if _, err := users.GetUserBalance(ctx, userID); err != nil {
+					t.Fatal(err)
+				}
+				if !server.Exists(balancesKey(userID)) {
+					t.Fatalf("balances of user %d are not cached", userID)
+				}
+			}
+
+			if err := tt.change(transactions); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, userID := range tt.userIDs {
+				if server.Exists(balancesKey(userID)) {
+					t.Errorf("balances of user %d are still cached", userID)
+				}
+			}
+		})
+	}
+}
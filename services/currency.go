@@ -0,0 +1,19 @@
+package services
+
+// DefaultBaseCurrency is used when no base currency is configured
+const DefaultBaseCurrency = "RUB"
+
+// IsCurrencyCode checks the code looks like an ISO 4217 one, three upper case latin letters
+func IsCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"balance-service/repositories"
+	"balance-service/repositories/memory"
+	"context"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPostgresDSNVariable names the variable with the connection string of a Postgres database for tests which
+// need real row locks, the tests create a schema of their own in it and drop it afterwards
+const testPostgresDSNVariable = "TEST_POSTGRES_DSN"
+
+// testEnv wires services to a fresh in-memory store or a fresh Postgres schema, store is nil for the latter
+type testEnv struct {
+	store        *memory.Store
+	runner       repositories.TransactionRunner
+	repos        repositories.Repositories
+	transactions *TransactionService
+	users        *UserService
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	store := memory.NewStore()
+	repos := store.Repositories()
+
+	return &testEnv{
+		store:        store,
+		runner:       store,
+		repos:        repos,
+		transactions: NewTransactionService(store, NoBalanceCache{}, "RUB", ReservationTTL{}),
+		users:        NewUserService(repos.Users, repos.Transactions, NoRatesProvider{}, NoBalanceCache{}, "RUB"),
+	}
+}
+
+// newPostgresTestEnv migrates a new schema of the database given by TEST_POSTGRES_DSN, the test is skipped
+// without the database
+func newPostgresTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	dsn := os.Getenv(testPostgresDSNVariable)
+	if dsn == "" {
+		t.Skipf("%s is not set", testPostgresDSNVariable)
+	}
+	ctx := context.Background()
+
+	admin, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	if _, err := admin.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		_ = admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.ExecContext(context.Background(), "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			t.Error(err)
+		}
+		_ = admin.Close()
+	})
+
+	db, err := sqlx.Connect("postgres", withSearchPath(t, dsn, schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Registered after the schema cleanup, so the connections are closed before the schema is dropped
+	t.Cleanup(func() { _ = db.Close() })
+
+	if _, err := repositories.MigrateUp(ctx, db, "RUB"); err != nil {
+		t.Fatal(err)
+	}
+
+	runner := repositories.NewPostgresTransactionRunner(db)
+	repos := repositories.NewPostgresRepositories(db)
+
+	return &testEnv{
+		runner:       runner,
+		repos:        repos,
+		transactions: NewTransactionService(runner, NoBalanceCache{}, "RUB", ReservationTTL{}),
+		users:        NewUserService(repos.Users, repos.Transactions, NoRatesProvider{}, NoBalanceCache{}, "RUB"),
+	}
+}
+
+// withSearchPath makes every connection of the data source name use the schema,
+// both URL and key=value data source names are accepted
+func withSearchPath(t *testing.T, dsn string, schema string) string {
+	t.Helper()
+
+	if !strings.Contains(dsn, "://") {
+		return dsn + " search_path=" + schema
+	}
+
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	query.Set("search_path", schema)
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String()
+}
+
+// forEachStore runs the test against the in-memory store, which serializes all transactions, and against Postgres,
+// where only the row locks taken by the services keep concurrent transactions apart
+func forEachStore(t *testing.T, test func(t *testing.T, env *testEnv)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newTestEnv(t))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		test(t, newPostgresTestEnv(t))
+	})
+}
+
+func (e *testEnv) replenish(t *testing.T, userID int64, amount int64) {
+	t.Helper()
+
+	if _, err := e.transactions.StoreReplenishmentTransaction(context.Background(), userID, amount, "RUB"); err != nil {
+		t.Fatalf("replenish user %d with %d: %v", userID, amount, err)
+	}
+}
+
+func (e *testEnv) reserve(t *testing.T, userID int64, amount int64, orderID int64, serviceID int64) {
+	t.Helper()
+
+	if _, _, err := e.transactions.StoreReservationTransaction(context.Background(), userID, amount, "RUB", orderID, serviceID, time.Time{}); err != nil {
+		t.Fatalf("reserve %d for order %d: %v", amount, orderID, err)
+	}
+}
+
+func (e *testEnv) withdraw(t *testing.T, userID int64, amount int64, orderID int64, serviceID int64, final bool) {
+	t.Helper()
+
+	if _, _, err := e.transactions.StoreWithdrawalTransaction(context.Background(), userID, amount, "RUB", orderID, serviceID, final); err != nil {
+		t.Fatalf("withdraw %d for order %d: %v", amount, orderID, err)
+	}
+}
+
+// balance returns the main balance and the reserved amount of the user in RUB
+func (e *testEnv) balance(t *testing.T, userID int64) (int64, int64) {
+	t.Helper()
+
+	balances, err := e.users.GetUserBalance(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("get balance of user %d: %v", userID, err)
+	}
+	for _, balance := range balances {
+		if balance.Currency == "RUB" {
+			return balance.Balance, balance.Reserved
+		}
+	}
+
+	return 0, 0
+}
+
+func (e *testEnv) assertBalance(t *testing.T, userID int64, wantBalance int64, wantReserved int64) {
+	t.Helper()
+
+	balance, reserved := e.balance(t, userID)
+	if balance != wantBalance || reserved != wantReserved {
+		t.Errorf("user %d balance = %d, reserved = %d, want %d, %d", userID, balance, reserved, wantBalance, wantReserved)
+	}
+}
+
+// assertLedgerConsistent checks that materialized balances match the postings of their accounts
+func (e *testEnv) assertLedgerConsistent(t *testing.T) {
+	t.Helper()
+
+	reconciliation := NewReconciliationService(e.runner, e.repos.Ledger, e.repos.Reconciliations)
+	run, mismatches, err := reconciliation.Reconcile(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Mismatches != 0 {
+		t.Errorf("ledger has %d mismatches: %+v", run.Mismatches, mismatches)
+	}
+}
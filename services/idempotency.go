@@ -0,0 +1,131 @@
+package services
+
+import (
+	"balance-service/repositories"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/google/uuid"
+	"time"
+)
+
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used with a different request")
+var ErrIdempotencyKeyInProgress = errors.New("request with this idempotency key is still being processed")
+var ErrIdempotencyKeyResponseLost = errors.New("request with this idempotency key was processed, but its response was lost")
+var ErrIdempotencyClaimLost = errors.New("idempotency key was claimed by a retry of the request")
+
+// idempotencyClaimStaleAfter is how long a key may stay claimed by a request before the request is considered lost
+// with a crashed replica, so that a retry claims the key again. Claims of requests which already moved money
+// are never taken over, see WithIdempotencyClaim.
+const idempotencyClaimStaleAfter = time.Minute
+
+// IdempotencyClaim identifies the request which claimed the key, every claim of the key has its own token
+type IdempotencyClaim struct {
+	APIKeyID int64
+	Key      string
+	Endpoint string
+	Token    string
+}
+
+type idempotencyClaimContextKey struct{}
+
+// WithIdempotencyClaim makes transactions of TransactionService started with the context mark the claim as applied
+// before changing balances. The mark is committed or rolled back together with the change, so a claim whose request
+// committed its change is never taken over by a retry, even if the response was not stored.
+func WithIdempotencyClaim(ctx context.Context, claim *IdempotencyClaim) context.Context {
+	return context.WithValue(ctx, idempotencyClaimContextKey{}, claim)
+}
+
+// applyIdempotencyClaim marks the claim of the context as applied within the transaction,
+// fails if a retry took the claim over in the meantime
+func applyIdempotencyClaim(ctx context.Context, repos repositories.Repositories) error {
+	claim, ok := ctx.Value(idempotencyClaimContextKey{}).(*IdempotencyClaim)
+	if !ok {
+		return nil
+	}
+
+	applied, err := repos.IdempotencyKeys.MarkIdempotencyKeyApplied(ctx, claim.APIKeyID, claim.Key, claim.Endpoint, claim.Token, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return ErrIdempotencyClaimLost
+	}
+
+	return nil
+}
+
+type IdempotencyService struct {
+	idempotencyKeys repositories.IdempotencyKeyRepository
+}
+
+func NewIdempotencyService(idempotencyKeys repositories.IdempotencyKeyRepository) *IdempotencyService {
+	return &IdempotencyService{idempotencyKeys: idempotencyKeys}
+}
+
+// BeginIdempotentRequest claims the key of the API key for the request, returns the stored response instead of a claim
+// if the request was already processed. Clients without an API key pass zero.
+func (s *IdempotencyService) BeginIdempotentRequest(ctx context.Context, apiKeyID int64, key string, endpoint string, body []byte) (*IdempotencyClaim, *repositories.IdempotencyKey, error) {
+	hash := sha256.Sum256(body)
+	claim := &IdempotencyClaim{APIKeyID: apiKeyID, Key: key, Endpoint: endpoint, Token: uuid.NewString()}
+
+	idempotencyKey := repositories.IdempotencyKey{
+		APIKeyID:    apiKeyID,
+		Key:         key,
+		Endpoint:    endpoint,
+		RequestHash: hex.EncodeToString(hash[:]),
+		ClaimToken:  claim.Token,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	stored, err := s.idempotencyKeys.StoreIdempotencyKeyIfNotExists(ctx, &idempotencyKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stored {
+		return claim, nil, nil
+	}
+
+	existing, err := s.idempotencyKeys.GetIdempotencyKey(ctx, apiKeyID, key, endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	if existing == nil {
+		// Claim was released by a failed request in the meantime
+		return nil, nil, ErrIdempotencyKeyInProgress
+	}
+
+	if existing.RequestHash != idempotencyKey.RequestHash {
+		return nil, nil, ErrIdempotencyKeyReused
+	}
+
+	if existing.StatusCode.Valid {
+		return nil, existing, nil
+	}
+
+	// Money was moved, so the request must not run again, even though its response is unknown
+	if existing.AppliedAt.Valid {
+		return nil, nil, ErrIdempotencyKeyResponseLost
+	}
+
+	reclaimed, err := s.idempotencyKeys.ReclaimStaleIdempotencyKey(ctx, apiKeyID, key, endpoint, idempotencyKey.CreatedAt.Add(-idempotencyClaimStaleAfter), idempotencyKey.CreatedAt, claim.Token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reclaimed {
+		return claim, nil, nil
+	}
+
+	return nil, nil, ErrIdempotencyKeyInProgress
+}
+
+// CompleteIdempotentRequest stores the response, unless a retry took the claim over
+func (s *IdempotencyService) CompleteIdempotentRequest(ctx context.Context, claim *IdempotencyClaim, statusCode int, responseBody []byte) error {
+	return s.idempotencyKeys.UpdateIdempotencyKeyResponse(ctx, claim.APIKeyID, claim.Key, claim.Endpoint, claim.Token, statusCode, responseBody)
+}
+
+// ReleaseIdempotentRequest forgets the key, so the request can be retried. Claims which are marked as applied are kept.
+func (s *IdempotencyService) ReleaseIdempotentRequest(ctx context.Context, claim *IdempotencyClaim) error {
+	return s.idempotencyKeys.DeleteIdempotencyKey(ctx, claim.APIKeyID, claim.Key, claim.Endpoint, claim.Token)
+}
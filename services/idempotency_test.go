@@ -0,0 +1,211 @@
+package services
+
+import (
+	"balance-service/repositories/memory"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIdempotentRequest(t *testing.T) {
+	ctx := context.Background()
+	request := []byte(`{"user_id":1,"amount":100}`)
+
+	tests := []struct {
+		name string
+		// prepare runs before the request with key "k" of API key 1 to /replenish begins
+		prepare    func(t *testing.T, s *IdempotencyService)
+		body       []byte
+		wantErr    error
+		wantStored bool
+	}{
+		{
+			name: "new key",
+		},
+		{
+			name: "still processed",
+			prepare: func(t *testing.T, s *IdempotencyService) {
+				if _, _, err := s.BeginIdempotentRequest(ctx, 1, "k", "/replenish", request); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrIdempotencyKeyInProgress,
+		},
+		{
+			name: "completed",
+			prepare: func(t *testing.T, s *IdempotencyService) {
+				claim, _, err := s.BeginIdempotentRequest(ctx, 1, "k", "/replenish", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.CompleteIdempotentRequest(ctx, claim, 200, []byte(`{"balance":100}`)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantStored: true,
+		},
+		{
+			name: "reused with another body",
+			prepare: func(t *testing.T, s *IdempotencyService) {
+				if _, _, err := s.BeginIdempotentRequest(ctx, 1, "k", "/replenish", []byte(`{"user_id":1,"amount":5}`)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrIdempotencyKeyReused,
+		},
+		{
+			name: "released",
+			prepare: func(t *testing.T, s *IdempotencyService) {
+				claim, _, err := s.BeginIdempotentRequest(ctx, 1, "k", "/replenish", request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.ReleaseIdempotentRequest(ctx, claim); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "same key of another endpoint",
+			prepare: func(t *testing.T, s *IdempotencyService) {
+				if _, _, err := s.BeginIdempotentRequest(ctx, 1, "k", "/reserve", request); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "same key of another API key",
+			prepare: func(t *testing.T, s *IdempotencyService) {
+				if _, _, err := s.BeginIdempotentRequest(ctx, 2, "k", "/replenish", request); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewIdempotencyService(memory.NewStore().Repositories().IdempotencyKeys)
+			if tt.prepare != nil {
+				tt.prepare(t, s)
+			}
+
+			claim, stored, err := s.BeginIdempotentRequest(ctx, 1, "k", "/replenish", request)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if (claim != nil) != (err == nil && !tt.wantStored) {
+				t.Errorf("claim = %+v, want claimed %v", claim, err == nil && !tt.wantStored)
+			}
+			if (stored != nil) != tt.wantStored {
+				t.Fatalf("stored = %+v, want stored response %v", stored, tt.wantStored)
+			}
+			if stored != nil && (stored.StatusCode.Int32 != 200 || string(stored.ResponseBody) != `{"balance":100}`) {
+				t.Errorf("stored = %d %s", stored.StatusCode.Int32, stored.ResponseBody)
+			}
+		})
+	}
+}
+
+func TestIdempotentRequestReclaimsStaleClaim(t *testing.T) {
+	ctx := context.Background()
+	request := []byte(`{"user_id":1,"amount":100}`)
+	keys := memory.NewStore().Repositories().IdempotencyKeys
+	s := NewIdempotencyService(keys)
+
+	lost, _, err := s.BeginIdempotentRequest(ctx, 1, "k", "/replenish", request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The replica which claimed the key crashed a while ago
+	claimedAt := time.Now().UTC().Add(-2 * idempotencyClaimStaleAfter)
+	if _, err := keys.ReclaimStaleIdempotencyKey(ctx, 1, "k", "/replenish", time.Now().UTC(), claimedAt, lost.Token); err != nil {
+		t.Fatal(err)
+	}
+
+	retry, stored, err := s.BeginIdempotentRequest(ctx, 1, "k", "/replenish", request)
+	if err != nil || retry == nil || stored != nil {
+		t.Fatalf("retry = %+v %+v, %v, want the key claimed again", retry, stored, err)
+	}
+	// The retry owns the claim now
+	if _, _, err := s.BeginIdempotentRequest(ctx, 1, "k", "/replenish", request); err != ErrIdempotencyKeyInProgress {
+		t.Errorf("err = %v, want %v", err, ErrIdempotencyKeyInProgress)
+	}
+
+	// The lost request neither releases nor completes the claim of the retry
+	if err := s.ReleaseIdempotentRequest(ctx, lost); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CompleteIdempotentRequest(ctx, lost, 200, []byte(`{"balance":100}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.BeginIdempotentRequest(ctx, 1, "k", "/replenish", request); err != ErrIdempotencyKeyInProgress {
+		t.Errorf("err = %v, want %v", err, ErrIdempotencyKeyInProgress)
+	}
+}
+
+func TestIdempotentRequestKeepsAppliedClaim(t *testing.T) {
+	request := []byte(`{"user_id":1,"amount":100}`)
+
+	tests := []struct {
+		name string
+		// reclaimed makes a retry take the claim over before the transaction of the request starts
+		reclaimed   bool
+		wantErr     error
+		wantBalance int64
+	}{
+		{name: "applied claim is neither reclaimed nor released", wantErr: ErrIdempotencyKeyResponseLost, wantBalance: 100},
+		{name: "claim taken over by a retry", reclaimed: true, wantErr: ErrIdempotencyKeyInProgress, wantBalance: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			keys := env.store.Repositories().IdempotencyKeys
+			s := NewIdempotencyService(keys)
+
+			claim, _, err := s.BeginIdempotentRequest(context.Background(), 1, "k", "/replenish", request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The request runs longer than the claim is considered alive
+			staleBefore := time.Now().UTC()
+			claimedAt := staleBefore.Add(-2 * idempotencyClaimStaleAfter)
+			if _, err := keys.ReclaimStaleIdempotencyKey(context.Background(), 1, "k", "/replenish", staleBefore, claimedAt, claim.Token); err != nil {
+				t.Fatal(err)
+			}
+			if tt.reclaimed {
+				if _, _, err := s.BeginIdempotentRequest(context.Background(), 1, "k", "/replenish", request); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err = env.transactions.StoreReplenishmentTransaction(WithIdempotencyClaim(context.Background(), claim), 1, 100, "")
+			if tt.reclaimed && err != ErrIdempotencyClaimLost {
+				t.Fatalf("err = %v, want %v", err, ErrIdempotencyClaimLost)
+			}
+			if !tt.reclaimed && err != nil {
+				t.Fatal(err)
+			}
+
+			// The response of the request is lost, like with a crash after the commit
+			if err := s.ReleaseIdempotentRequest(context.Background(), claim); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := s.BeginIdempotentRequest(context.Background(), 1, "k", "/replenish", request); err != tt.wantErr {
+				t.Errorf("retry err = %v, want %v", err, tt.wantErr)
+			}
+			balance, err := env.store.Repositories().Users.GetUserBalance(context.Background(), 1, "RUB")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := int64(0)
+			if balance != nil {
+				got = balance.Balance
+			}
+			if got != tt.wantBalance {
+				t.Errorf("balance = %d, want %d", got, tt.wantBalance)
+			}
+		})
+	}
+}
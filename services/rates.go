@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var ErrRateUnavailable = errors.New("exchange rate is not available")
+
+// RatesProvider returns how many units of the target currency one unit of the source currency is worth
+type RatesProvider interface {
+	GetRate(ctx context.Context, from string, to string) (float64, error)
+}
+
+// currencyExponents lists currencies whose minor unit is not a hundredth of the major one
+var currencyExponents = map[string]int{
+	"BHD": 3,
+	"CLP": 0,
+	"IQD": 3,
+	"ISK": 0,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"LYD": 3,
+	"OMR": 3,
+	"TND": 3,
+	"VND": 0,
+}
+
+func currencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[currency]; ok {
+		return exponent
+	}
+
+	return 2
+}
+
+// ConvertAmount converts an amount in minor units of one currency to minor units of another one
+func ConvertAmount(ctx context.Context, rates RatesProvider, amount int64, from string, to string) (int64, error) {
+	if from == to || amount == 0 {
+		return amount, nil
+	}
+
+	rate, err := rates.GetRate(ctx, from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	major := float64(amount) / math.Pow10(currencyExponent(from))
+	return int64(math.Round(major * rate * math.Pow10(currencyExponent(to)))), nil
+}
+
+// rateUnavailable wraps ErrRateUnavailable with the currency pair and the reason
+func rateUnavailable(from string, to string, reason error) error {
+	if reason == nil {
+		return fmt.Errorf("%w: %s/%s", ErrRateUnavailable, from, to)
+	}
+
+	return fmt.Errorf("%w: %s/%s: %v", ErrRateUnavailable, from, to, reason)
+}
+
+// ratesTable keeps rates by currency pair, the reverse rate is derived when only the direct one is known
+type ratesTable map[[2]string]float64
+
+func (t ratesTable) rate(from string, to string) (float64, bool) {
+	if rate, ok := t[[2]string{from, to}]; ok {
+		return rate, true
+	}
+	if rate, ok := t[[2]string{to, from}]; ok && rate != 0 {
+		return 1 / rate, true
+	}
+
+	return 0, false
+}
+
+// NoRatesProvider is used when no rates source is configured, every conversion fails
+type NoRatesProvider struct{}
+
+func (NoRatesProvider) GetRate(_ context.Context, from string, to string) (float64, error) {
+	return 0, rateUnavailable(from, to, errors.New("no rates source is configured"))
+}
+
+type cachedRate struct {
+	rate      float64
+	expiresAt time.Time
+}
+
+// CachedRatesProvider remembers rates returned by another provider for the given time
+type CachedRatesProvider struct {
+	provider RatesProvider
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	rates map[[2]string]cachedRate
+}
+
+func NewCachedRatesProvider(provider RatesProvider, ttl time.Duration) *CachedRatesProvider {
+	return &CachedRatesProvider{provider: provider, ttl: ttl, rates: map[[2]string]cachedRate{}}
+}
+
+func (p *CachedRatesProvider) GetRate(ctx context.Context, from string, to string) (float64, error) {
+	key := [2]string{from, to}
+
+	p.mu.Lock()
+	cached, ok := p.rates[key]
+	p.mu.Unlock()
+
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.rate, nil
+	}
+
+	rate, err := p.provider.GetRate(ctx, from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	p.mu.Lock()
+	p.rates[key] = cachedRate{rate: rate, expiresAt: time.Now().Add(p.ttl)}
+	p.mu.Unlock()
+
+	return rate, nil
+}
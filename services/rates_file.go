@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileRatesProvider reads rates from a local JSON or CSV file, the format is chosen by the file extension.
+//
+// JSON file is a list of objects like {"from": "USD", "to": "RUB", "rate": 61.5}, CSV file has the
+// from,to,rate header followed by rows in the same order.
+type FileRatesProvider struct {
+	path string
+
+	mu    sync.RWMutex
+	rates ratesTable
+}
+
+// NewFileRatesProvider loads the file right away so a broken file is reported on start
+func NewFileRatesProvider(path string) (*FileRatesProvider, error) {
+	p := &FileRatesProvider{path: path}
+	if err := p.Refresh(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *FileRatesProvider) GetRate(_ context.Context, from string, to string) (float64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	rate, ok := p.rates.rate(from, to)
+	if !ok {
+		return 0, rateUnavailable(from, to, nil)
+	}
+
+	return rate, nil
+}
+
+// Refresh rereads the file, previously loaded rates are kept if it fails
+func (p *FileRatesProvider) Refresh() error {
+	file, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var rates ratesTable
+	switch strings.ToLower(filepath.Ext(p.path)) {
+	case ".json":
+		rates, err = readJSONRates(file)
+	case ".csv":
+		rates, err = readCSVRates(file)
+	default:
+		err = fmt.Errorf("unsupported rates file format %q, json or csv is expected", filepath.Ext(p.path))
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read rates from %s: %w", p.path, err)
+	}
+
+	p.mu.Lock()
+	p.rates = rates
+	p.mu.Unlock()
+
+	return nil
+}
+
+// RefreshEvery rereads the file with the given interval until the context is done
+func (p *FileRatesProvider) RefreshEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.Refresh(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+type fileRate struct {
+	From string  `json:"from"`
+	To   string  `json:"to"`
+	Rate float64 `json:"rate"`
+}
+
+func readJSONRates(r io.Reader) (ratesTable, error) {
+	var items []fileRate
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return nil, err
+	}
+
+	rates := ratesTable{}
+	for _, item := range items {
+		if err := addFileRate(rates, item); err != nil {
+			return nil, err
+		}
+	}
+
+	return rates, nil
+}
+
+func readCSVRates(r io.Reader) (ratesTable, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 3
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	rates := ratesTable{}
+	for i, record := range records {
+		// The header is optional
+		if i == 0 && strings.EqualFold(record[0], "from") {
+			continue
+		}
+
+		rate, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		item := fileRate{From: strings.TrimSpace(record[0]), To: strings.TrimSpace(record[1]), Rate: rate}
+		if err := addFileRate(rates, item); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+
+	return rates, nil
+}
+
+func addFileRate(rates ratesTable, item fileRate) error {
+	if !IsCurrencyCode(item.From) || !IsCurrencyCode(item.To) {
+		return fmt.Errorf("invalid currency pair %s/%s", item.From, item.To)
+	}
+	if item.Rate <= 0 {
+		return fmt.Errorf("rate for %s/%s should be positive", item.From, item.To)
+	}
+
+	rates[[2]string{item.From, item.To}] = item.Rate
+	return nil
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTPRatesProvider asks an external service for every rate, it is meant to be wrapped into CachedRatesProvider.
+//
+// The service is called as GET <url>?from=USD&to=RUB and should respond with {"rate": 61.5}, 404 means the
+// rate is unknown.
+type HTTPRatesProvider struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPRatesProvider(endpoint string, timeout time.Duration) *HTTPRatesProvider {
+	return &HTTPRatesProvider{url: endpoint, client: &http.Client{Timeout: timeout}}
+}
+
+func (p *HTTPRatesProvider) GetRate(ctx context.Context, from string, to string) (float64, error) {
+	endpoint, err := url.Parse(p.url)
+	if err != nil {
+		return 0, err
+	}
+
+	query := endpoint.Query()
+	query.Set("from", from)
+	query.Set("to", to)
+	endpoint.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return 0, rateUnavailable(from, to, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return 0, rateUnavailable(from, to, nil)
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, rateUnavailable(from, to, fmt.Errorf("rates service responded with %s", res.Status))
+	}
+
+	var body struct {
+		Rate float64 `json:"rate"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return 0, rateUnavailable(from, to, err)
+	}
+	if body.Rate <= 0 {
+		return 0, rateUnavailable(from, to, errors.New("rates service returned a non positive rate"))
+	}
+
+	return body.Rate, nil
+}
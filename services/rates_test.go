@@ -0,0 +1,298 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPRatesProvider(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		timeout  time.Duration
+		wantRate float64
+		wantErr  error
+	}{
+		{
+			name: "rate",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("from") != "USD" || r.URL.Query().Get("to") != "RUB" || r.URL.Query().Get("token") != "secret" {
+					http.Error(w, "unexpected query "+r.URL.RawQuery, http.StatusBadRequest)
+					return
+				}
+				fmt.Fprint(w, `{"rate": 61.5}`)
+			},
+			wantRate: 61.5,
+		},
+		{
+			name:    "unknown rate",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) },
+			wantErr: ErrRateUnavailable,
+		},
+		{
+			name:    "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.Error(w, "down", http.StatusBadGateway) },
+			wantErr: ErrRateUnavailable,
+		},
+		{
+			name:    "zero rate",
+			handler: func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, `{"rate": 0}`) },
+			wantErr: ErrRateUnavailable,
+		},
+		{
+			name:    "negative rate",
+			handler: func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, `{"rate": -61.5}`) },
+			wantErr: ErrRateUnavailable,
+		},
+		{
+			name:    "malformed response",
+			handler: func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, `61.5`) },
+			wantErr: ErrRateUnavailable,
+		},
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+				fmt.Fprint(w, `{"rate": 61.5}`)
+			},
+			timeout: 50 * time.Millisecond,
+			wantErr: ErrRateUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			timeout := tt.timeout
+			if timeout == 0 {
+				timeout = time.Second
+			}
+			// Query parameters of the configured url are kept
+			provider := NewHTTPRatesProvider(server.URL+"/rates?token=secret", timeout)
+
+			started := time.Now()
+			rate, err := provider.GetRate(context.Background(), "USD", "RUB")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if rate != tt.wantRate {
+				t.Errorf("rate = %v, want %v", rate, tt.wantRate)
+			}
+			if tt.timeout > 0 && time.Since(started) > 10*tt.timeout {
+				t.Errorf("request took %v with the %v timeout", time.Since(started), tt.timeout)
+			}
+		})
+	}
+}
+
+func writeRatesFile(t *testing.T, path string, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileRatesProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr bool
+	}{
+		{name: "json", file: "rates.json", content: `[{"from": "USD", "to": "RUB", "rate": 61.5}, {"from": "EUR", "to": "RUB", "rate": 63.8}]`},
+		{name: "csv", file: "rates.csv", content: "from,to,rate\nUSD,RUB,61.5\nEUR, RUB ,63.8\n"},
+		{name: "csv without header", file: "rates.CSV", content: "USD,RUB,61.5\nEUR,RUB,63.8\n"},
+		{name: "unsupported format", file: "rates.txt", content: "USD RUB 61.5", wantErr: true},
+		{name: "malformed json", file: "rates.json", content: `{"USD": 61.5}`, wantErr: true},
+		{name: "malformed rate", file: "rates.csv", content: "USD,RUB,many\n", wantErr: true},
+		{name: "missing column", file: "rates.csv", content: "USD,RUB\n", wantErr: true},
+		{name: "invalid currency", file: "rates.csv", content: "usd,RUB,61.5\n", wantErr: true},
+		{name: "non positive rate", file: "rates.json", content: `[{"from": "USD", "to": "RUB", "rate": 0}]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			writeRatesFile(t, path, tt.content)
+
+			provider, err := NewFileRatesProvider(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			for _, pair := range []struct {
+				from, to string
+				want     float64
+			}{
+				{"USD", "RUB", 61.5},
+				{"EUR", "RUB", 63.8},
+				// Inverse rates are derived
+				{"RUB", "USD", 1 / 61.5},
+			} {
+				if rate, err := provider.GetRate(context.Background(), pair.from, pair.to); err != nil || rate != pair.want {
+					t.Errorf("%s/%s = %v, %v, want %v", pair.from, pair.to, rate, err, pair.want)
+				}
+			}
+			if _, err := provider.GetRate(context.Background(), "USD", "EUR"); !errors.Is(err, ErrRateUnavailable) {
+				t.Errorf("cross rate err = %v, want %v", err, ErrRateUnavailable)
+			}
+		})
+	}
+
+	if _, err := NewFileRatesProvider(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing file was accepted")
+	}
+}
+
+func TestFileRatesProviderRefresh(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "rates.csv")
+	writeRatesFile(t, path, "USD,RUB,61.5\n")
+
+	provider, err := NewFileRatesProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeRatesFile(t, path, "USD,RUB,62\n")
+	if err := provider.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if rate, _ := provider.GetRate(ctx, "USD", "RUB"); rate != 62 {
+		t.Errorf("rate = %v after the refresh, want 62", rate)
+	}
+
+	// Rates are kept when the file turns out broken
+	writeRatesFile(t, path, "USD,RUB,broken\n")
+	if err := provider.Refresh(); err == nil {
+		t.Fatal("broken file was accepted")
+	}
+	if rate, _ := provider.GetRate(ctx, "USD", "RUB"); rate != 62 {
+		t.Errorf("rate = %v after a failed refresh, want 62", rate)
+	}
+
+	refreshCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go provider.RefreshEvery(refreshCtx, 10*time.Millisecond)
+
+	writeRatesFile(t, path, "USD,RUB,63\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if rate, _ := provider.GetRate(ctx, "USD", "RUB"); rate == 63 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("file was not reread")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// countingRatesProvider counts the requests for rates, it fails while err is set
+type countingRatesProvider struct {
+	mu    sync.Mutex
+	calls int
+	err   error
+}
+
+func (p *countingRatesProvider) GetRate(_ context.Context, from string, to string) (float64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.calls++
+	if p.err != nil {
+		return 0, p.err
+	}
+
+	return float64(p.calls), nil
+}
+
+func TestCachedRatesProvider(t *testing.T) {
+	ctx := context.Background()
+	source := &countingRatesProvider{}
+	provider := NewCachedRatesProvider(source, 50*time.Millisecond)
+
+	if rate, err := provider.GetRate(ctx, "USD", "RUB"); err != nil || rate != 1 {
+		t.Fatalf("rate = %v, %v, want 1", rate, err)
+	}
+	if rate, _ := provider.GetRate(ctx, "USD", "RUB"); rate != 1 || source.calls != 1 {
+		t.Fatalf("rate = %v after %d calls, want the cached 1", rate, source.calls)
+	}
+
+	// Pairs are cached separately
+	if rate, _ := provider.GetRate(ctx, "RUB", "USD"); rate != 2 {
+		t.Fatalf("reverse rate = %v, want 2", rate)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if rate, _ := provider.GetRate(ctx, "USD", "RUB"); rate != 3 {
+		t.Fatalf("rate = %v after expiry, want 3", rate)
+	}
+
+	// Errors are not cached
+	source.err = rateUnavailable("EUR", "RUB", nil)
+	if _, err := provider.GetRate(ctx, "EUR", "RUB"); !errors.Is(err, ErrRateUnavailable) {
+		t.Fatalf("err = %v, want %v", err, ErrRateUnavailable)
+	}
+	source.err = nil
+	if rate, err := provider.GetRate(ctx, "EUR", "RUB"); err != nil || rate != 5 {
+		t.Errorf("rate = %v, %v after a failure, want 5", rate, err)
+	}
+}
+
+func TestConvertAmount(t *testing.T) {
+	rates := staticRatesProvider{{"USD", "RUB"}: 61.5, {"USD", "JPY"}: 150, {"KWD", "USD"}: 3.25}
+
+	tests := []struct {
+		name    string
+		rates   RatesProvider
+		amount  int64
+		from    string
+		to      string
+		want    int64
+		wantErr error
+	}{
+		{name: "same currency", amount: 1234, from: "RUB", to: "RUB", want: 1234},
+		{name: "cents to kopecks", amount: 100, from: "USD", to: "RUB", want: 6150},
+		{name: "inverse rate rounds", amount: 100, from: "RUB", to: "USD", want: 2},
+		{name: "currency without minor units", amount: 100, from: "USD", to: "JPY", want: 150},
+		{name: "currency with three digit minor units", amount: 1000, from: "KWD", to: "USD", want: 325},
+		{name: "zero amount needs no rate", amount: 0, from: "EUR", to: "RUB", want: 0},
+		{name: "unknown rate", amount: 100, from: "EUR", to: "RUB", wantErr: ErrRateUnavailable},
+		{name: "no rates source", rates: NoRatesProvider{}, amount: 100, from: "USD", to: "RUB", wantErr: ErrRateUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := tt.rates
+			if provider == nil {
+				provider = rates
+			}
+
+			got, err := ConvertAmount(context.Background(), provider, tt.amount, tt.from, tt.to)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("amount = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"balance-service/repositories"
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrReconciliationRunNotExists = errors.New("reconciliation run does not exists")
+
+// reconciliationBatchSize limits the number of accounts summed by a single query
+const reconciliationBatchSize = 500
+
+type ReconciliationService struct {
+	runner          repositories.TransactionRunner
+	ledger          repositories.LedgerRepository
+	reconciliations repositories.ReconciliationRepository
+}
+
+func NewReconciliationService(runner repositories.TransactionRunner, ledger repositories.LedgerRepository, reconciliations repositories.ReconciliationRepository) *ReconciliationService {
+	return &ReconciliationService{runner: runner, ledger: ledger, reconciliations: reconciliations}
+}
+
+// Reconcile compares materialized balances of all user accounts with the sums of their postings and records the run.
+//
+// With fix enabled every mismatch is closed by an adjustment entry, which brings the postings in line with the stored
+// balance, as it is the one users have seen in responses.
+func (s *ReconciliationService) Reconcile(ctx context.Context, fix bool) (*repositories.ReconciliationRun, []repositories.ReconciliationMismatch, error) {
+	run := &repositories.ReconciliationRun{
+		StartedAt: time.Now().UTC(),
+		Fix:       fix,
+		Status:    repositories.ReconciliationRunning,
+	}
+	if err := s.reconciliations.StoreReconciliationRun(ctx, run); err != nil {
+		return nil, nil, err
+	}
+
+	mismatches, err := s.scan(ctx, run)
+
+	run.FinishedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	run.Status = repositories.ReconciliationCompleted
+	if err != nil {
+		run.Status = repositories.ReconciliationFailed
+		run.Error = sql.NullString{String: err.Error(), Valid: true}
+	}
+
+	// The outcome is recorded even if the request was cancelled in the middle of the run
+	if updateErr := s.reconciliations.UpdateReconciliationRun(context.Background(), run); updateErr != nil && err == nil {
+		err = updateErr
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return run, mismatches, nil
+}
+
+func (s *ReconciliationService) scan(ctx context.Context, run *repositories.ReconciliationRun) ([]repositories.ReconciliationMismatch, error) {
+	var mismatches []repositories.ReconciliationMismatch
+
+	var lastAccountID int64
+	for {
+		checks, err := s.ledger.GetUserAccountChecks(ctx, lastAccountID, reconciliationBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(checks) == 0 {
+			return mismatches, nil
+		}
+
+		for _, check := range checks {
+			lastAccountID = check.ID
+			run.CheckedAccounts++
+
+			if check.Balance == check.ComputedBalance {
+				continue
+			}
+
+			mismatch := repositories.ReconciliationMismatch{
+				RunID:           run.ID,
+				AccountID:       check.ID,
+				AccountType:     check.Type,
+				UserID:          check.UserID.Int64,
+				Currency:        check.Currency,
+				StoredBalance:   check.Balance,
+				ComputedBalance: check.ComputedBalance,
+			}
+
+			if run.Fix {
+				if mismatch.Fixed, err = s.adjust(ctx, check.Account); err != nil {
+					return nil, err
+				}
+			}
+
+			if err := s.reconciliations.StoreReconciliationMismatch(ctx, &mismatch); err != nil {
+				return nil, err
+			}
+
+			run.Mismatches++
+			if mismatch.Fixed {
+				run.Fixed++
+			}
+			mismatches = append(mismatches, mismatch)
+		}
+	}
+}
+
+// adjust posts the difference between the stored and the computed balance, returns false if the account
+// turned out to be consistent once it was locked
+func (s *ReconciliationService) adjust(ctx context.Context, account repositories.Account) (bool, error) {
+	var adjusted bool
+	err := s.runner.RunInTransaction(ctx, func(repos repositories.Repositories) error {
+		if _, err := repos.Users.LockUser(ctx, account.UserID.Int64); err != nil {
+			return err
+		}
+
+		locked, err := repos.Ledger.GetAccount(ctx, repositories.AccountKey{Type: account.Type, UserID: account.UserID.Int64, Currency: account.Currency})
+		if err != nil {
+			return err
+		}
+
+		computed, err := repos.Ledger.GetAccountComputedBalance(ctx, account.ID)
+		if err != nil {
+			return err
+		}
+
+		difference := locked.Balance - computed
+		if difference == 0 {
+			return nil
+		}
+
+		adjustmentAccount, err := repos.Ledger.GetOrCreateAccount(ctx, repositories.AdjustmentAccount(account.Currency))
+		if err != nil {
+			return err
+		}
+
+		entry := newJournalEntry(repositories.EntryAdjustment,
+			posting(locked, difference),
+			posting(adjustmentAccount, -difference),
+		)
+		if err := repos.Ledger.StoreAdjustmentEntry(ctx, entry); err != nil {
+			return err
+		}
+
+		adjusted = true
+		return nil
+	})
+
+	return adjusted, err
+}
+
+func (s *ReconciliationService) GetReconciliationRuns(ctx context.Context, limit int) ([]repositories.ReconciliationRun, error) {
+	return s.reconciliations.GetReconciliationRuns(ctx, limit)
+}
+
+func (s *ReconciliationService) GetReconciliationRun(ctx context.Context, ID int64) (*repositories.ReconciliationRun, []repositories.ReconciliationMismatch, error) {
+	run, err := s.reconciliations.GetReconciliationRun(ctx, ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if run == nil {
+		return nil, nil, ErrReconciliationRunNotExists
+	}
+
+	mismatches, err := s.reconciliations.GetReconciliationMismatches(ctx, ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return run, mismatches, nil
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"balance-service/repositories"
+	"context"
+	"testing"
+)
+
+// corruptBalance posts to the account keeping its materialized balance, as if the balance update was lost
+func corruptBalance(t *testing.T, env *testEnv, key repositories.AccountKey, amount int64) {
+	t.Helper()
+	ctx := context.Background()
+
+	account, err := env.repos.Ledger.GetAccount(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cash, err := env.repos.Ledger.GetOrCreateAccount(ctx, repositories.ExternalCashAccount(key.Currency))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := newJournalEntry(repositories.EntryReplenishment, posting(account, amount), posting(cash, -amount))
+	if err := env.repos.Ledger.StoreAdjustmentEntry(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	env.replenish(t, 1, 100)
+	env.replenish(t, 2, 100)
+	env.reserve(t, 2, 30, 1, 1)
+	reconciliation := NewReconciliationService(env.store, env.repos.Ledger, env.repos.Reconciliations)
+
+	run, mismatches, err := reconciliation.Reconcile(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != repositories.ReconciliationCompleted || run.CheckedAccounts != 3 || run.Mismatches != 0 {
+		t.Fatalf("run = %+v, want 3 consistent accounts", run)
+	}
+
+	corruptBalance(t, env, repositories.UserMainAccount(1, "RUB"), 15)
+	corruptBalance(t, env, repositories.UserReserveAccount(2, "RUB"), -5)
+
+	run, mismatches, err = reconciliation.Reconcile(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Mismatches != 2 || run.Fixed != 0 || len(mismatches) != 2 {
+		t.Fatalf("run = %+v, want 2 mismatches left as they are", run)
+	}
+	if mismatch := mismatches[0]; mismatch.UserID != 1 || mismatch.StoredBalance != 100 || mismatch.ComputedBalance != 115 {
+		t.Errorf("mismatch = %+v, want user 1 stored 100 computed 115", mismatch)
+	}
+	if mismatch := mismatches[1]; mismatch.UserID != 2 || mismatch.StoredBalance != 30 || mismatch.ComputedBalance != 25 {
+		t.Errorf("mismatch = %+v, want user 2 stored 30 computed 25", mismatch)
+	}
+
+	stored, storedMismatches, err := reconciliation.GetReconciliationRun(ctx, run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Mismatches != 2 || len(storedMismatches) != 2 {
+		t.Errorf("stored run = %+v with %d mismatches, want 2", stored, len(storedMismatches))
+	}
+
+	run, _, err = reconciliation.Reconcile(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Mismatches != 2 || run.Fixed != 2 {
+		t.Fatalf("run = %+v, want 2 fixed mismatches", run)
+	}
+
+	// Stored balances are kept and the postings are brought in line with them
+	env.assertBalance(t, 1, 100, 0)
+	env.assertBalance(t, 2, 70, 30)
+	env.assertLedgerConsistent(t)
+
+	runs, err := reconciliation.GetReconciliationRuns(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The consistency check above is the last run
+	if len(runs) != 4 || runs[0].Mismatches != 0 || runs[1].Fixed != 2 {
+		t.Errorf("runs = %+v, want 4 runs, the latest first", runs)
+	}
+
+	if _, _, err := reconciliation.GetReconciliationRun(ctx, 100); err != ErrReconciliationRunNotExists {
+		t.Errorf("err = %v, want %v", err, ErrReconciliationRunNotExists)
+	}
+}
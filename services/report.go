@@ -2,72 +2,156 @@ package services
 
 import (
 	"balance-service/repositories"
+	"bytes"
+	"context"
 	"database/sql"
-	"encoding/csv"
+	"errors"
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
-	"os"
-	"strconv"
+	"io"
 	"time"
 )
 
-func StoreReport(month int, year int) (string, error) {
-	lastID, err := repositories.GetLastTransactionIDForReport(nil, month, year)
+var (
+	ErrReportNotExists     = errors.New("report does not exists")
+	ErrUnknownReportFormat = errors.New("unknown report format")
+	ErrInvalidReportPeriod = errors.New("report period should end after it begins in a known timezone")
+)
+
+type ReportService struct {
+	transactions repositories.TransactionRepository
+	reports      repositories.ReportRepository
+	storage      ReportStorage
+}
+
+func NewReportService(transactions repositories.TransactionRepository, reports repositories.ReportRepository, storage ReportStorage) *ReportService {
+	return &ReportService{transactions: transactions, reports: reports, storage: storage}
+}
+
+// FindReport returns the report of the period stored in the format unless new transactions were created in the period
+// since it was built, along with the id of the last transaction of the period the report should account for
+func (s *ReportService) FindReport(ctx context.Context, period repositories.ReportPeriod, groupBy string, format string) (*repositories.Report, sql.NullInt64, error) {
+	if err := validateReportPeriod(period); err != nil {
+		return nil, sql.NullInt64{}, err
+	}
+
+	lastID, err := s.transactions.GetLastTransactionIDForReport(ctx, period)
+	if err != nil {
+		return nil, sql.NullInt64{}, err
+	}
+
+	report, err := s.reports.FindReport(ctx, period, groupBy, format, lastID)
 	if err != nil {
-		return "", err
+		return nil, sql.NullInt64{}, err
 	}
 
-	filePath, err := repositories.FindReport(month, year, lastID)
+	return report, lastID, nil
+}
+
+// StoreReport builds the report of the period grouped by one of repositories.ReportGroupBy values
+// and written in one of ReportFormat values
+func (s *ReportService) StoreReport(ctx context.Context, period repositories.ReportPeriod, groupBy string, format string) (*repositories.Report, error) {
+	reportWriter, ok := reportWriters[format]
+	if !ok {
+		return nil, ErrUnknownReportFormat
+	}
 
-	if err == nil {
-		return filePath, nil
+	existingReport, _, err := s.FindReport(ctx, period, groupBy, format)
+	if err != nil {
+		return nil, err
 	}
 
-	if err != sql.ErrNoRows {
-		return "", err
+	if existingReport != nil {
+		return existingReport, nil
 	}
 
-	transactionReports, err := repositories.GetReport(nil, month, year)
+	transactionReports, err := s.transactions.GetReport(ctx, period, groupBy)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	fileName, err := uuid.NewUUID()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	filePath = "data/" + fileName.String() + ".csv"
-	csvRecords := getCsvRecords(transactionReports)
-	f, err := os.Create(filePath)
-	defer f.Close()
+	fileKey := fileName.String() + "." + reportWriter.Extension()
+
+	var content bytes.Buffer
+	err = reportWriter.WriteReport(&content, getReportTable(transactionReports, groupBy))
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	w := csv.NewWriter(f)
-	err = w.WriteAll(csvRecords)
-
+	err = s.storage.Save(ctx, fileKey, &content, int64(content.Len()), reportWriter.ContentType())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	maxID := getMaxIdFromTransactionReports(transactionReports)
 
 	report := repositories.Report{
-		Month:             month,
-		Year:              year,
+		ReportPeriod:      period,
+		GroupBy:           groupBy,
+		Format:            format,
 		CreatedAt:         time.Now().UTC(),
-		FilePath:          filePath,
+		FileKey:           fileKey,
 		LastTransactionID: maxID,
 	}
-	err = repositories.StoreReport(&report)
+	err = s.reports.StoreReport(ctx, &report)
+	if err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+func (s *ReportService) GetReport(ctx context.Context, ID int64) (*repositories.Report, error) {
+	report, err := s.reports.GetReport(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	if report == nil {
+		return nil, ErrReportNotExists
+	}
+
+	return report, nil
+}
+
+// GetReports returns the latest reports first along with the total number of reports
+func (s *ReportService) GetReports(ctx context.Context, limit int, offset int) ([]repositories.Report, int64, error) {
+	reports, err := s.reports.GetReports(ctx, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total, err := s.reports.CountReports(ctx)
 	if err != nil {
-		return "", err
+		return nil, 0, err
+	}
+
+	return reports, total, nil
+}
+
+// OpenReportFile opens the stored report file for reading
+func (s *ReportService) OpenReportFile(ctx context.Context, fileKey string) (io.ReadCloser, error) {
+	return s.storage.Open(ctx, fileKey)
+}
+
+// PresignReportURL returns a direct link to the report file, an empty one if the storage can't provide it
+func (s *ReportService) PresignReportURL(ctx context.Context, fileKey string, expires time.Duration) (string, error) {
+	return s.storage.PresignURL(ctx, fileKey, expires)
+}
+
+func validateReportPeriod(period repositories.ReportPeriod) error {
+	if period.To.Before(period.From) {
+		return ErrInvalidReportPeriod
+	}
+	if _, err := time.LoadLocation(period.Timezone); err != nil {
+		return ErrInvalidReportPeriod
 	}
 
-	return filePath, nil
+	return nil
 }
 
 func getMaxIdFromTransactionReports(transactionReports []repositories.TransactionReport) sql.NullInt64 {
@@ -86,14 +170,49 @@ func getMaxIdFromTransactionReports(transactionReports []repositories.Transactio
 	return sql.NullInt64{Int64: maxID, Valid: true}
 }
 
-func getCsvRecords(transactionReports []repositories.TransactionReport) [][]string {
-	var records [][]string
+func getReportTable(transactionReports []repositories.TransactionReport, groupBy string) ReportTable {
+	byService := groupBy == repositories.ReportGroupByService || groupBy == repositories.ReportGroupByServiceDay
+	byDay := groupBy == repositories.ReportGroupByDay || groupBy == repositories.ReportGroupByServiceDay
+
+	var table ReportTable
+	if byService {
+		table.Columns = append(table.Columns, ReportColumn{Name: "service_id", Kind: ReportColumnInt})
+	}
+	if byDay {
+		table.Columns = append(table.Columns, ReportColumn{Name: "day", Kind: ReportColumnDate})
+	}
+	table.Columns = append(table.Columns,
+		ReportColumn{Name: "currency", Kind: ReportColumnString},
+		ReportColumn{Name: "orders", Kind: ReportColumnInt},
+		ReportColumn{Name: "gross", Kind: ReportColumnInt},
+		ReportColumn{Name: "refunded", Kind: ReportColumnInt},
+		ReportColumn{Name: "net", Kind: ReportColumnInt},
+		ReportColumn{Name: "cancelled", Kind: ReportColumnInt},
+		ReportColumn{Name: "released", Kind: ReportColumnInt},
+		ReportColumn{Name: "expired", Kind: ReportColumnInt},
+		ReportColumn{Name: "average_order_value", Kind: ReportColumnInt},
+	)
 
 	for _, e := range transactionReports {
-		record := []string{strconv.FormatInt(e.ServiceID, 10), strconv.FormatInt(e.Total, 10)}
-		records = append(records, record)
+		var row []interface{}
+		if byService {
+			row = append(row, e.ServiceID.Int64)
+		}
+		if byDay {
+			row = append(row, e.Day.Time)
+		}
+		row = append(row, e.Currency, e.Orders, e.Gross, e.Refunded, e.Net(), e.Cancelled, e.Released, e.Expired, averageOrderValue(e))
+		table.Rows = append(table.Rows, row)
 	}
 
-	return records
+	return table
+}
+
+// averageOrderValue is rounded down to the minor unit, it is zero for rows with returned reservations only
+func averageOrderValue(e repositories.TransactionReport) int64 {
+	if e.Orders == 0 {
+		return 0
+	}
 
+	return e.Gross / e.Orders
 }
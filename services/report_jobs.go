@@ -0,0 +1,153 @@
+package services
+
+import (
+	"balance-service/repositories"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+var ErrReportJobNotExists = errors.New("report job does not exists")
+
+const (
+	// reportJobPollInterval is how often idle workers look for jobs queued by other replicas
+	reportJobPollInterval = 5 * time.Second
+	// reportJobStaleAfter is how long a job may stay running before it is considered abandoned by a stopped replica
+	reportJobStaleAfter = 30 * time.Minute
+)
+
+// ReportJobService queues reports to be built in background, jobs are kept in the database,
+// so a worker of any replica can pick them up
+type ReportJobService struct {
+	reports *ReportService
+	jobs    repositories.ReportJobRepository
+	workers int
+	wake    chan struct{}
+}
+
+func NewReportJobService(reports *ReportService, jobs repositories.ReportJobRepository, workers int) *ReportJobService {
+	return &ReportJobService{reports: reports, jobs: jobs, workers: workers, wake: make(chan struct{}, workers)}
+}
+
+// StoreReportJob queues the report of the period. A request for a report, which is being built as of the same last
+// transaction, gets the in-flight job, and a request for an already stored report gets a job which is done at once.
+func (s *ReportJobService) StoreReportJob(ctx context.Context, period repositories.ReportPeriod, groupBy string, format string) (*repositories.ReportJob, error) {
+	report, lastID, err := s.reports.FindReport(ctx, period, groupBy, format)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	job := &repositories.ReportJob{
+		ReportPeriod:      period,
+		GroupBy:           groupBy,
+		Format:            format,
+		LastTransactionID: lastID,
+		Status:            repositories.ReportJobPending,
+		CreatedAt:         now,
+	}
+	if report != nil {
+		job.Status = repositories.ReportJobDone
+		job.ReportID = sql.NullInt64{Int64: report.ID, Valid: true}
+		job.FinishedAt = sql.NullTime{Time: now, Valid: true}
+	}
+
+	for {
+		stored, err := s.jobs.StoreReportJobIfNotInFlight(ctx, job)
+		if err != nil {
+			return nil, err
+		}
+		if stored {
+			if job.IsInFlight() {
+				s.wakeWorker()
+			}
+
+			return job, nil
+		}
+
+		inFlight, err := s.jobs.GetInFlightReportJob(ctx, period, groupBy, format, lastID)
+		if err != nil {
+			return nil, err
+		}
+		if inFlight != nil {
+			return inFlight, nil
+		}
+		// The in-flight job has finished in between, so the new one is stored on the next attempt
+	}
+}
+
+func (s *ReportJobService) GetReportJob(ctx context.Context, ID int64) (*repositories.ReportJob, error) {
+	job, err := s.jobs.GetReportJob(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		return nil, ErrReportJobNotExists
+	}
+
+	return job, nil
+}
+
+// Start runs the workers until the context is done
+func (s *ReportJobService) Start(ctx context.Context) {
+	for i := 0; i < s.workers; i++ {
+		go s.work(ctx)
+	}
+}
+
+func (s *ReportJobService) wakeWorker() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *ReportJobService) work(ctx context.Context) {
+	ticker := time.NewTicker(reportJobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for s.processNextJob(ctx) {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// processNextJob builds the report of the oldest queued job, returns false if there was no job to process
+func (s *ReportJobService) processNextJob(ctx context.Context) bool {
+	now := time.Now().UTC()
+	job, err := s.jobs.ClaimReportJob(ctx, now, now.Add(-reportJobStaleAfter))
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if job == nil {
+		return false
+	}
+
+	report, err := s.reports.StoreReport(ctx, job.ReportPeriod, job.GroupBy, job.Format)
+
+	job.FinishedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	job.Status = repositories.ReportJobDone
+	if err != nil {
+		job.Status = repositories.ReportJobFailed
+		job.Error = sql.NullString{String: err.Error(), Valid: true}
+	} else {
+		job.ReportID = sql.NullInt64{Int64: report.ID, Valid: true}
+	}
+
+	// The outcome is recorded even if the workers are being stopped
+	if err := s.jobs.UpdateReportJob(context.Background(), job); err != nil {
+		log.Println(err)
+	}
+
+	return true
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// ReportLinkSigner signs links to download reports, so they can be handed out to clients which can't send
+// the API key, like browsers
+type ReportLinkSigner struct {
+	secret []byte
+}
+
+// NewReportLinkSigner signs links with the secret. Links signed with a random secret, when none is given,
+// are only valid for the replica which signed them and until it restarts.
+func NewReportLinkSigner(secret string) (*ReportLinkSigner, error) {
+	if secret != "" {
+		return &ReportLinkSigner{secret: []byte(secret)}, nil
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+
+	return &ReportLinkSigner{secret: random}, nil
+}
+
+// Sign returns the signature of the link to the report valid until expires
+func (s *ReportLinkSigner) Sign(reportID int64, expires time.Time) string {
+	return hex.EncodeToString(s.mac(reportID, expires.Unix()))
+}
+
+// Verify reports whether the signature is valid for the report and hasn't expired by now
+func (s *ReportLinkSigner) Verify(reportID int64, expires int64, signature string, now time.Time) bool {
+	if now.Unix() >= expires {
+		return false
+	}
+
+	decoded, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(decoded, s.mac(reportID, expires))
+}
+
+func (s *ReportLinkSigner) mac(reportID int64, expires int64) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(strconv.FormatInt(reportID, 10) + ":" + strconv.FormatInt(expires, 10)))
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReportLinkSigner(t *testing.T) {
+	signer, err := NewReportLinkSigner("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewReportLinkSigner("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	expires := now.Add(time.Hour)
+	signature := signer.Sign(1, expires)
+
+	tests := []struct {
+		name      string
+		signer    *ReportLinkSigner
+		reportID  int64
+		expires   int64
+		signature string
+		now       time.Time
+		want      bool
+	}{
+		{name: "valid", signer: signer, reportID: 1, expires: expires.Unix(), signature: signature, now: now, want: true},
+		{name: "expired", signer: signer, reportID: 1, expires: expires.Unix(), signature: signature, now: expires},
+		{name: "another report", signer: signer, reportID: 2, expires: expires.Unix(), signature: signature, now: now},
+		{name: "prolonged", signer: signer, reportID: 1, expires: expires.Add(time.Hour).Unix(), signature: signature, now: now},
+		{name: "malformed signature", signer: signer, reportID: 1, expires: expires.Unix(), signature: "zz", now: now},
+		{name: "another secret", signer: other, reportID: 1, expires: expires.Unix(), signature: signature, now: now},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.signer.Verify(tt.reportID, tt.expires, tt.signature, tt.now); got != tt.want {
+				t.Errorf("verify = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"balance-service/repositories"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/robfig/cron"
+	"log"
+	"time"
+)
+
+const DefaultReportSchedule = "0 0 1 * *"
+
+// reportSchedulerLockKey is the advisory lock which keeps the scheduled report to a single replica
+const reportSchedulerLockKey = 7_240_113_002
+
+// ReportJobStatus describes the scheduled report job and its latest runs
+type ReportJobStatus struct {
+	Schedule  string
+	NextRunAt time.Time
+	Runs      []repositories.ReportRun
+}
+
+// ReportScheduler generates the report of the previous month on schedule
+type ReportScheduler struct {
+	reports    *ReportService
+	runs       repositories.ReportRunRepository
+	locker     repositories.Locker
+	spec       string
+	schedule   cron.Schedule
+	retries    int
+	retryDelay time.Duration
+	cron       *cron.Cron
+}
+
+// NewReportScheduler parses a standard 5 field cron spec, the schedule is evaluated in UTC as reports are.
+// A failed run is retried up to retries times, the delay doubles after every attempt.
+func NewReportScheduler(reports *ReportService, runs repositories.ReportRunRepository, locker repositories.Locker, spec string, retries int, retryDelay time.Duration) (*ReportScheduler, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid report schedule %q: %w", spec, err)
+	}
+
+	return &ReportScheduler{
+		reports:    reports,
+		runs:       runs,
+		locker:     locker,
+		spec:       spec,
+		schedule:   schedule,
+		retries:    retries,
+		retryDelay: retryDelay,
+		cron:       cron.NewWithLocation(time.UTC),
+	}, nil
+}
+
+func (s *ReportScheduler) Start() {
+	s.cron.Schedule(s.schedule, cron.FuncJob(func() {
+		run, err := s.Run(context.Background(), time.Now().UTC())
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if run != nil {
+			log.Printf("scheduled report for %02d.%d %s after %d attempts", run.Month, run.Year, run.Status, run.Attempts)
+		}
+	}))
+	s.cron.Start()
+}
+
+func (s *ReportScheduler) Stop() {
+	s.cron.Stop()
+}
+
+// Run generates the report of the month preceding now. It returns nil without doing anything if another replica
+// holds the job, and the existing run if the month has already been reported.
+func (s *ReportScheduler) Run(ctx context.Context, now time.Time) (*repositories.ReportRun, error) {
+	release, acquired, err := s.locker.TryLock(ctx, reportSchedulerLockKey)
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		return nil, nil
+	}
+	defer release()
+
+	month, year := previousMonth(now)
+
+	run, err := s.runs.GetReportRun(ctx, month, year)
+	if err != nil {
+		return nil, err
+	}
+	if run != nil && run.Status == repositories.ReportRunCompleted {
+		return run, nil
+	}
+
+	run = &repositories.ReportRun{
+		Month:     month,
+		Year:      year,
+		Status:    repositories.ReportRunRunning,
+		StartedAt: time.Now().UTC(),
+	}
+	if err := s.runs.SaveReportRun(ctx, run); err != nil {
+		return nil, err
+	}
+
+	reportID, err := s.generate(ctx, run)
+
+	run.FinishedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	run.Status = repositories.ReportRunCompleted
+	if err != nil {
+		run.Status = repositories.ReportRunFailed
+		run.Error = sql.NullString{String: err.Error(), Valid: true}
+	} else {
+		run.ReportID = sql.NullInt64{Int64: reportID, Valid: true}
+	}
+
+	// The outcome is recorded even if the context was cancelled between the attempts
+	if err := s.runs.SaveReportRun(context.Background(), run); err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+func (s *ReportScheduler) generate(ctx context.Context, run *repositories.ReportRun) (int64, error) {
+	delay := s.retryDelay
+	for {
+		run.Attempts++
+		report, err := s.reports.StoreReport(ctx, repositories.MonthReportPeriod(run.Month, run.Year, "UTC"), repositories.ReportGroupByService, ReportFormatCSV)
+		if err == nil {
+			return report.ID, nil
+		}
+		if run.Attempts > s.retries {
+			return 0, err
+		}
+
+		log.Printf("scheduled report for %02d.%d failed on attempt %d: %v", run.Month, run.Year, run.Attempts, err)
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (s *ReportScheduler) GetStatus(ctx context.Context, limit int) (*ReportJobStatus, error) {
+	runs, err := s.runs.GetReportRuns(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReportJobStatus{
+		Schedule:  s.spec,
+		NextRunAt: s.schedule.Next(time.Now().UTC()),
+		Runs:      runs,
+	}, nil
+}
+
+func previousMonth(now time.Time) (int, int) {
+	lastMonthDay := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -1)
+
+	return int(lastMonthDay.Month()), lastMonthDay.Year()
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrReportFileNotExists = errors.New("report file does not exists")
+
+// ReportStorage keeps built report files under keys stored in the reports table
+type ReportStorage interface {
+	Save(ctx context.Context, key string, content io.Reader, size int64, contentType string) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// PresignURL returns a link to download the file directly from the storage, which expires after the given time.
+	// An empty link means the storage can't hand out links and the file should be proxied by the service.
+	PresignURL(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// LocalReportStorage keeps files in a local directory, it is suitable for a single replica only
+type LocalReportStorage struct {
+	dir string
+}
+
+func NewLocalReportStorage(dir string) *LocalReportStorage {
+	return &LocalReportStorage{dir: dir}
+}
+
+func (s *LocalReportStorage) Save(ctx context.Context, key string, content io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	// The file is written under a temporary name, so that a half written report is never served
+	f, err := os.CreateTemp(s.dir, "."+key+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, content); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func (s *LocalReportStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrReportFileNotExists
+	}
+
+	return f, err
+}
+
+func (s *LocalReportStorage) PresignURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	return "", nil
+}
+
+// path rejects keys pointing outside of the storage directory
+func (s *LocalReportStorage) path(key string) (string, error) {
+	if key == "" || key != filepath.Base(key) || key[0] == '.' {
+		return "", ErrReportFileNotExists
+	}
+
+	return filepath.Join(s.dir, key), nil
+}
+
+// S3ReportStorage keeps files in a bucket of an S3 compatible storage, like AWS S3 or MinIO
+type S3ReportStorage struct {
+	client *minio.Client
+	bucket string
+}
+
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	UseSSL    bool
+}
+
+func NewS3ReportStorage(options S3Options) (*S3ReportStorage, error) {
+	client, err := minio.New(options.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(options.AccessKey, options.SecretKey, ""),
+		Secure: options.UseSSL,
+		Region: options.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3ReportStorage{client: client, bucket: options.Bucket}, nil
+}
+
+func (s *S3ReportStorage) Save(ctx context.Context, key string, content io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, content, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *S3ReportStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// The object is requested lazily, so a missing key shows up on the first call to the server
+	if _, err := object.Stat(); err != nil {
+		_ = object.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrReportFileNotExists
+		}
+
+		return nil, err
+	}
+
+	return object, nil
+}
+
+func (s *S3ReportStorage) PresignURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	params := url.Values{}
+	params.Set("response-content-disposition", `attachment; filename="`+key+`"`)
+
+	link, err := s.client.PresignedGetObject(ctx, s.bucket, key, expires, params)
+	if err != nil {
+		return "", err
+	}
+
+	return link.String(), nil
+}
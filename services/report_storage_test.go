@@ -0,0 +1,324 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalReportStorageRejectsKeysOutsideOfDirectory(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	dir := filepath.Join(root, "reports")
+	storage := NewLocalReportStorage(dir)
+
+	if err := os.WriteFile(filepath.Join(root, "secret.csv"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{
+		"",
+		".",
+		"..",
+		"../secret.csv",
+		"../../etc/passwd",
+		"nested/report.csv",
+		"/etc/passwd",
+		".hidden.csv",
+		".report.csv.123",
+	} {
+		t.Run(key, func(t *testing.T) {
+			if err := storage.Save(ctx, key, strings.NewReader("x"), 1, "text/csv"); err != ErrReportFileNotExists {
+				t.Errorf("save err = %v, want %v", err, ErrReportFileNotExists)
+			}
+			if file, err := storage.Open(ctx, key); err != ErrReportFileNotExists {
+				if file != nil {
+					file.Close()
+				}
+				t.Errorf("open err = %v, want %v", err, ErrReportFileNotExists)
+			}
+		})
+	}
+
+	if content, err := os.ReadFile(filepath.Join(root, "secret.csv")); err != nil || string(content) != "secret" {
+		t.Errorf("file outside of the storage = %q, %v", content, err)
+	}
+}
+
+func TestLocalReportStorageSaveAndOpen(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalReportStorage(filepath.Join(t.TempDir(), "reports"))
+
+	if _, err := storage.Open(ctx, "report.csv"); err != ErrReportFileNotExists {
+		t.Fatalf("err = %v, want %v", err, ErrReportFileNotExists)
+	}
+
+	// The directory is created on the first save
+	if err := storage.Save(ctx, "report.csv", strings.NewReader("a,b\n"), 4, "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+	assertStoredReport(t, storage, "report.csv", "a,b\n")
+
+	if link, err := storage.PresignURL(ctx, "report.csv", time.Minute); err != nil || link != "" {
+		t.Errorf("link = %q, %v, want none", link, err)
+	}
+}
+
+func assertStoredReport(t *testing.T, storage ReportStorage, key string, want string) {
+	t.Helper()
+
+	file, err := storage.Open(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != want {
+		t.Errorf("content = %q, want %q", content, want)
+	}
+}
+
+// pausedReader returns the first part of the content, then waits for resume before the rest
+type pausedReader struct {
+	parts   []string
+	paused  chan struct{}
+	resume  chan struct{}
+	err     error
+	started sync.Once
+}
+
+func (r *pausedReader) Read(p []byte) (int, error) {
+	if len(r.parts) == 2 {
+		part := r.parts[0]
+		r.parts = r.parts[1:]
+		return copy(p, part), nil
+	}
+
+	r.started.Do(func() {
+		close(r.paused)
+		<-r.resume
+	})
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(r.parts) == 0 {
+		return 0, io.EOF
+	}
+
+	part := r.parts[0]
+	r.parts = nil
+	return copy(p, part), nil
+}
+
+func TestLocalReportStorageSaveIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage := NewLocalReportStorage(dir)
+
+	if err := storage.Save(ctx, "replaced.csv", strings.NewReader("old"), 3, "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		err  error
+		// wantBefore is the content served while the file is being written, empty if there should be no file
+		wantBefore string
+		wantAfter  string
+	}{
+		{name: "new file", key: "new.csv", wantAfter: "first,second"},
+		{name: "replaced file", key: "replaced.csv", wantBefore: "old", wantAfter: "first,second"},
+		{name: "failed write", key: "failed.csv", err: errors.New("connection reset")},
+		{name: "failed replacement", key: "replaced.csv", err: errors.New("connection reset"), wantBefore: "first,second", wantAfter: "first,second"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := &pausedReader{parts: []string{"first,", "second"}, paused: make(chan struct{}), resume: make(chan struct{}), err: tt.err}
+
+			saved := make(chan error)
+			go func() {
+				saved <- storage.Save(ctx, tt.key, content, 12, "text/csv")
+			}()
+
+			<-content.paused
+			if tt.wantBefore == "" {
+				if _, err := storage.Open(ctx, tt.key); err != ErrReportFileNotExists {
+					t.Errorf("half written file is served: %v", err)
+				}
+			} else {
+				assertStoredReport(t, storage, tt.key, tt.wantBefore)
+			}
+			close(content.resume)
+
+			if err := <-saved; !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.wantAfter == "" {
+				if _, err := storage.Open(ctx, tt.key); err != ErrReportFileNotExists {
+					t.Errorf("failed file is served: %v", err)
+				}
+			} else {
+				assertStoredReport(t, storage, tt.key, tt.wantAfter)
+			}
+
+			// Temporary files are removed either way
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Name(), ".") {
+					t.Errorf("temporary file %s is left", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+// s3Stub serves objects of the reports bucket the way S3 does
+type s3Stub struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/reports/")
+	if key == "forbidden.csv" {
+		s.error(w, r, http.StatusForbidden, "AccessDenied", "Access Denied.")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := readS3Payload(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = body
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodGet, http.MethodHead:
+		object, ok := s.objects[key]
+		if !ok {
+			s.error(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Length", fmt.Sprint(len(object)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(object)
+		}
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+// readS3Payload decodes the body of the upload, which the client signs chunk by chunk over plain HTTP
+func readS3Payload(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return io.ReadAll(r.Body)
+	}
+
+	var payload []byte
+	reader := bufio.NewReader(r.Body)
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		var size int
+		if _, err := fmt.Sscanf(header, "%x;", &size); err != nil {
+			return nil, err
+		}
+		// Every chunk is followed by CRLF
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return payload, nil
+		}
+		payload = append(payload, chunk[:size]...)
+	}
+}
+
+// error responds with an S3 error document, responses to HEAD requests have no body, so clients derive the code
+// from the status, like NoSuchKey from 404 when Open checks the object
+func (s *s3Stub) error(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message><Key>%s</Key><BucketName>reports</BucketName></Error>`,
+			code, message, strings.TrimPrefix(r.URL.Path, "/reports/"))
+	}
+}
+
+func newTestS3ReportStorage(t *testing.T) *S3ReportStorage {
+	t.Helper()
+
+	server := httptest.NewServer(&s3Stub{objects: map[string][]byte{}})
+	t.Cleanup(server.Close)
+
+	// The region is set, so the client doesn't ask the stub for the bucket location
+	storage, err := NewS3ReportStorage(S3Options{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Bucket:    "reports",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage
+}
+
+func TestS3ReportStorage(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestS3ReportStorage(t)
+
+	content := []byte("a,b\n")
+	if err := storage.Save(ctx, "report.csv", bytes.NewReader(content), int64(len(content)), "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+	assertStoredReport(t, storage, "report.csv", "a,b\n")
+
+	if _, err := storage.Open(ctx, "missing.csv"); err != ErrReportFileNotExists {
+		t.Errorf("err = %v, want %v", err, ErrReportFileNotExists)
+	}
+	if _, err := storage.Open(ctx, "forbidden.csv"); err == nil || err == ErrReportFileNotExists {
+		t.Errorf("err = %v, want the access error", err)
+	}
+
+	link, err := storage.PresignURL(ctx, "report.csv", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(link, "/reports/report.csv?") || !strings.Contains(link, "X-Amz-Expires=60") || !strings.Contains(link, "response-content-disposition=") {
+		t.Errorf("link = %s", link)
+	}
+}
@@ -0,0 +1,380 @@
+package services
+
+import (
+	"balance-service/repositories"
+	"balance-service/repositories/memory"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestReportService stores report files in a temporary directory
+func newTestReportService(t *testing.T, env *testEnv) *ReportService {
+	t.Helper()
+
+	return NewReportService(env.repos.Transactions, env.repos.Reports, NewLocalReportStorage(t.TempDir()))
+}
+
+// todayReportPeriod covers the day transactions of the test are created on
+func todayReportPeriod() repositories.ReportPeriod {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	return repositories.ReportPeriod{From: today, To: today, Timezone: "UTC"}
+}
+
+// storeReportScenario settles orders of two services in every possible way
+func storeReportScenario(t *testing.T, env *testEnv) {
+	t.Helper()
+	ctx := context.Background()
+
+	env.replenish(t, 1, 1000)
+
+	// Captured and partially refunded
+	env.reserve(t, 1, 40, 1, 1)
+	env.withdraw(t, 1, 40, 1, 1, false)
+	if _, _, err := env.transactions.StoreRefundTransaction(ctx, 1, 10, "RUB", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	// Partially captured, the rest is released
+	env.reserve(t, 1, 40, 2, 1)
+	env.withdraw(t, 1, 15, 2, 1, true)
+	// Cancelled
+	env.reserve(t, 1, 20, 3, 2)
+	if _, err := env.transactions.StoreCancellationTransaction(ctx, 1, 20, "RUB", 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	// Expired
+	if _, _, err := env.transactions.StoreReservationTransaction(ctx, 1, 30, "RUB", 4, 2, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.transactions.ExpireReservations(ctx, time.Now().Add(time.Hour), 10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readCSVReport(t *testing.T, reports *ReportService, report *repositories.Report) [][]string {
+	t.Helper()
+
+	file, err := reports.OpenReportFile(context.Background(), report.FileKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
+
+func TestStoreReport(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	reports := newTestReportService(t, env)
+	storeReportScenario(t, env)
+
+	report, err := reports.StoreReport(ctx, todayReportPeriod(), repositories.ReportGroupByService, ReportFormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"service_id", "currency", "orders", "gross", "refunded", "net", "cancelled", "released", "expired", "average_order_value"},
+		{"1", "RUB", "2", "55", "10", "45", "0", "25", "0", "27"},
+		{"2", "RUB", "0", "0", "0", "0", "20", "0", "30", "0"},
+	}
+	if got := readCSVReport(t, reports, report); !reflect.DeepEqual(got, want) {
+		t.Errorf("report = %q, want %q", got, want)
+	}
+
+	// The report is reused until the period gets new transactions
+	again, err := reports.StoreReport(ctx, todayReportPeriod(), repositories.ReportGroupByService, ReportFormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != report.ID {
+		t.Errorf("report %d was built again as %d", report.ID, again.ID)
+	}
+
+	env.reserve(t, 1, 5, 5, 3)
+	env.withdraw(t, 1, 5, 5, 3, false)
+	rebuilt, err := reports.StoreReport(ctx, todayReportPeriod(), repositories.ReportGroupByService, ReportFormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.ID == report.ID {
+		t.Error("report was not rebuilt after a new transaction")
+	}
+	if got := readCSVReport(t, reports, rebuilt); len(got) != 4 {
+		t.Errorf("rebuilt report = %q, want 3 services", got)
+	}
+
+	stored, err := reports.GetReport(ctx, report.ID)
+	if err != nil || stored.FileKey != report.FileKey {
+		t.Errorf("stored report = %+v, %v, want %+v", stored, err, report)
+	}
+	list, total, err := reports.GetReports(ctx, 1, 0)
+	if err != nil || total != 2 || len(list) != 1 || list[0].ID != rebuilt.ID {
+		t.Errorf("reports = %+v, total %d, %v, want the latest of 2", list, total, err)
+	}
+}
+
+func TestStoreReportFormats(t *testing.T) {
+	env := newTestEnv(t)
+	reports := newTestReportService(t, env)
+	storeReportScenario(t, env)
+
+	for _, format := range []string{ReportFormatCSV, ReportFormatJSON, ReportFormatXLSX, ReportFormatParquet} {
+		t.Run(format, func(t *testing.T) {
+			report, err := reports.StoreReport(context.Background(), todayReportPeriod(), repositories.ReportGroupByServiceDay, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ReportContentType(report.FileKey) != reportWriters[format].ContentType() {
+				t.Errorf("file %s is served as %s", report.FileKey, ReportContentType(report.FileKey))
+			}
+
+			file, err := reports.OpenReportFile(context.Background(), report.FileKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			content, err := io.ReadAll(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(content) == 0 {
+				t.Fatal("report file is empty")
+			}
+
+			if format == ReportFormatJSON {
+				var rows []map[string]interface{}
+				if err := json.Unmarshal(content, &rows); err != nil {
+					t.Fatalf("report is not valid JSON: %v", err)
+				}
+				if len(rows) != 2 || rows[0]["day"] == nil {
+					t.Errorf("rows = %v, want 2 rows with days", rows)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreReportErrors(t *testing.T) {
+	today := todayReportPeriod()
+
+	tests := []struct {
+		name    string
+		period  repositories.ReportPeriod
+		format  string
+		wantErr error
+	}{
+		{name: "unknown format", period: today, format: "pdf", wantErr: ErrUnknownReportFormat},
+		{name: "period ends before it begins", period: repositories.ReportPeriod{From: today.From, To: today.From.AddDate(0, 0, -1), Timezone: "UTC"}, format: ReportFormatCSV, wantErr: ErrInvalidReportPeriod},
+		{name: "unknown timezone", period: repositories.ReportPeriod{From: today.From, To: today.To, Timezone: "Mars/Olympus"}, format: ReportFormatCSV, wantErr: ErrInvalidReportPeriod},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reports := newTestReportService(t, newTestEnv(t))
+
+			if _, err := reports.StoreReport(context.Background(), tt.period, repositories.ReportGroupByService, tt.format); !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	reports := newTestReportService(t, newTestEnv(t))
+	if _, err := reports.GetReport(context.Background(), 1); err != ErrReportNotExists {
+		t.Errorf("err = %v, want %v", err, ErrReportNotExists)
+	}
+}
+
+func TestReportJobs(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	jobs := NewReportJobService(newTestReportService(t, env), env.repos.ReportJobs, 1)
+	storeReportScenario(t, env)
+
+	job, err := jobs.StoreReportJob(ctx, todayReportPeriod(), repositories.ReportGroupByService, ReportFormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != repositories.ReportJobPending {
+		t.Fatalf("job = %+v, want a pending one", job)
+	}
+
+	// A request for the same report gets the queued job
+	same, err := jobs.StoreReportJob(ctx, todayReportPeriod(), repositories.ReportGroupByService, ReportFormatCSV)
+	if err != nil || same.ID != job.ID {
+		t.Fatalf("job = %+v, %v, want job %d", same, err, job.ID)
+	}
+
+	if !jobs.processNextJob(ctx) {
+		t.Fatal("queued job was not processed")
+	}
+	if jobs.processNextJob(ctx) {
+		t.Fatal("a job was processed twice")
+	}
+
+	done, err := jobs.GetReportJob(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.Status != repositories.ReportJobDone || !done.ReportID.Valid || !done.FinishedAt.Valid {
+		t.Fatalf("job = %+v, want a done one with the report", done)
+	}
+
+	// The stored report is returned right away
+	cached, err := jobs.StoreReportJob(ctx, todayReportPeriod(), repositories.ReportGroupByService, ReportFormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.ID == job.ID || cached.Status != repositories.ReportJobDone || cached.ReportID != done.ReportID {
+		t.Errorf("job = %+v, want a new done job with report %d", cached, done.ReportID.Int64)
+	}
+
+	if _, err := jobs.GetReportJob(ctx, 100); err != ErrReportJobNotExists {
+		t.Errorf("err = %v, want %v", err, ErrReportJobNotExists)
+	}
+}
+
+func TestReportJobFailure(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	jobs := NewReportJobService(newTestReportService(t, env), env.repos.ReportJobs, 1)
+
+	job, err := jobs.StoreReportJob(ctx, todayReportPeriod(), "month", ReportFormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs.processNextJob(ctx)
+
+	failed, err := jobs.GetReportJob(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.Status != repositories.ReportJobFailed || !failed.Error.Valid || failed.ReportID.Valid {
+		t.Errorf("job = %+v, want a failed one with the error", failed)
+	}
+}
+
+// failingReportStorage fails to save the first failures files
+type failingReportStorage struct {
+	ReportStorage
+	failures int
+}
+
+func (s *failingReportStorage) Save(ctx context.Context, key string, content io.Reader, size int64, contentType string) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("storage is not available")
+	}
+
+	return s.ReportStorage.Save(ctx, key, content, size, contentType)
+}
+
+func TestReportSchedulerRun(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		failures     int
+		retries      int
+		wantStatus   string
+		wantAttempts int
+	}{
+		{name: "first attempt", wantStatus: repositories.ReportRunCompleted, wantAttempts: 1},
+		{name: "retried", failures: 2, retries: 2, wantStatus: repositories.ReportRunCompleted, wantAttempts: 3},
+		{name: "out of retries", failures: 3, retries: 2, wantStatus: repositories.ReportRunFailed, wantAttempts: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			storage := &failingReportStorage{ReportStorage: NewLocalReportStorage(t.TempDir()), failures: tt.failures}
+			reports := NewReportService(env.repos.Transactions, env.repos.Reports, storage)
+			scheduler, err := NewReportScheduler(reports, env.repos.ReportRuns, memory.NewLocker(), DefaultReportSchedule, tt.retries, time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			run, err := scheduler.Run(ctx, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if run.Month != 2 || run.Year != 2024 || run.Status != tt.wantStatus || run.Attempts != tt.wantAttempts {
+				t.Fatalf("run = %+v, want 02.2024 %s after %d attempts", run, tt.wantStatus, tt.wantAttempts)
+			}
+			if run.ReportID.Valid != (tt.wantStatus == repositories.ReportRunCompleted) {
+				t.Errorf("run = %+v, only completed runs reference reports", run)
+			}
+			if run.ReportID.Valid {
+				report, err := reports.GetReport(ctx, run.ReportID.Int64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !report.From.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) || report.GroupBy != repositories.ReportGroupByService {
+					t.Errorf("report = %+v, want February by service", report)
+				}
+			}
+
+			// A failed month is run again, a completed one is not
+			again, err := scheduler.Run(ctx, now.Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.Status != repositories.ReportRunCompleted {
+				t.Errorf("run = %+v, want completed", again)
+			}
+			if tt.wantStatus == repositories.ReportRunCompleted && again.Attempts != run.Attempts {
+				t.Errorf("completed month was run again: %+v", again)
+			}
+
+			status, err := scheduler.GetStatus(ctx, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Schedule != DefaultReportSchedule || len(status.Runs) != 1 || !status.NextRunAt.After(time.Now()) {
+				t.Errorf("status = %+v", status)
+			}
+		})
+	}
+}
+
+func TestReportSchedulerSkipsLockedRun(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	locker := memory.NewLocker()
+	scheduler, err := NewReportScheduler(newTestReportService(t, env), env.repos.ReportRuns, locker, DefaultReportSchedule, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release, _, err := locker.TryLock(ctx, reportSchedulerLockKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	run, err := scheduler.Run(ctx, time.Now())
+	if err != nil || run != nil {
+		t.Errorf("run = %+v, %v, want nothing while another replica holds the job", run, err)
+	}
+}
+
+func TestNewReportSchedulerRejectsInvalidSpec(t *testing.T) {
+	env := newTestEnv(t)
+
+	if _, err := NewReportScheduler(newTestReportService(t, env), env.repos.ReportRuns, memory.NewLocker(), "every month", 0, 0); err == nil {
+		t.Error("invalid schedule was accepted")
+	}
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/xitongsys/parquet-go/writer"
+	"github.com/xuri/excelize/v2"
+	"io"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	ReportFormatCSV     = "csv"
+	ReportFormatJSON    = "json"
+	ReportFormatXLSX    = "xlsx"
+	ReportFormatParquet = "parquet"
+)
+
+const (
+	ReportColumnInt = iota
+	ReportColumnString
+	ReportColumnDate
+)
+
+// ReportColumn describes a column of the report, values of the column are int64, string or time.Time
+// for ReportColumnInt, ReportColumnString and ReportColumnDate kinds respectively
+type ReportColumn struct {
+	Name string
+	Kind int
+}
+
+// ReportTable is the report independent of the format it is exported in
+type ReportTable struct {
+	Columns []ReportColumn
+	Rows    [][]interface{}
+}
+
+// ReportWriter encodes the report in one of the export formats
+type ReportWriter interface {
+	ContentType() string
+	// Extension is appended to keys of the stored files, it is also used to serve them with the right content type
+	Extension() string
+	WriteReport(w io.Writer, table ReportTable) error
+}
+
+var reportWriters = map[string]ReportWriter{
+	ReportFormatCSV:     CSVReportWriter{},
+	ReportFormatJSON:    JSONReportWriter{},
+	ReportFormatXLSX:    XLSXReportWriter{},
+	ReportFormatParquet: ParquetReportWriter{},
+}
+
+// ReportContentType returns the content type of the stored report file by its extension
+func ReportContentType(fileKey string) string {
+	for _, w := range reportWriters {
+		if "."+w.Extension() == filepath.Ext(fileKey) {
+			return w.ContentType()
+		}
+	}
+
+	return "application/octet-stream"
+}
+
+type CSVReportWriter struct{}
+
+func (CSVReportWriter) ContentType() string {
+	return "text/csv"
+}
+
+func (CSVReportWriter) Extension() string {
+	return "csv"
+}
+
+func (CSVReportWriter) WriteReport(w io.Writer, table ReportTable) error {
+	records := make([][]string, 0, len(table.Rows)+1)
+
+	header := make([]string, 0, len(table.Columns))
+	for _, column := range table.Columns {
+		header = append(header, column.Name)
+	}
+	records = append(records, header)
+
+	for _, row := range table.Rows {
+		record := make([]string, 0, len(row))
+		for _, value := range row {
+			record = append(record, formatReportValue(value))
+		}
+		records = append(records, record)
+	}
+
+	return csv.NewWriter(w).WriteAll(records)
+}
+
+// JSONReportWriter writes an array of objects keyed by the column names
+type JSONReportWriter struct{}
+
+func (JSONReportWriter) ContentType() string {
+	return "application/json"
+}
+
+func (JSONReportWriter) Extension() string {
+	return "json"
+}
+
+func (JSONReportWriter) WriteReport(w io.Writer, table ReportTable) error {
+	objects := make([]map[string]interface{}, 0, len(table.Rows))
+	for _, row := range table.Rows {
+		object := make(map[string]interface{}, len(row))
+		for i, value := range row {
+			if table.Columns[i].Kind == ReportColumnDate {
+				value = formatReportValue(value)
+			}
+			object[table.Columns[i].Name] = value
+		}
+		objects = append(objects, object)
+	}
+
+	return json.NewEncoder(w).Encode(objects)
+}
+
+// XLSXReportWriter writes a workbook with a single sheet, days are written as text to keep the ISO format
+type XLSXReportWriter struct{}
+
+const xlsxReportSheet = "Report"
+
+func (XLSXReportWriter) ContentType() string {
+	return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+}
+
+func (XLSXReportWriter) Extension() string {
+	return "xlsx"
+}
+
+func (XLSXReportWriter) WriteReport(w io.Writer, table ReportTable) error {
+	f := excelize.NewFile()
+	defer f.Close()
+	f.SetSheetName(f.GetSheetName(0), xlsxReportSheet)
+
+	header := make([]interface{}, 0, len(table.Columns))
+	for _, column := range table.Columns {
+		header = append(header, column.Name)
+	}
+
+	rows := append([][]interface{}{header}, table.Rows...)
+	for i, row := range rows {
+		cells := make([]interface{}, 0, len(row))
+		for _, value := range row {
+			if _, ok := value.(time.Time); ok {
+				value = formatReportValue(value)
+			}
+			cells = append(cells, value)
+		}
+
+		axis, err := excelize.CoordinatesToCellName(1, i+1)
+		if err != nil {
+			return err
+		}
+		if err := f.SetSheetRow(xlsxReportSheet, axis, &cells); err != nil {
+			return err
+		}
+	}
+
+	return f.Write(w)
+}
+
+// ParquetReportWriter writes a single row group, days are stored with the DATE logical type
+type ParquetReportWriter struct{}
+
+func (ParquetReportWriter) ContentType() string {
+	return "application/vnd.apache.parquet"
+}
+
+func (ParquetReportWriter) Extension() string {
+	return "parquet"
+}
+
+func (ParquetReportWriter) WriteReport(w io.Writer, table ReportTable) error {
+	schema := make([]string, 0, len(table.Columns))
+	for _, column := range table.Columns {
+		switch column.Kind {
+		case ReportColumnInt:
+			schema = append(schema, "name="+column.Name+", type=INT64")
+		case ReportColumnString:
+			schema = append(schema, "name="+column.Name+", type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY")
+		case ReportColumnDate:
+			schema = append(schema, "name="+column.Name+", type=INT32, convertedtype=DATE")
+		}
+	}
+
+	pw, err := writer.NewCSVWriterFromWriter(schema, w, 1)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range table.Rows {
+		record := make([]interface{}, 0, len(row))
+		for _, value := range row {
+			if day, ok := value.(time.Time); ok {
+				// DATE is the number of days since the Unix epoch
+				value = int32(day.Unix() / (24 * 60 * 60))
+			}
+			record = append(record, value)
+		}
+
+		if err := pw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	return pw.WriteStop()
+}
+
+func formatReportValue(value interface{}) string {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case string:
+		return v
+	case time.Time:
+		return v.Format("2006-01-02")
+	default:
+		return fmt.Sprint(v)
+	}
+}
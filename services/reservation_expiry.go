@@ -0,0 +1,190 @@
+package services
+
+import (
+	"balance-service/repositories"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrReservationExpired = errors.New("reservation expired")
+var ErrReservationExpiryInPast = errors.New("reservation expiry should be in the future")
+
+// reservationExpiryLockKey is the advisory lock which keeps the expiry of reservations to a single replica
+const reservationExpiryLockKey = 7_240_113_003
+
+const reservationExpiryBatchSize = 100
+
+// ReservationTTL is the lifetime of reservations stored without an explicit expiry, zero means they never expire
+type ReservationTTL struct {
+	Default time.Duration
+	// Services overrides the default for reservations of the services
+	Services map[int64]time.Duration
+}
+
+func (t ReservationTTL) For(serviceID int64) time.Duration {
+	if ttl, ok := t.Services[serviceID]; ok {
+		return ttl
+	}
+
+	return t.Default
+}
+
+// ParseServiceTTLs parses a comma separated list of service id and lifetime pairs like "1=30m,2=72h"
+func ParseServiceTTLs(spec string) (map[int64]time.Duration, error) {
+	ttls := map[int64]time.Duration{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		serviceID, ttl, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid service lifetime %q, service_id=duration is expected", pair)
+		}
+
+		ID, err := strconv.ParseInt(strings.TrimSpace(serviceID), 10, 64)
+		if err != nil || ID <= 0 {
+			return nil, fmt.Errorf("invalid service id %q", serviceID)
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(ttl))
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid lifetime %q of service %d", ttl, ID)
+		}
+
+		ttls[ID] = duration
+	}
+
+	return ttls, nil
+}
+
+// ExpireReservations releases what is left of the reservations expired by now back to the main balance,
+// looking them up in batches of the limit. Reservations which fail to be released are logged and skipped,
+// so that they don't hold up the rest, they are tried again by the next call. Returns the number of expired reservations.
+func (s *TransactionService) ExpireReservations(ctx context.Context, now time.Time, limit int) (int, error) {
+	expired := 0
+	afterID := int64(0)
+	for {
+		var reservations []repositories.Transaction
+		err := s.runner.RunInTransaction(ctx, func(repos repositories.Repositories) error {
+			var err error
+			reservations, err = repos.Transactions.GetExpiredReservations(ctx, now, afterID, limit)
+
+			return err
+		})
+		if err != nil {
+			return expired, err
+		}
+
+		for _, reservation := range reservations {
+			afterID = reservation.ID
+
+			released, err := s.expireReservation(ctx, reservation)
+			if ctx.Err() != nil {
+				return expired, ctx.Err()
+			}
+			if err != nil {
+				log.Printf("failed to expire reservation %d: %v", reservation.ID, err)
+				continue
+			}
+			if released {
+				expired++
+			}
+		}
+
+		if len(reservations) < limit {
+			return expired, nil
+		}
+	}
+}
+
+// expireReservation releases the remainder of the reservation unless it was settled since it was found
+func (s *TransactionService) expireReservation(ctx context.Context, reservation repositories.Transaction) (bool, error) {
+	userID := reservation.UserID.Int64
+
+	released := false
+	err := s.runner.RunInTransaction(ctx, func(repos repositories.Repositories) error {
+		if _, err := repos.Users.LockUser(ctx, userID); err != nil {
+			return err
+		}
+
+		settlement, err := repos.Transactions.GetReservationSettlement(ctx, reservation.ID)
+		if err != nil {
+			return err
+		}
+
+		remaining := newReservationCapture(&reservation, settlement).Remaining()
+		if !settlement.IsCancelled && !settlement.IsExpired && remaining > 0 {
+			reason := "reservation expired at " + reservation.ExpiresAt.Time.Format(time.RFC3339)
+			if err := releaseReservation(ctx, repos, &reservation, remaining, repositories.EntryExpiration, reason); err != nil {
+				return err
+			}
+			released = true
+		}
+
+		return repos.Transactions.ClearReservationExpiry(ctx, reservation.ID)
+	})
+
+	if err != nil {
+		return false, err
+	}
+	if released {
+		invalidateBalances(s.cache, userID)
+	}
+
+	return released, nil
+}
+
+// ReservationExpirer periodically releases expired reservations
+type ReservationExpirer struct {
+	transactions *TransactionService
+	locker       repositories.Locker
+	interval     time.Duration
+}
+
+func NewReservationExpirer(transactions *TransactionService, locker repositories.Locker, interval time.Duration) *ReservationExpirer {
+	return &ReservationExpirer{transactions: transactions, locker: locker, interval: interval}
+}
+
+// Start checks for expired reservations every interval until the context is done
+func (e *ReservationExpirer) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+
+		for {
+			expired, err := e.Run(ctx, time.Now().UTC())
+			if err != nil {
+				log.Println(err)
+			}
+			if expired > 0 {
+				log.Printf("released %d expired reservations", expired)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Run releases all the reservations expired by now. It does nothing if another replica is already releasing them.
+func (e *ReservationExpirer) Run(ctx context.Context, now time.Time) (int, error) {
+	release, acquired, err := e.locker.TryLock(ctx, reservationExpiryLockKey)
+	if err != nil {
+		return 0, err
+	}
+	if !acquired {
+		return 0, nil
+	}
+	defer release()
+
+	return e.transactions.ExpireReservations(ctx, now, reservationExpiryBatchSize)
+}
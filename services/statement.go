@@ -0,0 +1,219 @@
+package services
+
+import (
+	"balance-service/repositories"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+var ErrUnsupportedStatementFormat = errors.New("unsupported statement format")
+var ErrInvalidStatementPeriod = errors.New("statement period should end after it starts")
+
+type Statement struct {
+	UserID         int64
+	Currency       string
+	From           time.Time
+	To             time.Time
+	OpeningBalance int64
+}
+
+type StatementEntry struct {
+	Transaction repositories.TransactionHistoryItem
+	Description string
+	// Balance of the main account right after the transaction
+	Balance int64
+}
+
+// StatementWriter renders a statement, entries are written one by one as they are read from the storage
+type StatementWriter interface {
+	WriteOpening(statement Statement) error
+	WriteEntry(entry StatementEntry) error
+	WriteClosing(statement Statement, closingBalance int64) error
+}
+
+// StatementFormats maps supported formats to their content types
+var StatementFormats = map[string]string{
+	"csv":  "text/csv; charset=utf-8",
+	"json": "application/json; charset=utf-8",
+	"txt":  "text/plain; charset=utf-8",
+}
+
+func NewStatementWriter(format string, w io.Writer) (StatementWriter, error) {
+	switch format {
+	case "csv":
+		return &csvStatementWriter{w: csv.NewWriter(w)}, nil
+	case "json":
+		return &jsonStatementWriter{w: w}, nil
+	case "txt":
+		return &textStatementWriter{w: w}, nil
+	default:
+		return nil, ErrUnsupportedStatementFormat
+	}
+}
+
+// WriteStatement writes main account movements in the currency in [from, to) with the running balance
+func (s *UserService) WriteStatement(ctx context.Context, userID int64, currency string, from time.Time, to time.Time, w StatementWriter) error {
+	if currency == "" {
+		currency = s.baseCurrency
+	}
+	if !to.After(from) {
+		return ErrInvalidStatementPeriod
+	}
+
+	user, err := s.users.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrUserNotExists
+	}
+
+	openingBalance, err := s.transactions.GetUserBalanceAt(ctx, userID, currency, from)
+	if err != nil {
+		return err
+	}
+
+	statement := Statement{UserID: userID, Currency: currency, From: from, To: to, OpeningBalance: openingBalance}
+	if err := w.WriteOpening(statement); err != nil {
+		return err
+	}
+
+	balance := openingBalance
+	err = s.transactions.EachUserMainAccountTransaction(ctx, userID, currency, from, to, func(item repositories.TransactionHistoryItem) error {
+		balance += item.Amount
+
+		return w.WriteEntry(StatementEntry{
+			Transaction: item,
+			Description: DescribeTransaction(item),
+			Balance:     balance,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return w.WriteClosing(statement, balance)
+}
+
+type csvStatementWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvStatementWriter) WriteOpening(statement Statement) error {
+	if err := w.w.Write([]string{"date", "transaction_id", "description", "amount", "balance", "currency"}); err != nil {
+		return err
+	}
+
+	return w.w.Write([]string{statement.From.Format(time.RFC3339), "", "opening balance", "", strconv.FormatInt(statement.OpeningBalance, 10), statement.Currency})
+}
+
+func (w *csvStatementWriter) WriteEntry(entry StatementEntry) error {
+	return w.w.Write([]string{
+		entry.Transaction.CreatedAt.Format(time.RFC3339),
+		strconv.FormatInt(entry.Transaction.ID, 10),
+		entry.Description,
+		strconv.FormatInt(entry.Transaction.Amount, 10),
+		strconv.FormatInt(entry.Balance, 10),
+		entry.Transaction.Currency,
+	})
+}
+
+func (w *csvStatementWriter) WriteClosing(statement Statement, closingBalance int64) error {
+	if err := w.w.Write([]string{statement.To.Format(time.RFC3339), "", "closing balance", "", strconv.FormatInt(closingBalance, 10), statement.Currency}); err != nil {
+		return err
+	}
+
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// jsonStatementWriter writes the document piece by piece instead of marshalling the whole statement
+type jsonStatementWriter struct {
+	w       io.Writer
+	entries int
+}
+
+type jsonStatementEntry struct {
+	ID               int64     `json:"id"`
+	CreatedAt        time.Time `json:"created_at"`
+	Description      string    `json:"description"`
+	Amount           int64     `json:"amount"`
+	Balance          int64     `json:"balance"`
+	ServiceID        *int64    `json:"service_id"`
+	OrderID          *int64    `json:"order_id"`
+	IsReserveAccount bool      `json:"is_reserve_account"`
+}
+
+func (w *jsonStatementWriter) WriteOpening(statement Statement) error {
+	_, err := fmt.Fprintf(w.w, `{"user_id":%d,"currency":"%s","from":"%s","to":"%s","opening_balance":%d,"transactions":[`,
+		statement.UserID, statement.Currency, statement.From.Format(time.RFC3339), statement.To.Format(time.RFC3339), statement.OpeningBalance)
+
+	return err
+}
+
+func (w *jsonStatementWriter) WriteEntry(entry StatementEntry) error {
+	item := jsonStatementEntry{
+		ID:               entry.Transaction.ID,
+		CreatedAt:        entry.Transaction.CreatedAt,
+		Description:      entry.Description,
+		Amount:           entry.Transaction.Amount,
+		Balance:          entry.Balance,
+		IsReserveAccount: entry.Transaction.IsReserveAccount(),
+	}
+	if entry.Transaction.ServiceID.Valid {
+		item.ServiceID = &entry.Transaction.ServiceID.Int64
+	}
+	if entry.Transaction.OrderID.Valid {
+		item.OrderID = &entry.Transaction.OrderID.Int64
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	if w.entries > 0 {
+		if _, err := io.WriteString(w.w, ","); err != nil {
+			return err
+		}
+	}
+	w.entries++
+
+	_, err = w.w.Write(data)
+	return err
+}
+
+func (w *jsonStatementWriter) WriteClosing(statement Statement, closingBalance int64) error {
+	_, err := fmt.Fprintf(w.w, `],"closing_balance":%d}`, closingBalance)
+	return err
+}
+
+type textStatementWriter struct {
+	w io.Writer
+}
+
+func (w *textStatementWriter) WriteOpening(statement Statement) error {
+	_, err := fmt.Fprintf(w.w, "Statement for user %d in %s\nPeriod: %s - %s\nOpening balance: %d\n\n",
+		statement.UserID, statement.Currency, statement.From.Format(time.RFC3339), statement.To.Format(time.RFC3339), statement.OpeningBalance)
+
+	return err
+}
+
+func (w *textStatementWriter) WriteEntry(entry StatementEntry) error {
+	// Fixed width columns keep the text aligned without buffering the whole statement
+	_, err := fmt.Fprintf(w.w, "%s  #%-10d  %-50s  %+15d  %15d\n",
+		entry.Transaction.CreatedAt.Format("2006-01-02 15:04:05"), entry.Transaction.ID, entry.Description, entry.Transaction.Amount, entry.Balance)
+
+	return err
+}
+
+func (w *textStatementWriter) WriteClosing(statement Statement, closingBalance int64) error {
+	_, err := fmt.Fprintf(w.w, "\nClosing balance: %d\n", closingBalance)
+	return err
+}
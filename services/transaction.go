@@ -2,9 +2,10 @@ package services
 
 import (
 	"balance-service/repositories"
+	"context"
 	"database/sql"
 	"errors"
-	_ "github.com/lib/pq"
+	"sort"
 	"time"
 )
 
@@ -12,204 +13,716 @@ var ErrInsufficientBalance = errors.New("insufficient balance to provide a trans
 var ErrTransactionAlreadyProcessed = errors.New("transaction already processed")
 var ErrTransactionNotFound = errors.New("not found transaction to withdrawal")
 var ErrTransactionWrongAmount = errors.New("withdrawal transaction should has same amount, as initial one")
+var ErrReservationExceeded = errors.New("withdrawal amount exceeds the remaining reserved amount")
 var ErrTransactionAlreadyCancelled = errors.New("transaction already cancelled")
+var ErrTransactionAlreadyWithdrawn = errors.New("transaction already withdrawn")
+var ErrReservationNotFound = errors.New("not found reservation to cancel")
+var ErrAdjustedReservationNotFound = errors.New("not found reservation to adjust")
+var ErrReservationBelowCaptured = errors.New("reserved amount should not be less than the captured one")
+var ErrRefundedOrderNotFound = errors.New("not found recognized revenue to refund")
+var ErrRefundExceedsCaptured = errors.New("refund amount exceeds the recognized revenue which is not refunded yet")
+var ErrTransferToSelf = errors.New("sender and receiver should be different users")
+var ErrTransactionWrongCurrency = errors.New("transaction currency should be the same, as initial one")
+
+type TransactionService struct {
+	runner         repositories.TransactionRunner
+	cache          BalanceCache
+	baseCurrency   string
+	reservationTTL ReservationTTL
+}
+
+// NewTransactionService creates the service, baseCurrency is used for requests without an explicit currency
+// and reservationTTL for reservations without an explicit expiry.
+// Cached balances of the affected users are dropped after every committed change.
+func NewTransactionService(runner repositories.TransactionRunner, cache BalanceCache, baseCurrency string, reservationTTL ReservationTTL) *TransactionService {
+	return &TransactionService{runner: runner, cache: cache, baseCurrency: baseCurrency, reservationTTL: reservationTTL}
+}
+
+// runInTransaction runs fn in a transaction, which first marks the idempotency claim of the request as applied, if any
+func (s *TransactionService) runInTransaction(ctx context.Context, fn func(repos repositories.Repositories) error) error {
+	return s.runner.RunInTransaction(ctx, func(repos repositories.Repositories) error {
+		if err := applyIdempotencyClaim(ctx, repos); err != nil {
+			return err
+		}
+
+		return fn(repos)
+	})
+}
 
-func StoreReplenishmentTransaction(userID int64, amount int64) (*repositories.User, error) {
+func (s *TransactionService) currencyOrBase(currency string) string {
+	if currency == "" {
+		return s.baseCurrency
+	}
+
+	return currency
+}
+
+func (s *TransactionService) StoreReplenishmentTransaction(ctx context.Context, userID int64, amount int64, currency string) (*repositories.Balance, error) {
+	currency = s.currencyOrBase(currency)
 	if amount <= 0 {
 		return nil, errors.New("amount should be positive")
 	}
 
-	transaction := repositories.Transaction{
-		UserID:           userID,
-		Amount:           amount,
-		IsReserveAccount: false,
-		CreatedAt:        time.Now().UTC(),
-	}
+	var balance *repositories.Balance
+	err := s.runInTransaction(ctx, func(repos repositories.Repositories) error {
+		if err := repos.Users.StoreUserIfNotExists(ctx, userID); err != nil {
+			return err
+		}
+		if _, err := repos.Users.LockUser(ctx, userID); err != nil {
+			return err
+		}
 
-	tx := repositories.DB.MustBegin()
-	if err := repositories.StoreUserIfNotExists(tx, userID); err != nil {
-		return nil, err
-	}
-	if _, err := repositories.LockUser(tx, userID); err != nil {
-		_ = tx.Rollback()
-		return nil, err
-	}
+		accounts, err := getOrCreateAccounts(ctx, repos, repositories.UserMainAccount(userID, currency), repositories.ExternalCashAccount(currency))
+		if err != nil {
+			return err
+		}
+		mainAccount, cashAccount := accounts[0], accounts[1]
+
+		// Money comes from outside of the system, so the external cash account goes below zero
+		entry := newJournalEntry(repositories.EntryReplenishment,
+			posting(mainAccount, amount),
+			posting(cashAccount, -amount),
+		)
+		if err := repos.Ledger.StoreJournalEntry(ctx, entry); err != nil {
+			return err
+		}
 
-	if err := repositories.StoreTransaction(tx, &transaction); err != nil {
-		return nil, err
-	}
+		balance, err = repos.Users.GetUserBalance(ctx, userID, currency)
 
-	user, err := repositories.UpdateUserBalance(tx, userID, amount)
+		return err
+	})
 
 	if err != nil {
 		return nil, err
 	}
+	invalidateBalances(s.cache, userID)
 
-	if err := tx.Commit(); err != nil {
-		return nil, err
-	}
-
-	return user, nil
+	return balance, nil
 }
 
-func StoreReservationTransaction(userID int64, amount int64, orderID int64, serviceID int64) (*repositories.User, error) {
+// StoreReservationTransaction holds the amount for the order until expiresAt, a zero expiresAt means the lifetime
+// configured for the service. Returns the expiry of the reservation, which is null if it never expires.
+func (s *TransactionService) StoreReservationTransaction(ctx context.Context, userID int64, amount int64, currency string, orderID int64, serviceID int64, expiresAt time.Time) (*repositories.Balance, sql.NullTime, error) {
+	currency = s.currencyOrBase(currency)
 	if amount < 0 {
-		return nil, errors.New("amount should be either positive or zero")
+		return nil, sql.NullTime{}, errors.New("amount should be either positive or zero")
 	}
 
-	withdrawalTransaction := repositories.Transaction{
-		UserID:           userID,
-		ServiceID:        sql.NullInt64{Int64: serviceID, Valid: true},
-		OrderID:          sql.NullInt64{Int64: orderID, Valid: true},
-		Amount:           -amount,
-		IsReserveAccount: false,
-		CreatedAt:        time.Now().UTC(),
+	now := time.Now().UTC()
+	expiry := sql.NullTime{Time: expiresAt.UTC(), Valid: !expiresAt.IsZero()}
+	if expiry.Valid && !expiry.Time.After(now) {
+		return nil, sql.NullTime{}, ErrReservationExpiryInPast
 	}
-	reservationTransaction := repositories.Transaction{
-		UserID:           userID,
-		ServiceID:        sql.NullInt64{Int64: serviceID, Valid: true},
-		OrderID:          sql.NullInt64{Int64: orderID, Valid: true},
-		Amount:           amount,
-		IsReserveAccount: true,
-		CreatedAt:        time.Now().UTC(),
+	if ttl := s.reservationTTL.For(serviceID); !expiry.Valid && ttl > 0 {
+		expiry = sql.NullTime{Time: now.Add(ttl), Valid: true}
 	}
 
-	tx := repositories.DB.MustBegin()
+	var balance *repositories.Balance
+	err := s.runInTransaction(ctx, func(repos repositories.Repositories) error {
+		if user, err := repos.Users.GetUser(ctx, userID); err != nil || user == nil {
+			if err != nil {
+				return err
+			}
+
+			return ErrInsufficientBalance
+		}
+
+		if _, err := repos.Users.LockUser(ctx, userID); err != nil {
+			return err
+		}
 
-	if user, err := repositories.GetUser(tx, userID); err != nil || user == nil {
-		_ = tx.Rollback()
+		mainAccount, err := repos.Ledger.GetAccount(ctx, repositories.UserMainAccount(userID, currency))
+		if err != nil {
+			return err
+		}
+		if mainAccount == nil || mainAccount.Balance-amount < 0 {
+			return ErrInsufficientBalance
+		}
 
+		existingTransaction, err := repos.Transactions.GetServiceTransaction(ctx, userID, serviceID, orderID, repositories.AccountUserMain)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if existingTransaction != nil {
+			return ErrTransactionAlreadyProcessed
 		}
 
-		return nil, ErrInsufficientBalance
-	}
+		reserveAccount, err := repos.Ledger.GetOrCreateAccount(ctx, repositories.UserReserveAccount(userID, currency))
+		if err != nil {
+			return err
+		}
 
-	user, err := repositories.LockUser(tx, userID)
-	if err != nil {
-		_ = tx.Rollback()
-		return nil, err
-	}
+		reserveCredit := orderPosting(reserveAccount, amount, serviceID, orderID)
+		reserveCredit.ExpiresAt = expiry
 
-	if user.Balance+withdrawalTransaction.Amount < 0 {
-		_ = tx.Rollback()
-		return nil, ErrInsufficientBalance
-	}
+		entry := newJournalEntry(repositories.EntryReservation,
+			orderPosting(mainAccount, -amount, serviceID, orderID),
+			reserveCredit,
+		)
+		if err := repos.Ledger.StoreJournalEntry(ctx, entry); err != nil {
+			return err
+		}
+
+		balance, err = repos.Users.GetUserBalance(ctx, userID, currency)
+
+		return err
+	})
 
-	existingTransaction, err := repositories.GetServiceTransaction(tx, userID, serviceID, orderID, false)
 	if err != nil {
-		_ = tx.Rollback()
-		return nil, err
+		return nil, sql.NullTime{}, err
 	}
-	if existingTransaction != nil {
-		_ = tx.Rollback()
-		return nil, ErrTransactionAlreadyProcessed
+	invalidateBalances(s.cache, userID)
+
+	return balance, expiry, nil
+}
+
+// ReservationCapture describes how much of the reserved amount has been captured as revenue and how much
+// has been released back to the main balance
+type ReservationCapture struct {
+	Reserved int64
+	Captured int64
+	Released int64
+}
+
+// Remaining is the amount which is still held for the order
+func (c ReservationCapture) Remaining() int64 {
+	return c.Reserved - c.Captured - c.Released
+}
+
+func newReservationCapture(reservation *repositories.Transaction, settlement *repositories.ReservationSettlement) *ReservationCapture {
+	return &ReservationCapture{
+		Reserved: reservation.Amount + settlement.Adjusted,
+		Captured: settlement.Captured,
+		Released: settlement.Released,
 	}
+}
 
-	if err := repositories.StoreTransaction(tx, &withdrawalTransaction); err != nil {
-		_ = tx.Rollback()
-		return nil, err
+// StoreWithdrawalTransaction captures the amount out of the reservation of the order, the reservation may be
+// captured several times until it is exhausted. Once the order is final the remainder of the reservation
+// is released back to the main balance and no further captures are accepted.
+func (s *TransactionService) StoreWithdrawalTransaction(ctx context.Context, userID int64, amount int64, currency string, orderID int64, serviceID int64, final bool) (*repositories.Balance, *ReservationCapture, error) {
+	currency = s.currencyOrBase(currency)
+	if amount < 0 {
+		return nil, nil, errors.New("amount should be either positive or zero")
 	}
 
-	if err := repositories.StoreTransaction(tx, &reservationTransaction); err != nil {
-		_ = tx.Rollback()
-		return nil, err
+	var balance *repositories.Balance
+	var capture *ReservationCapture
+	err := s.runInTransaction(ctx, func(repos repositories.Repositories) error {
+		if user, err := repos.Users.GetUser(ctx, userID); err != nil || user == nil {
+			if err != nil {
+				return err
+			}
+
+			return ErrTransactionNotFound
+		}
+
+		if _, err := repos.Users.LockUser(ctx, userID); err != nil {
+			return err
+		}
+
+		reservation, err := repos.Transactions.GetServiceTransaction(ctx, userID, serviceID, orderID, repositories.AccountUserReserve)
+		if err != nil {
+			return err
+		}
+		if reservation == nil {
+			return ErrTransactionNotFound
+		}
+
+		if reservation.Currency != currency {
+			return ErrTransactionWrongCurrency
+		}
+
+		settlement, err := repos.Transactions.GetReservationSettlement(ctx, reservation.ID)
+		if err != nil {
+			return err
+		}
+		if settlement.IsCancelled {
+			return ErrTransactionAlreadyCancelled
+		}
+		// Reservation past its expiry is about to be released, so nothing can be captured anymore
+		if settlement.IsExpired || (reservation.ExpiresAt.Valid && !reservation.ExpiresAt.Time.After(time.Now().UTC())) {
+			return ErrReservationExpired
+		}
+
+		capture = newReservationCapture(reservation, settlement)
+		if settlement.Released > 0 || (settlement.Captures > 0 && capture.Remaining() == 0) {
+			return ErrTransactionAlreadyWithdrawn
+		}
+
+		if amount > capture.Remaining() {
+			return ErrReservationExceeded
+		}
+
+		accounts, err := getOrCreateAccounts(ctx, repos, repositories.UserReserveAccount(userID, currency), repositories.ServiceRevenueAccount(serviceID, currency))
+		if err != nil {
+			return err
+		}
+		reserveAccount, revenueAccount := accounts[0], accounts[1]
+
+		if reserveAccount.Balance-amount < 0 {
+			return errors.New("reserved balance cannot be less than 0")
+		}
+
+		// A final request without an amount only releases the remainder, nothing is captured
+		if amount > 0 || capture.Remaining() == 0 {
+			reserveDebit := orderPosting(reserveAccount, -amount, serviceID, orderID)
+			reserveDebit.CancelledTransactionId = sql.NullInt64{Int64: reservation.ID, Valid: true}
+
+			entry := newJournalEntry(repositories.EntryWithdrawal,
+				reserveDebit,
+				orderPosting(revenueAccount, amount, serviceID, orderID),
+			)
+			if err := repos.Ledger.StoreJournalEntry(ctx, entry); err != nil {
+				return err
+			}
+			capture.Captured += amount
+		}
+
+		if final && capture.Remaining() > 0 {
+			if err := releaseReservation(ctx, repos, reservation, capture.Remaining(), repositories.EntryRelease, ""); err != nil {
+				return err
+			}
+			capture.Released += capture.Remaining()
+		}
+		if capture.Remaining() == 0 {
+			if err := repos.Transactions.ClearReservationExpiry(ctx, reservation.ID); err != nil {
+				return err
+			}
+		}
+
+		balance, err = repos.Users.GetUserBalance(ctx, userID, currency)
+		if err == nil && balance == nil {
+			balance = &repositories.Balance{UserID: userID, Currency: currency}
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return nil, nil, err
 	}
+	invalidateBalances(s.cache, userID)
+
+	return balance, capture, nil
+}
 
-	user, err = repositories.UpdateUserBalance(tx, userID, -amount)
+// releaseReservation returns the amount held by the reservation back to the main balance with an entry of the type,
+// the reason is stored for entries the system makes on its own
+func releaseReservation(ctx context.Context, repos repositories.Repositories, reservation *repositories.Transaction, amount int64, entryType string, reason string) error {
+	userID, serviceID, orderID := reservation.UserID.Int64, reservation.ServiceID.Int64, reservation.OrderID.Int64
 
+	// Reservation moved money out of the main account, that debit is the one to be compensated
+	debitTransaction, err := repos.Transactions.GetServiceTransaction(ctx, userID, serviceID, orderID, repositories.AccountUserMain)
 	if err != nil {
-		_ = tx.Rollback()
-		return nil, err
+		return err
+	}
+	if debitTransaction == nil {
+		return ErrReservationNotFound
 	}
 
-	if err := tx.Commit(); err != nil {
-		_ = tx.Rollback()
-		return nil, err
+	accounts, err := getOrCreateAccounts(ctx, repos, repositories.UserReserveAccount(userID, reservation.Currency), repositories.UserMainAccount(userID, reservation.Currency))
+	if err != nil {
+		return err
 	}
+	reserveAccount, mainAccount := accounts[0], accounts[1]
 
-	return user, nil
+	reserveDebit := orderPosting(reserveAccount, -amount, serviceID, orderID)
+	reserveDebit.CancelledTransactionId = sql.NullInt64{Int64: reservation.ID, Valid: true}
+	refund := orderPosting(mainAccount, amount, serviceID, orderID)
+	refund.CancelledTransactionId = sql.NullInt64{Int64: debitTransaction.ID, Valid: true}
+
+	entry := newJournalEntry(entryType, reserveDebit, refund)
+	entry.Reason = sql.NullString{String: reason, Valid: reason != ""}
+
+	return repos.Ledger.StoreJournalEntry(ctx, entry)
 }
 
-func StoreWithdrawalTransaction(userID int64, amount int64, orderID int64, serviceID int64) (*repositories.User, error) {
+func (s *TransactionService) StoreCancellationTransaction(ctx context.Context, userID int64, amount int64, currency string, orderID int64, serviceID int64) (*repositories.Balance, error) {
+	currency = s.currencyOrBase(currency)
 	if amount < 0 {
 		return nil, errors.New("amount should be either positive or zero")
 	}
 
-	cancelReservationTransaction := repositories.Transaction{
-		UserID:           userID,
-		ServiceID:        sql.NullInt64{Int64: serviceID, Valid: true},
-		OrderID:          sql.NullInt64{Int64: orderID, Valid: true},
-		Amount:           -amount,
-		IsReserveAccount: true,
-		CreatedAt:        time.Now().UTC(),
-	}
+	var balance *repositories.Balance
+	err := s.runInTransaction(ctx, func(repos repositories.Repositories) error {
+		if user, err := repos.Users.GetUser(ctx, userID); err != nil || user == nil {
+			if err != nil {
+				return err
+			}
 
-	tx := repositories.DB.MustBegin()
+			return ErrReservationNotFound
+		}
 
-	if user, err := repositories.GetUser(tx, userID); err != nil || user == nil {
-		_ = tx.Rollback()
+		if _, err := repos.Users.LockUser(ctx, userID); err != nil {
+			return err
+		}
 
+		reservation, err := repos.Transactions.GetServiceTransaction(ctx, userID, serviceID, orderID, repositories.AccountUserReserve)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if reservation == nil {
+			return ErrReservationNotFound
 		}
 
-		return nil, ErrTransactionNotFound
-	}
+		if reservation.Currency != currency {
+			return ErrTransactionWrongCurrency
+		}
+
+		settlement, err := repos.Transactions.GetReservationSettlement(ctx, reservation.ID)
+		if err != nil {
+			return err
+		}
+		if settlement.IsCancelled {
+			return ErrTransactionAlreadyCancelled
+		}
+		if settlement.IsExpired {
+			return ErrReservationExpired
+		}
+		// Once anything is captured the order can only be completed by a final withdrawal
+		if settlement.Captures > 0 || settlement.Released > 0 {
+			return ErrTransactionAlreadyWithdrawn
+		}
+
+		if newReservationCapture(reservation, settlement).Reserved != amount {
+			return ErrTransactionWrongAmount
+		}
+
+		if err := releaseReservation(ctx, repos, reservation, amount, repositories.EntryCancellation, ""); err != nil {
+			return err
+		}
+		if err := repos.Transactions.ClearReservationExpiry(ctx, reservation.ID); err != nil {
+			return err
+		}
+
+		balance, err = repos.Users.GetUserBalance(ctx, userID, currency)
+
+		return err
+	})
 
-	user, err := repositories.LockUser(tx, userID)
 	if err != nil {
-		_ = tx.Rollback()
 		return nil, err
 	}
+	invalidateBalances(s.cache, userID)
 
-	transactionToCancel, err := repositories.GetServiceTransaction(tx, userID, serviceID, orderID, true)
-	if err != nil {
-		_ = tx.Rollback()
-		return nil, err
+	return balance, nil
+}
+
+// AdjustReservation changes the amount held by the active reservation of the order to amount. An increase is moved
+// from the main balance, which should be sufficient, and a decrease is returned to it. A reservation which held
+// nothing anymore has lost its expiry, so once it holds money again it gets the lifetime configured for the service.
+func (s *TransactionService) AdjustReservation(ctx context.Context, userID int64, amount int64, currency string, orderID int64, serviceID int64) (*repositories.Balance, *ReservationCapture, error) {
+	currency = s.currencyOrBase(currency)
+	if amount <= 0 {
+		return nil, nil, errors.New("amount should be positive")
 	}
-	if transactionToCancel == nil {
-		_ = tx.Rollback()
-		return nil, ErrTransactionNotFound
+
+	var balance *repositories.Balance
+	var capture *ReservationCapture
+	err := s.runInTransaction(ctx, func(repos repositories.Repositories) error {
+		if user, err := repos.Users.GetUser(ctx, userID); err != nil || user == nil {
+			if err != nil {
+				return err
+			}
+
+			return ErrAdjustedReservationNotFound
+		}
+
+		if _, err := repos.Users.LockUser(ctx, userID); err != nil {
+			return err
+		}
+
+		reservation, err := repos.Transactions.GetServiceTransaction(ctx, userID, serviceID, orderID, repositories.AccountUserReserve)
+		if err != nil {
+			return err
+		}
+		if reservation == nil {
+			return ErrAdjustedReservationNotFound
+		}
+
+		if reservation.Currency != currency {
+			return ErrTransactionWrongCurrency
+		}
+
+		// Reservation moved money out of the main account, a decrease compensates that debit
+		debitTransaction, err := repos.Transactions.GetServiceTransaction(ctx, userID, serviceID, orderID, repositories.AccountUserMain)
+		if err != nil {
+			return err
+		}
+		if debitTransaction == nil {
+			return ErrAdjustedReservationNotFound
+		}
+
+		settlement, err := repos.Transactions.GetReservationSettlement(ctx, reservation.ID)
+		if err != nil {
+			return err
+		}
+		if settlement.IsCancelled {
+			return ErrTransactionAlreadyCancelled
+		}
+		if settlement.IsExpired || (reservation.ExpiresAt.Valid && !reservation.ExpiresAt.Time.After(time.Now().UTC())) {
+			return ErrReservationExpired
+		}
+		if settlement.Released > 0 {
+			return ErrTransactionAlreadyWithdrawn
+		}
+
+		capture = newReservationCapture(reservation, settlement)
+		if amount < capture.Captured {
+			return ErrReservationBelowCaptured
+		}
+
+		accounts, err := getOrCreateAccounts(ctx, repos, repositories.UserReserveAccount(userID, currency), repositories.UserMainAccount(userID, currency))
+		if err != nil {
+			return err
+		}
+		reserveAccount, mainAccount := accounts[0], accounts[1]
+
+		difference := amount - capture.Reserved
+		if mainAccount.Balance-difference < 0 {
+			return ErrInsufficientBalance
+		}
+
+		if difference != 0 {
+			reserveChange := orderPosting(reserveAccount, difference, serviceID, orderID)
+			reserveChange.CancelledTransactionId = sql.NullInt64{Int64: reservation.ID, Valid: true}
+			mainChange := orderPosting(mainAccount, -difference, serviceID, orderID)
+			if difference < 0 {
+				mainChange.CancelledTransactionId = sql.NullInt64{Int64: debitTransaction.ID, Valid: true}
+			}
+
+			if err := repos.Ledger.StoreJournalEntry(ctx, newJournalEntry(repositories.EntryReservationAdjustment, mainChange, reserveChange)); err != nil {
+				return err
+			}
+
+			held := capture.Remaining() > 0
+			capture.Reserved = amount
+			if ttl := s.reservationTTL.For(serviceID); !held && !reservation.ExpiresAt.Valid && ttl > 0 {
+				if err := repos.Transactions.SetReservationExpiry(ctx, reservation.ID, time.Now().UTC().Add(ttl)); err != nil {
+					return err
+				}
+			}
+		}
+
+		balance, err = repos.Users.GetUserBalance(ctx, userID, currency)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, nil, err
 	}
+	invalidateBalances(s.cache, userID)
+
+	return balance, capture, nil
+}
+
+// OrderRefund describes how much of the revenue recognized for the order has been refunded
+type OrderRefund struct {
+	Captured int64
+	Refunded int64
+}
+
+// Refundable is the revenue of the order which can still be refunded
+func (r OrderRefund) Refundable() int64 {
+	return r.Captured - r.Refunded
+}
 
-	if transactionToCancel.Amount != amount {
-		_ = tx.Rollback()
-		return nil, ErrTransactionWrongAmount
+// StoreRefundTransaction gives the recognized revenue of the order back to the main balance of the user,
+// the revenue may be refunded in several parts
+func (s *TransactionService) StoreRefundTransaction(ctx context.Context, userID int64, amount int64, currency string, orderID int64, serviceID int64) (*repositories.Balance, *OrderRefund, error) {
+	currency = s.currencyOrBase(currency)
+	if amount <= 0 {
+		return nil, nil, errors.New("amount should be positive")
 	}
 
-	cancelReservationTransaction.CancelledTransactionId = sql.NullInt64{Int64: transactionToCancel.ID, Valid: true}
+	var balance *repositories.Balance
+	var refund *OrderRefund
+	err := s.runInTransaction(ctx, func(repos repositories.Repositories) error {
+		if user, err := repos.Users.GetUser(ctx, userID); err != nil || user == nil {
+			if err != nil {
+				return err
+			}
+
+			return ErrRefundedOrderNotFound
+		}
+
+		if _, err := repos.Users.LockUser(ctx, userID); err != nil {
+			return err
+		}
+
+		reservation, err := repos.Transactions.GetServiceTransaction(ctx, userID, serviceID, orderID, repositories.AccountUserReserve)
+		if err != nil {
+			return err
+		}
+		if reservation == nil {
+			return ErrRefundedOrderNotFound
+		}
+
+		if reservation.Currency != currency {
+			return ErrTransactionWrongCurrency
+		}
+
+		settlement, err := repos.Transactions.GetReservationSettlement(ctx, reservation.ID)
+		if err != nil {
+			return err
+		}
+		if settlement.Captured == 0 {
+			return ErrRefundedOrderNotFound
+		}
+
+		refunded, err := repos.Transactions.GetRefundedAmount(ctx, userID, serviceID, orderID)
+		if err != nil {
+			return err
+		}
+
+		refund = &OrderRefund{Captured: settlement.Captured, Refunded: refunded}
+		if amount > refund.Refundable() {
+			return ErrRefundExceedsCaptured
+		}
+
+		accounts, err := getOrCreateAccounts(ctx, repos, repositories.ServiceRevenueAccount(serviceID, currency), repositories.UserMainAccount(userID, currency))
+		if err != nil {
+			return err
+		}
+		revenueAccount, mainAccount := accounts[0], accounts[1]
+
+		entry := newJournalEntry(repositories.EntryRefund,
+			orderPosting(revenueAccount, -amount, serviceID, orderID),
+			orderPosting(mainAccount, amount, serviceID, orderID),
+		)
+		if err := repos.Ledger.StoreJournalEntry(ctx, entry); err != nil {
+			return err
+		}
+		refund.Refunded += amount
+
+		balance, err = repos.Users.GetUserBalance(ctx, userID, currency)
+
+		return err
+	})
 
-	reserved, err := repositories.GetUserReservedAmount(tx, userID)
 	if err != nil {
-		_ = tx.Rollback()
-		return nil, err
+		return nil, nil, err
+	}
+	invalidateBalances(s.cache, userID)
+
+	return balance, refund, nil
+}
+
+func (s *TransactionService) StoreTransferTransaction(ctx context.Context, fromUserID int64, toUserID int64, amount int64, currency string) (*repositories.Balance, *repositories.Balance, error) {
+	currency = s.currencyOrBase(currency)
+	if amount <= 0 {
+		return nil, nil, errors.New("amount should be positive")
 	}
-	if reserved-amount < 0 {
-		_ = tx.Rollback()
-		return nil, errors.New("reserved balance cannot be less than 0")
+	if fromUserID == toUserID {
+		return nil, nil, ErrTransferToSelf
 	}
 
-	cancellingTransaction, err := repositories.GetCancellingTransaction(tx, transactionToCancel.ID)
+	var fromBalance, toBalance *repositories.Balance
+	err := s.runInTransaction(ctx, func(repos repositories.Repositories) error {
+		if user, err := repos.Users.GetUser(ctx, fromUserID); err != nil || user == nil {
+			if err != nil {
+				return err
+			}
+
+			return ErrInsufficientBalance
+		}
+
+		if err := repos.Users.StoreUserIfNotExists(ctx, toUserID); err != nil {
+			return err
+		}
+
+		// Both rows are locked in ascending id order, so that opposite transfers can't deadlock each other
+		userIDs := []int64{fromUserID, toUserID}
+		sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+
+		for _, userID := range userIDs {
+			if _, err := repos.Users.LockUser(ctx, userID); err != nil {
+				return err
+			}
+		}
+
+		senderAccount, err := repos.Ledger.GetAccount(ctx, repositories.UserMainAccount(fromUserID, currency))
+		if err != nil {
+			return err
+		}
+		if senderAccount == nil || senderAccount.Balance-amount < 0 {
+			return ErrInsufficientBalance
+		}
+
+		receiverAccount, err := repos.Ledger.GetOrCreateAccount(ctx, repositories.UserMainAccount(toUserID, currency))
+		if err != nil {
+			return err
+		}
+
+		entry := newJournalEntry(repositories.EntryTransfer,
+			posting(senderAccount, -amount),
+			posting(receiverAccount, amount),
+		)
+		if err := repos.Ledger.StoreJournalEntry(ctx, entry); err != nil {
+			return err
+		}
+
+		debit, credit := entry.Postings[0], entry.Postings[1]
+		if err := repos.Transactions.LinkTransaction(ctx, debit.ID, credit.ID); err != nil {
+			return err
+		}
+		if err := repos.Transactions.LinkTransaction(ctx, credit.ID, debit.ID); err != nil {
+			return err
+		}
+
+		fromBalance, err = repos.Users.GetUserBalance(ctx, fromUserID, currency)
+		if err != nil {
+			return err
+		}
+
+		toBalance, err = repos.Users.GetUserBalance(ctx, toUserID, currency)
+
+		return err
+	})
+
 	if err != nil {
-		_ = tx.Rollback()
-		return nil, err
-	}
-	if cancellingTransaction != nil {
-		_ = tx.Rollback()
-		return nil, ErrTransactionAlreadyCancelled
+		return nil, nil, err
 	}
+	invalidateBalances(s.cache, fromUserID, toUserID)
 
-	if err := repositories.StoreTransaction(tx, &cancelReservationTransaction); err != nil {
-		_ = tx.Rollback()
-		return nil, err
+	return fromBalance, toBalance, nil
+}
+
+func newJournalEntry(entryType string, postings ...repositories.Transaction) *repositories.JournalEntry {
+	return &repositories.JournalEntry{Type: entryType, CreatedAt: time.Now().UTC(), Postings: postings}
+}
+
+// posting moves the amount to the account, negative amounts move it out
+func posting(account *repositories.Account, amount int64) repositories.Transaction {
+	return repositories.Transaction{
+		AccountID:   account.ID,
+		AccountType: account.Type,
+		UserID:      account.UserID,
+		Amount:      amount,
+		Currency:    account.Currency,
 	}
+}
 
-	if err := tx.Commit(); err != nil {
-		_ = tx.Rollback()
-		return nil, err
+func orderPosting(account *repositories.Account, amount int64, serviceID int64, orderID int64) repositories.Transaction {
+	transaction := posting(account, amount)
+	transaction.ServiceID = sql.NullInt64{Int64: serviceID, Valid: true}
+	transaction.OrderID = sql.NullInt64{Int64: orderID, Valid: true}
+
+	return transaction
+}
+
+func getOrCreateAccounts(ctx context.Context, repos repositories.Repositories, keys ...repositories.AccountKey) ([]*repositories.Account, error) {
+	accounts := make([]*repositories.Account, 0, len(keys))
+	for _, key := range keys {
+		account, err := repos.Ledger.GetOrCreateAccount(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		accounts = append(accounts, account)
 	}
 
-	return user, nil
+	return accounts, nil
 }
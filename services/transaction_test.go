@@ -0,0 +1,1113 @@
+package services
+
+import (
+	"balance-service/repositories"
+	"balance-service/repositories/memory"
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStoreReplenishmentTransaction(t *testing.T) {
+	tests := []struct {
+		name        string
+		amount      int64
+		currency    string
+		wantErr     bool
+		wantBalance int64
+	}{
+		{name: "base currency", amount: 100, wantBalance: 100},
+		{name: "explicit currency", amount: 100, currency: "USD", wantBalance: 100},
+		{name: "zero amount", amount: 0, wantErr: true},
+		{name: "negative amount", amount: -1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+
+			balance, err := env.transactions.StoreReplenishmentTransaction(context.Background(), 1, tt.amount, tt.currency)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			wantCurrency := tt.currency
+			if wantCurrency == "" {
+				wantCurrency = "RUB"
+			}
+			if balance.Balance != tt.wantBalance || balance.Currency != wantCurrency {
+				t.Errorf("balance = %d %s, want %d %s", balance.Balance, balance.Currency, tt.wantBalance, wantCurrency)
+			}
+			env.assertLedgerConsistent(t)
+		})
+	}
+}
+
+func TestStoreReservationTransaction(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        func(t *testing.T, env *testEnv)
+		amount       int64
+		currency     string
+		expiresAt    time.Time
+		wantErr      error
+		wantBalance  int64
+		wantReserved int64
+	}{
+		{
+			name:         "reserves from the main balance",
+			setup:        func(t *testing.T, env *testEnv) { env.replenish(t, 1, 100) },
+			amount:       40,
+			wantBalance:  60,
+			wantReserved: 40,
+		},
+		{
+			name:         "whole balance",
+			setup:        func(t *testing.T, env *testEnv) { env.replenish(t, 1, 100) },
+			amount:       100,
+			wantBalance:  0,
+			wantReserved: 100,
+		},
+		{
+			name:         "insufficient balance",
+			setup:        func(t *testing.T, env *testEnv) { env.replenish(t, 1, 100) },
+			amount:       101,
+			wantErr:      ErrInsufficientBalance,
+			wantBalance:  100,
+			wantReserved: 0,
+		},
+		{
+			name:    "unknown user",
+			amount:  1,
+			wantErr: ErrInsufficientBalance,
+		},
+		{
+			name:         "no balance in the currency",
+			setup:        func(t *testing.T, env *testEnv) { env.replenish(t, 1, 100) },
+			amount:       1,
+			currency:     "USD",
+			wantErr:      ErrInsufficientBalance,
+			wantBalance:  100,
+			wantReserved: 0,
+		},
+		{
+			name: "double reserve of the order",
+			setup: func(t *testing.T, env *testEnv) {
+				env.replenish(t, 1, 100)
+				env.reserve(t, 1, 10, 1, 1)
+			},
+			amount:       10,
+			wantErr:      ErrTransactionAlreadyProcessed,
+			wantBalance:  90,
+			wantReserved: 10,
+		},
+		{
+			name:         "expiry in the past",
+			setup:        func(t *testing.T, env *testEnv) { env.replenish(t, 1, 100) },
+			amount:       10,
+			expiresAt:    time.Now().Add(-time.Minute),
+			wantErr:      ErrReservationExpiryInPast,
+			wantBalance:  100,
+			wantReserved: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			if tt.setup != nil {
+				tt.setup(t, env)
+			}
+
+			_, _, err := env.transactions.StoreReservationTransaction(context.Background(), 1, tt.amount, tt.currency, 1, 1, tt.expiresAt)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.setup != nil {
+				env.assertBalance(t, 1, tt.wantBalance, tt.wantReserved)
+			}
+			env.assertLedgerConsistent(t)
+		})
+	}
+}
+
+func TestStoreReservationTransactionExpiry(t *testing.T) {
+	ttl := ReservationTTL{Default: time.Hour, Services: map[int64]time.Duration{2: 0, 3: time.Minute}}
+	explicit := time.Now().Add(2 * time.Hour).UTC()
+
+	tests := []struct {
+		name      string
+		serviceID int64
+		expiresAt time.Time
+		wantValid bool
+		wantTTL   time.Duration
+	}{
+		{name: "default lifetime", serviceID: 1, wantValid: true, wantTTL: time.Hour},
+		{name: "service never expires", serviceID: 2, wantValid: false},
+		{name: "service lifetime", serviceID: 3, wantValid: true, wantTTL: time.Minute},
+		{name: "explicit expiry wins", serviceID: 3, expiresAt: explicit, wantValid: true, wantTTL: time.Until(explicit)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.transactions = NewTransactionService(env.store, NoBalanceCache{}, "RUB", ttl)
+			env.replenish(t, 1, 100)
+
+			_, expiry, err := env.transactions.StoreReservationTransaction(context.Background(), 1, 10, "RUB", 1, tt.serviceID, tt.expiresAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expiry.Valid != tt.wantValid {
+				t.Fatalf("expiry = %v, want valid %v", expiry, tt.wantValid)
+			}
+			if got := time.Until(expiry.Time); tt.wantValid && (got > tt.wantTTL || got < tt.wantTTL-time.Minute) {
+				t.Errorf("expires in %v, want %v", got, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestStoreWithdrawalTransaction(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        func(t *testing.T, env *testEnv)
+		amount       int64
+		currency     string
+		final        bool
+		wantErr      error
+		wantCapture  ReservationCapture
+		wantBalance  int64
+		wantReserved int64
+	}{
+		{
+			name:         "captures the whole reservation",
+			setup:        func(t *testing.T, env *testEnv) { env.reserve(t, 1, 40, 1, 1) },
+			amount:       40,
+			wantCapture:  ReservationCapture{Reserved: 40, Captured: 40},
+			wantBalance:  60,
+			wantReserved: 0,
+		},
+		{
+			name:         "partial capture keeps the remainder reserved",
+			setup:        func(t *testing.T, env *testEnv) { env.reserve(t, 1, 40, 1, 1) },
+			amount:       15,
+			wantCapture:  ReservationCapture{Reserved: 40, Captured: 15},
+			wantBalance:  60,
+			wantReserved: 25,
+		},
+		{
+			name: "second partial capture",
+			setup: func(t *testing.T, env *testEnv) {
+				env.reserve(t, 1, 40, 1, 1)
+				env.withdraw(t, 1, 15, 1, 1, false)
+			},
+			amount:       20,
+			wantCapture:  ReservationCapture{Reserved: 40, Captured: 35},
+			wantBalance:  60,
+			wantReserved: 5,
+		},
+		{
+			name:         "final capture releases the remainder",
+			setup:        func(t *testing.T, env *testEnv) { env.reserve(t, 1, 40, 1, 1) },
+			amount:       15,
+			final:        true,
+			wantCapture:  ReservationCapture{Reserved: 40, Captured: 15, Released: 25},
+			wantBalance:  85,
+			wantReserved: 0,
+		},
+		{
+			name:         "final request without an amount releases everything",
+			setup:        func(t *testing.T, env *testEnv) { env.reserve(t, 1, 40, 1, 1) },
+			amount:       0,
+			final:        true,
+			wantCapture:  ReservationCapture{Reserved: 40, Released: 40},
+			wantBalance:  100,
+			wantReserved: 0,
+		},
+		{
+			name:         "capture over the hold",
+			setup:        func(t *testing.T, env *testEnv) { env.reserve(t, 1, 40, 1, 1) },
+			amount:       41,
+			wantErr:      ErrReservationExceeded,
+			wantBalance:  60,
+			wantReserved: 40,
+		},
+		{
+			name: "capture over the remainder",
+			setup: func(t *testing.T, env *testEnv) {
+				env.reserve(t, 1, 40, 1, 1)
+				env.withdraw(t, 1, 30, 1, 1, false)
+			},
+			amount:       11,
+			wantErr:      ErrReservationExceeded,
+			wantBalance:  60,
+			wantReserved: 10,
+		},
+		{
+			name: "already withdrawn",
+			setup: func(t *testing.T, env *testEnv) {
+				env.reserve(t, 1, 40, 1, 1)
+				env.withdraw(t, 1, 40, 1, 1, false)
+			},
+			amount:       40,
+			wantErr:      ErrTransactionAlreadyWithdrawn,
+			wantBalance:  60,
+			wantReserved: 0,
+		},
+		{
+			name: "capture after the final one",
+			setup: func(t *testing.T, env *testEnv) {
+				env.reserve(t, 1, 40, 1, 1)
+				env.withdraw(t, 1, 10, 1, 1, true)
+			},
+			amount:       10,
+			wantErr:      ErrTransactionAlreadyWithdrawn,
+			wantBalance:  90,
+			wantReserved: 0,
+		},
+		{
+			name: "already cancelled",
+			setup: func(t *testing.T, env *testEnv) {
+				env.reserve(t, 1, 40, 1, 1)
+				if _, err := env.transactions.StoreCancellationTransaction(context.Background(), 1, 40, "RUB", 1, 1); err != nil {
+					t.Fatal(err)
+				}
+			},
+			amount:       40,
+			wantErr:      ErrTransactionAlreadyCancelled,
+			wantBalance:  100,
+			wantReserved: 0,
+		},
+		{
+			name:         "no reservation",
+			amount:       40,
+			wantErr:      ErrTransactionNotFound,
+			wantBalance:  100,
+			wantReserved: 0,
+		},
+		{
+			name:         "wrong currency",
+			setup:        func(t *testing.T, env *testEnv) { env.reserve(t, 1, 40, 1, 1) },
+			amount:       40,
+			currency:     "USD",
+			wantErr:      ErrTransactionWrongCurrency,
+			wantBalance:  60,
+			wantReserved: 40,
+		},
+		{
+			name: "expired hold",
+			setup: func(t *testing.T, env *testEnv) {
+				if _, _, err := env.transactions.StoreReservationTransaction(context.Background(), 1, 40, "RUB", 1, 1, time.Now().Add(time.Minute)); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := env.transactions.ExpireReservations(context.Background(), time.Now().Add(time.Hour), 10); err != nil {
+					t.Fatal(err)
+				}
+			},
+			amount:       40,
+			wantErr:      ErrReservationExpired,
+			wantBalance:  100,
+			wantReserved: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.replenish(t, 1, 100)
+			if tt.setup != nil {
+				tt.setup(t, env)
+			}
+
+			_, capture, err := env.transactions.StoreWithdrawalTransaction(context.Background(), 1, tt.amount, tt.currency, 1, 1, tt.final)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && *capture != tt.wantCapture {
+				t.Errorf("capture = %+v, want %+v", *capture, tt.wantCapture)
+			}
+
+			env.assertBalance(t, 1, tt.wantBalance, tt.wantReserved)
+			env.assertLedgerConsistent(t)
+		})
+	}
+}
+
+func TestStoreWithdrawalTransactionOfHoldPastExpiry(t *testing.T) {
+	env := newTestEnv(t)
+	env.replenish(t, 1, 100)
+	if _, _, err := env.transactions.StoreReservationTransaction(context.Background(), 1, 40, "RUB", 1, 1, time.Now().Add(50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The expirer hasn't released the hold yet, but nothing can be captured anymore
+	_, _, err := env.transactions.StoreWithdrawalTransaction(context.Background(), 1, 40, "RUB", 1, 1, false)
+	if err != ErrReservationExpired {
+		t.Fatalf("err = %v, want %v", err, ErrReservationExpired)
+	}
+}
+
+func TestStoreCancellationTransaction(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        func(t *testing.T, env *testEnv)
+		amount       int64
+		currency     string
+		wantErr      error
+		wantBalance  int64
+		wantReserved int64
+	}{
+		{
+			name:        "returns the reservation",
+			setup:       func(t *testing.T, env *testEnv) { env.reserve(t, 1, 40, 1, 1) },
+			amount:      40,
+			wantBalance: 100,
+		},
+		{
+			name: "returns the adjusted reservation",
+			setup: func(t *testing.T, env *testEnv) {
+				env.reserve(t, 1, 40, 1, 1)
+				if _, _, err := env.transactions.AdjustReservation(context.Background(), 1, 60, "RUB", 1, 1); err != nil {
+					t.Fatal(err)
+				}
+			},
+			amount:      60,
+			wantBalance: 100,
+		},
+		{
+			name:         "wrong amount",
+			setup:        func(t *testing.T, env *testEnv) { env.reserve(t, 1, 40, 1, 1) },
+			amount:       30,
+			wantErr:      ErrTransactionWrongAmount,
+			wantBalance:  60,
+			wantReserved: 40,
+		},
+		{
+			name:         "wrong currency",
+			setup:        func(t *testing.T, env *testEnv) { env.reserve(t, 1, 40, 1, 1) },
+			amount:       40,
+			currency:     "USD",
+			wantErr:      ErrTransactionWrongCurrency,
+			wantBalance:  60,
+			wantReserved: 40,
+		},
+		{
+			name: "already cancelled",
+			setup: func(t *testing.T, env *testEnv) {
+				env.reserve(t, 1, 40, 1, 1)
+				if _, err := env.transactions.StoreCancellationTransaction(context.Background(), 1, 40, "RUB", 1, 1); err != nil {
+					t.Fatal(err)
+				}
+			},
+			amount:      40,
+			wantErr:     ErrTransactionAlreadyCancelled,
+			wantBalance: 100,
+		},
+		{
+			name: "already withdrawn",
+			setup: func(t *testing.T, env *testEnv) {
+				env.reserve(t, 1, 40, 1, 1)
+				env.withdraw(t, 1, 40, 1, 1, false)
+			},
+			amount:      40,
+			wantErr:     ErrTransactionAlreadyWithdrawn,
+			wantBalance: 60,
+		},
+		{
+			name: "partially captured",
+			setup: func(t *testing.T, env *testEnv) {
+				env.reserve(t, 1, 40, 1, 1)
+				env.withdraw(t, 1, 10, 1, 1, false)
+			},
+			amount:       40,
+			wantErr:      ErrTransactionAlreadyWithdrawn,
+			wantBalance:  60,
+			wantReserved: 30,
+		},
+		{
+			name: "expired hold",
+			setup: func(t *testing.T, env *testEnv) {
+				if _, _, err := env.transactions.StoreReservationTransaction(context.Background(), 1, 40, "RUB", 1, 1, time.Now().Add(time.Minute)); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := env.transactions.ExpireReservations(context.Background(), time.Now().Add(time.Hour), 10); err != nil {
+					t.Fatal(err)
+				}
+			},
+			amount:      40,
+			wantErr:     ErrReservationExpired,
+			wantBalance: 100,
+		},
+		{
+			name:        "no reservation",
+			amount:      40,
+			wantErr:     ErrReservationNotFound,
+			wantBalance: 100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.replenish(t, 1, 100)
+			if tt.setup != nil {
+				tt.setup(t, env)
+			}
+
+			_, err := env.transactions.StoreCancellationTransaction(context.Background(), 1, tt.amount, tt.currency, 1, 1)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			env.assertBalance(t, 1, tt.wantBalance, tt.wantReserved)
+			env.assertLedgerConsistent(t)
+		})
+	}
+}
+
+func TestAdjustReservation(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        func(t *testing.T, env *testEnv)
+		amount       int64
+		wantErr      error
+		wantReserved int64
+		wantBalance  int64
+	}{
+		{
+			name:         "increase",
+			setup:        func(t *testing.T, env *testEnv) { env.reserve(t, 1, 40, 1, 1) },
+			amount:       70,
+			wantBalance:  30,
+			wantReserved: 70,
+		},
+		{
+			name:         "decrease",
+			setup:        func(t *testing.T, env *testEnv) { env.reserve(t, 1, 40, 1, 1) },
+			amount:       10,
+			wantBalance:  90,
+			wantReserved: 10,
+		},
+		{
+			name:         "same amount",
+			setup:        func(t *testing.T, env *testEnv) { env.reserve(t, 1, 40, 1, 1) },
+			amount:       40,
+			wantBalance:  60,
+			wantReserved: 40,
+		},
+		{
+			name:         "insufficient balance for the increase",
+			setup:        func(t *testing.T, env *testEnv) { env.reserve(t, 1, 40, 1, 1) },
+			amount:       101,
+			wantErr:      ErrInsufficientBalance,
+			wantBalance:  60,
+			wantReserved: 40,
+		},
+		{
+			name: "below the captured amount",
+			setup: func(t *testing.T, env *testEnv) {
+				env.reserve(t, 1, 40, 1, 1)
+				env.withdraw(t, 1, 30, 1, 1, false)
+			},
+			amount:       20,
+			wantErr:      ErrReservationBelowCaptured,
+			wantBalance:  60,
+			wantReserved: 10,
+		},
+		{
+			name: "already completed",
+			setup: func(t *testing.T, env *testEnv) {
+				env.reserve(t, 1, 40, 1, 1)
+				env.withdraw(t, 1, 30, 1, 1, true)
+			},
+			amount:      50,
+			wantErr:     ErrTransactionAlreadyWithdrawn,
+			wantBalance: 70,
+		},
+		{
+			name: "already cancelled",
+			setup: func(t *testing.T, env *testEnv) {
+				env.reserve(t, 1, 40, 1, 1)
+				if _, err := env.transactions.StoreCancellationTransaction(context.Background(), 1, 40, "RUB", 1, 1); err != nil {
+					t.Fatal(err)
+				}
+			},
+			amount:      50,
+			wantErr:     ErrTransactionAlreadyCancelled,
+			wantBalance: 100,
+		},
+		{
+			name:        "no reservation",
+			amount:      50,
+			wantErr:     ErrAdjustedReservationNotFound,
+			wantBalance: 100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.replenish(t, 1, 100)
+			if tt.setup != nil {
+				tt.setup(t, env)
+			}
+
+			_, capture, err := env.transactions.AdjustReservation(context.Background(), 1, tt.amount, "RUB", 1, 1)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && capture.Reserved != tt.amount {
+				t.Errorf("reserved = %d, want %d", capture.Reserved, tt.amount)
+			}
+
+			env.assertBalance(t, 1, tt.wantBalance, tt.wantReserved)
+			env.assertLedgerConsistent(t)
+		})
+	}
+}
+
+func TestAdjustReservationExpiry(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	env.transactions = NewTransactionService(env.store, NoBalanceCache{}, "RUB", ReservationTTL{Default: time.Hour})
+	env.replenish(t, 1, 100)
+	env.reserve(t, 1, 40, 1, 1)
+
+	// The whole hold is captured, so it loses its expiry, and then it is increased again
+	env.withdraw(t, 1, 40, 1, 1, false)
+	if _, _, err := env.transactions.AdjustReservation(ctx, 1, 50, "RUB", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	reservation, err := env.store.Repositories().Transactions.GetServiceTransaction(ctx, 1, 1, 1, repositories.AccountUserReserve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Until(reservation.ExpiresAt.Time); !reservation.ExpiresAt.Valid || got > time.Hour || got < time.Hour-time.Minute {
+		t.Fatalf("expiry = %v, want in an hour", reservation.ExpiresAt)
+	}
+
+	expired, err := env.transactions.ExpireReservations(ctx, time.Now().Add(2*time.Hour), 10)
+	if err != nil || expired != 1 {
+		t.Fatalf("expire = %d, %v, want 1 expired", expired, err)
+	}
+	env.assertBalance(t, 1, 60, 0)
+	env.assertLedgerConsistent(t)
+}
+
+func TestStoreRefundTransaction(t *testing.T) {
+	tests := []struct {
+		name        string
+		setup       func(t *testing.T, env *testEnv)
+		amount      int64
+		currency    string
+		wantErr     error
+		wantRefund  OrderRefund
+		wantBalance int64
+	}{
+		{
+			name:        "partial refund",
+			amount:      15,
+			wantRefund:  OrderRefund{Captured: 40, Refunded: 15},
+			wantBalance: 75,
+		},
+		{
+			name: "refund of the rest",
+			setup: func(t *testing.T, env *testEnv) {
+				if _, _, err := env.transactions.StoreRefundTransaction(context.Background(), 1, 15, "RUB", 1, 1); err != nil {
+					t.Fatal(err)
+				}
+			},
+			amount:      25,
+			wantRefund:  OrderRefund{Captured: 40, Refunded: 40},
+			wantBalance: 100,
+		},
+		{
+			name:        "more than captured",
+			amount:      41,
+			wantErr:     ErrRefundExceedsCaptured,
+			wantBalance: 60,
+		},
+		{
+			name: "more than left to refund",
+			setup: func(t *testing.T, env *testEnv) {
+				if _, _, err := env.transactions.StoreRefundTransaction(context.Background(), 1, 30, "RUB", 1, 1); err != nil {
+					t.Fatal(err)
+				}
+			},
+			amount:      11,
+			wantErr:     ErrRefundExceedsCaptured,
+			wantBalance: 90,
+		},
+		{
+			name:        "wrong currency",
+			amount:      10,
+			currency:    "USD",
+			wantErr:     ErrTransactionWrongCurrency,
+			wantBalance: 60,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.replenish(t, 1, 100)
+			env.reserve(t, 1, 40, 1, 1)
+			env.withdraw(t, 1, 40, 1, 1, false)
+			if tt.setup != nil {
+				tt.setup(t, env)
+			}
+
+			_, refund, err := env.transactions.StoreRefundTransaction(context.Background(), 1, tt.amount, tt.currency, 1, 1)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && *refund != tt.wantRefund {
+				t.Errorf("refund = %+v, want %+v", *refund, tt.wantRefund)
+			}
+
+			env.assertBalance(t, 1, tt.wantBalance, 0)
+			env.assertLedgerConsistent(t)
+		})
+	}
+}
+
+func TestStoreRefundTransactionWithoutRevenue(t *testing.T) {
+	env := newTestEnv(t)
+	env.replenish(t, 1, 100)
+	env.reserve(t, 1, 40, 1, 1)
+
+	_, _, err := env.transactions.StoreRefundTransaction(context.Background(), 1, 10, "RUB", 1, 1)
+	if err != ErrRefundedOrderNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrRefundedOrderNotFound)
+	}
+	_, _, err = env.transactions.StoreRefundTransaction(context.Background(), 1, 10, "RUB", 2, 1)
+	if err != ErrRefundedOrderNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrRefundedOrderNotFound)
+	}
+}
+
+func TestStoreTransferTransaction(t *testing.T) {
+	tests := []struct {
+		name         string
+		fromUserID   int64
+		toUserID     int64
+		amount       int64
+		wantErr      error
+		wantSender   int64
+		wantReceiver int64
+	}{
+		{name: "to a new user", fromUserID: 1, toUserID: 3, amount: 30, wantSender: 70, wantReceiver: 30},
+		{name: "to an existing user", fromUserID: 1, toUserID: 2, amount: 30, wantSender: 70, wantReceiver: 80},
+		{name: "to a user with a lower id", fromUserID: 2, toUserID: 1, amount: 50, wantSender: 0, wantReceiver: 150},
+		{name: "whole balance", fromUserID: 1, toUserID: 2, amount: 100, wantSender: 0, wantReceiver: 150},
+		{name: "insufficient balance", fromUserID: 1, toUserID: 2, amount: 101, wantErr: ErrInsufficientBalance, wantSender: 100, wantReceiver: 50},
+		{name: "unknown sender", fromUserID: 4, toUserID: 1, amount: 1, wantErr: ErrInsufficientBalance, wantReceiver: 100},
+		{name: "to self", fromUserID: 1, toUserID: 1, amount: 10, wantErr: ErrTransferToSelf, wantSender: 100, wantReceiver: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.replenish(t, 1, 100)
+			env.replenish(t, 2, 50)
+
+			_, _, err := env.transactions.StoreTransferTransaction(context.Background(), tt.fromUserID, tt.toUserID, tt.amount, "RUB")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.fromUserID != 4 {
+				if sender, _ := env.balance(t, tt.fromUserID); sender != tt.wantSender {
+					t.Errorf("sender balance = %d, want %d", sender, tt.wantSender)
+				}
+			}
+			if receiver, _ := env.balance(t, tt.toUserID); receiver != tt.wantReceiver {
+				t.Errorf("receiver balance = %d, want %d", receiver, tt.wantReceiver)
+			}
+			env.assertLedgerConsistent(t)
+		})
+	}
+}
+
+func TestExpireReservations(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	env.replenish(t, 1, 100)
+
+	// Expired and partially captured, expired and untouched, not expired yet and never expiring
+	for orderID, expiresIn := range map[int64]time.Duration{1: time.Minute, 2: time.Minute, 3: 2 * time.Hour} {
+		if _, _, err := env.transactions.StoreReservationTransaction(ctx, 1, 20, "RUB", orderID, 1, time.Now().Add(expiresIn)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env.reserve(t, 1, 20, 4, 1)
+	env.withdraw(t, 1, 5, 1, 1, false)
+
+	// Batches of one reservation are looked up until there are no more
+	now := time.Now().Add(time.Hour)
+	expired, err := env.transactions.ExpireReservations(ctx, now, 1)
+	if err != nil || expired != 2 {
+		t.Fatalf("first call = %d, %v, want 2 expired", expired, err)
+	}
+	expired, err = env.transactions.ExpireReservations(ctx, now, 10)
+	if err != nil || expired != 0 {
+		t.Fatalf("second call = %d, %v, want nothing expired", expired, err)
+	}
+
+	// 5 was captured, the other 35 of the expired orders are back
+	env.assertBalance(t, 1, 55, 40)
+	env.assertLedgerConsistent(t)
+}
+
+// failingSettlementRunner fails transactions which look up the settlement of the reservation
+type failingSettlementRunner struct {
+	*memory.Store
+	reservationID int64
+}
+
+type failingSettlementRepository struct {
+	repositories.TransactionRepository
+	reservationID int64
+}
+
+func (r failingSettlementRunner) RunInTransaction(ctx context.Context, fn func(repos repositories.Repositories) error) error {
+	return r.Store.RunInTransaction(ctx, func(repos repositories.Repositories) error {
+		repos.Transactions = failingSettlementRepository{TransactionRepository: repos.Transactions, reservationID: r.reservationID}
+		return fn(repos)
+	})
+}
+
+func (r failingSettlementRepository) GetReservationSettlement(ctx context.Context, reservationID int64) (*repositories.ReservationSettlement, error) {
+	if reservationID == r.reservationID {
+		return nil, errors.New("settlement is not available")
+	}
+
+	return r.TransactionRepository.GetReservationSettlement(ctx, reservationID)
+}
+
+func TestExpireReservationsSkipsFailedOnes(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	env.replenish(t, 1, 100)
+	for orderID := int64(1); orderID <= 3; orderID++ {
+		if _, _, err := env.transactions.StoreReservationTransaction(ctx, 1, 20, "RUB", orderID, 1, time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The earliest reservation can't be released
+	first, err := env.store.Repositories().Transactions.GetServiceTransaction(ctx, 1, 1, 1, repositories.AccountUserReserve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := failingSettlementRunner{Store: env.store, reservationID: first.ID}
+	transactions := NewTransactionService(runner, NoBalanceCache{}, "RUB", ReservationTTL{})
+
+	expired, err := transactions.ExpireReservations(ctx, time.Now().Add(time.Hour), 1)
+	if err != nil || expired != 2 {
+		t.Fatalf("expire = %d, %v, want the other 2 expired", expired, err)
+	}
+	env.assertBalance(t, 1, 80, 20)
+
+	// It is tried again once the failure is gone
+	expired, err = env.transactions.ExpireReservations(ctx, time.Now().Add(time.Hour), 1)
+	if err != nil || expired != 1 {
+		t.Fatalf("retry = %d, %v, want 1 expired", expired, err)
+	}
+	env.assertBalance(t, 1, 100, 0)
+	env.assertLedgerConsistent(t)
+}
+
+func TestReservationExpirerRun(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	env.replenish(t, 1, 100)
+	if _, _, err := env.transactions.StoreReservationTransaction(ctx, 1, 20, "RUB", 1, 1, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	locker := memory.NewLocker()
+	expirer := NewReservationExpirer(env.transactions, locker, time.Minute)
+
+	// Another replica holds the lock
+	release, _, err := locker.TryLock(ctx, reservationExpiryLockKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired, err := expirer.Run(ctx, time.Now().Add(time.Hour)); err != nil || expired != 0 {
+		t.Fatalf("run while locked = %d, %v, want nothing expired", expired, err)
+	}
+	release()
+
+	if expired, err := expirer.Run(ctx, time.Now().Add(time.Hour)); err != nil || expired != 1 {
+		t.Fatalf("run = %d, %v, want 1 expired", expired, err)
+	}
+	env.assertBalance(t, 1, 100, 0)
+}
+
+func TestParseServiceTTLs(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    map[int64]time.Duration
+		wantErr bool
+	}{
+		{spec: "", want: map[int64]time.Duration{}},
+		{spec: "1=30m, 2=72h,", want: map[int64]time.Duration{1: 30 * time.Minute, 2: 72 * time.Hour}},
+		{spec: "3=0s", want: map[int64]time.Duration{3: 0}},
+		{spec: "1", wantErr: true},
+		{spec: "x=1m", wantErr: true},
+		{spec: "0=1m", wantErr: true},
+		{spec: "1=soon", wantErr: true},
+		{spec: "1=-1m", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseServiceTTLs(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ttls = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestConcurrentReserveAndReplenish fires reservations and replenishments of a single user in parallel and checks
+// that the user never goes below zero and no money appears or disappears
+func TestConcurrentReserveAndReplenish(t *testing.T) {
+	forEachStore(t, func(t *testing.T, env *testEnv) {
+		ctx := context.Background()
+		env.replenish(t, 1, 100)
+
+		const workers = 20
+		const ordersPerWorker = 25
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var reserved, replenished int64
+		for worker := 0; worker < workers; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+
+				for i := 0; i < ordersPerWorker; i++ {
+					orderID := int64(worker*ordersPerWorker + i + 1)
+					if i%5 == 0 {
+						if _, err := env.transactions.StoreReplenishmentTransaction(ctx, 1, 10, "RUB"); err != nil {
+							t.Error(err)
+							return
+						}
+						mu.Lock()
+						replenished += 10
+						mu.Unlock()
+					}
+
+					_, _, err := env.transactions.StoreReservationTransaction(ctx, 1, 7, "RUB", orderID, 1, time.Time{})
+					if err == ErrInsufficientBalance {
+						continue
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					reserved += 7
+					mu.Unlock()
+
+					balances, err := env.users.GetUserBalance(ctx, 1)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					for _, balance := range balances {
+						if balance.Balance < 0 || balance.Reserved < 0 {
+							t.Errorf("balance = %d, reserved = %d, should not be negative", balance.Balance, balance.Reserved)
+						}
+					}
+				}
+			}(worker)
+		}
+		wg.Wait()
+
+		env.assertBalance(t, 1, 100+replenished-reserved, reserved)
+		env.assertLedgerConsistent(t)
+	})
+}
+
+// TestConcurrentSettlementOfOneReservation races captures and cancellations of the same order along with
+// replenishments of the user. Either the cancellation wins and nothing is captured, or it is rejected and
+// the reservation is captured up to its amount.
+func TestConcurrentSettlementOfOneReservation(t *testing.T) {
+	forEachStore(t, func(t *testing.T, env *testEnv) {
+		ctx := context.Background()
+		env.replenish(t, 1, 100)
+		env.reserve(t, 1, 50, 1, 1)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var captures, cancellations, replenishments int64
+		for i := 0; i < 30; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				switch i % 3 {
+				case 0:
+					_, _, err := env.transactions.StoreWithdrawalTransaction(ctx, 1, 10, "RUB", 1, 1, false)
+					if err == ErrTransactionAlreadyCancelled || err == ErrTransactionAlreadyWithdrawn || err == ErrReservationExceeded {
+						return
+					}
+					if err != nil {
+						t.Errorf("capture: %v", err)
+						return
+					}
+					mu.Lock()
+					captures++
+					mu.Unlock()
+				case 1:
+					_, err := env.transactions.StoreCancellationTransaction(ctx, 1, 50, "RUB", 1, 1)
+					if err == ErrTransactionAlreadyCancelled || err == ErrTransactionAlreadyWithdrawn {
+						return
+					}
+					if err != nil {
+						t.Errorf("cancellation: %v", err)
+						return
+					}
+					mu.Lock()
+					cancellations++
+					mu.Unlock()
+				case 2:
+					if _, err := env.transactions.StoreReplenishmentTransaction(ctx, 1, 1, "RUB"); err != nil {
+						t.Errorf("replenishment: %v", err)
+						return
+					}
+					mu.Lock()
+					replenishments++
+					mu.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		reservation, err := env.repos.Transactions.GetServiceTransaction(ctx, 1, 1, 1, repositories.AccountUserReserve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settlement, err := env.repos.Transactions.GetReservationSettlement(ctx, reservation.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if replenishments != 10 {
+			t.Errorf("replenishments = %d, want 10", replenishments)
+		}
+		if settlement.Captured != captures*10 {
+			t.Errorf("captured = %d, want %d by %d captures", settlement.Captured, captures*10, captures)
+		}
+		if cancellations > 1 || (cancellations == 1) != settlement.IsCancelled || (cancellations == 1 && captures > 0) {
+			t.Errorf("cancellations = %d, captures = %d, cancelled = %v", cancellations, captures, settlement.IsCancelled)
+		}
+		if cancellations == 0 && captures != 5 {
+			t.Errorf("captures = %d, want the whole reservation captured by 5", captures)
+		}
+
+		// Replenished 100 and 10 times 1, nothing but captured revenue left the user
+		balance, reserved := env.balance(t, 1)
+		wantReserved := 50 - settlement.Captured
+		if settlement.IsCancelled {
+			wantReserved = 0
+		}
+		if reserved != wantReserved {
+			t.Errorf("reserved = %d, want %d", reserved, wantReserved)
+		}
+		if balance+reserved+settlement.Captured != 110 {
+			t.Errorf("balance %d + reserved %d + captured %d, want 110", balance, reserved, settlement.Captured)
+		}
+		env.assertLedgerConsistent(t)
+	})
+}
+
+// TestConcurrentOppositeTransfers sends money back and forth between two users, which deadlocks
+// unless both users are locked in the same order
+func TestConcurrentOppositeTransfers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, env *testEnv) {
+		ctx := context.Background()
+		env.replenish(t, 1, 100)
+		env.replenish(t, 2, 100)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 40; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				from, to := int64(1), int64(2)
+				if i%2 == 1 {
+					from, to = to, from
+				}
+				_, _, err := env.transactions.StoreTransferTransaction(ctx, from, to, int64(i%7+1), "RUB")
+				if err != nil && err != ErrInsufficientBalance {
+					t.Errorf("transfer %d: %v", i, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		first, _ := env.balance(t, 1)
+		second, _ := env.balance(t, 2)
+		if first < 0 || second < 0 || first+second != 200 {
+			t.Errorf("balances = %d and %d, want 200 in total", first, second)
+		}
+		env.assertLedgerConsistent(t)
+	})
+}
+
+// TestStoreChecksUserLocks makes sure the in-memory store rejects what the single mutex would otherwise hide:
+// accounts changed without a lock of their user and users locked out of order
+func TestStoreChecksUserLocks(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	env.replenish(t, 1, 100)
+	env.replenish(t, 2, 100)
+
+	err := env.store.RunInTransaction(ctx, func(repos repositories.Repositories) error {
+		account, err := repos.Ledger.GetAccount(ctx, repositories.UserMainAccount(1, "RUB"))
+		if err != nil {
+			return err
+		}
+		cash, err := repos.Ledger.GetOrCreateAccount(ctx, repositories.ExternalCashAccount("RUB"))
+		if err != nil {
+			return err
+		}
+
+		return repos.Ledger.StoreJournalEntry(ctx, newJournalEntry(repositories.EntryReplenishment, posting(account, 10), posting(cash, -10)))
+	})
+	if !errors.Is(err, memory.ErrUserNotLocked) {
+		t.Errorf("err = %v, want %v", err, memory.ErrUserNotLocked)
+	}
+
+	err = env.store.RunInTransaction(ctx, func(repos repositories.Repositories) error {
+		if _, err := repos.Users.LockUser(ctx, 2); err != nil {
+			return err
+		}
+		_, err := repos.Users.LockUser(ctx, 1)
+
+		return err
+	})
+	if !errors.Is(err, memory.ErrUserLockOrder) {
+		t.Errorf("err = %v, want %v", err, memory.ErrUserLockOrder)
+	}
+
+	env.assertBalance(t, 1, 100, 0)
+}
@@ -2,14 +2,119 @@ package services
 
 import (
 	"balance-service/repositories"
+	"context"
 	"errors"
-	_ "github.com/lib/pq"
+	"fmt"
+	"log"
+	"sort"
 )
 
 var ErrUserNotExists = errors.New("user does not exists")
 
-func GetUserBalance(userID int64) (*repositories.User, int64, error) {
-	user, err := repositories.GetUser(nil, userID)
+type CurrencyBalance struct {
+	Currency string
+	Balance  int64
+	Reserved int64
+}
+
+type UserService struct {
+	users        repositories.UserRepository
+	transactions repositories.TransactionRepository
+	rates        RatesProvider
+	cache        BalanceCache
+	baseCurrency string
+}
+
+func NewUserService(users repositories.UserRepository, transactions repositories.TransactionRepository, rates RatesProvider, cache BalanceCache, baseCurrency string) *UserService {
+	return &UserService{users: users, transactions: transactions, rates: rates, cache: cache, baseCurrency: baseCurrency}
+}
+
+func (s *UserService) BaseCurrency() string {
+	return s.baseCurrency
+}
+
+// GetUserBalance returns balances and reserves in every currency the user has, the base currency is always present
+func (s *UserService) GetUserBalance(ctx context.Context, userID int64) ([]CurrencyBalance, error) {
+	cached, version, ok, err := s.cache.GetBalances(ctx, userID)
+	if err != nil {
+		log.Println(err)
+	}
+	if ok {
+		return cached, nil
+	}
+
+	user, err := s.users.GetUser(ctx, userID)
+
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotExists
+	}
+
+	balances, err := s.users.GetUserBalances(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	reserved, err := s.transactions.GetUserReservedAmounts(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	byCurrency := map[string]*CurrencyBalance{
+		s.baseCurrency: {Currency: s.baseCurrency},
+	}
+	for _, e := range balances {
+		if _, ok := byCurrency[e.Currency]; !ok {
+			byCurrency[e.Currency] = &CurrencyBalance{Currency: e.Currency}
+		}
+		byCurrency[e.Currency].Balance = e.Balance
+	}
+	for currency, amount := range reserved {
+		if _, ok := byCurrency[currency]; !ok {
+			byCurrency[currency] = &CurrencyBalance{Currency: currency}
+		}
+		byCurrency[currency].Reserved = amount
+	}
+
+	result := make([]CurrencyBalance, 0, len(byCurrency))
+	for _, e := range byCurrency {
+		result = append(result, *e)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Currency < result[j].Currency })
+
+	if err := s.cache.SetBalances(ctx, userID, version, result); err != nil {
+		log.Println(err)
+	}
+
+	return result, nil
+}
+
+// ConvertBalance sums balances and reserves in all currencies converted to the given one
+func (s *UserService) ConvertBalance(ctx context.Context, balances []CurrencyBalance, currency string) (CurrencyBalance, error) {
+	total := CurrencyBalance{Currency: currency}
+
+	for _, e := range balances {
+		balance, err := ConvertAmount(ctx, s.rates, e.Balance, e.Currency, currency)
+		if err != nil {
+			return CurrencyBalance{}, err
+		}
+
+		reserved, err := ConvertAmount(ctx, s.rates, e.Reserved, e.Currency, currency)
+		if err != nil {
+			return CurrencyBalance{}, err
+		}
+
+		total.Balance += balance
+		total.Reserved += reserved
+	}
+
+	return total, nil
+}
+
+func (s *UserService) GetUserTransactions(ctx context.Context, userID int64, sort string, desc bool, limit int, offset int) ([]repositories.TransactionHistoryItem, int64, error) {
+	user, err := s.users.GetUser(ctx, userID)
 
 	if err != nil {
 		return nil, 0, err
@@ -18,10 +123,72 @@ func GetUserBalance(userID int64) (*repositories.User, int64, error) {
 		return nil, 0, ErrUserNotExists
 	}
 
-	reserved, err := repositories.GetUserReservedAmount(nil, userID)
+	transactions, err := s.transactions.GetUserTransactions(ctx, userID, sort, desc, limit, offset)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	return user, reserved, nil
+	total, err := s.transactions.CountUserTransactions(ctx, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return transactions, total, nil
+}
+
+func DescribeTransaction(item repositories.TransactionHistoryItem) string {
+	if item.EntryType == repositories.EntryAdjustment {
+		return "balance adjustment"
+	}
+
+	if item.RelatedUserID.Valid {
+		if item.Amount < 0 {
+			return fmt.Sprintf("transfer to user %d", item.RelatedUserID.Int64)
+		}
+
+		return fmt.Sprintf("transfer from user %d", item.RelatedUserID.Int64)
+	}
+
+	if !item.ServiceID.Valid || !item.OrderID.Valid {
+		return "replenishment"
+	}
+
+	order := fmt.Sprintf("order %d of service %d", item.OrderID.Int64, item.ServiceID.Int64)
+
+	if item.EntryType == repositories.EntryRefund {
+		return "refund for " + order
+	}
+
+	if item.EntryType == repositories.EntryReservationAdjustment && item.IsReserveAccount() {
+		if item.Amount >= 0 {
+			return "reservation increased for " + order
+		}
+
+		return "reservation decreased for " + order
+	}
+
+	if item.EntryType == repositories.EntryExpiration {
+		if item.IsReserveAccount() {
+			return "reservation expired for " + order
+		}
+
+		return "returned from expired reserve for " + order
+	}
+
+	if item.IsReserveAccount() {
+		if item.Amount >= 0 {
+			return "reserved for " + order
+		}
+		if item.IsReleased {
+			return "reservation released for " + order
+		}
+
+		return "revenue recognized for " + order
+	}
+
+	if item.Amount < 0 {
+		return "moved to reserve for " + order
+	}
+
+	return "returned from reserve for " + order
 }
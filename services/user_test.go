@@ -0,0 +1,281 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// staticRatesProvider returns fixed rates by currency pair
+type staticRatesProvider ratesTable
+
+func (p staticRatesProvider) GetRate(_ context.Context, from string, to string) (float64, error) {
+	if rate, ok := ratesTable(p).rate(from, to); ok {
+		return rate, nil
+	}
+
+	return 0, rateUnavailable(from, to, nil)
+}
+
+func TestGetUserBalance(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+
+	if _, err := env.users.GetUserBalance(ctx, 1); err != ErrUserNotExists {
+		t.Fatalf("err = %v, want %v", err, ErrUserNotExists)
+	}
+
+	env.replenish(t, 1, 100)
+	if _, err := env.transactions.StoreReplenishmentTransaction(ctx, 1, 500, "USD"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := env.transactions.StoreReservationTransaction(ctx, 1, 200, "USD", 1, 1, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	balances, err := env.users.GetUserBalance(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CurrencyBalance{
+		{Currency: "RUB", Balance: 100},
+		{Currency: "USD", Balance: 300, Reserved: 200},
+	}
+	if !reflect.DeepEqual(balances, want) {
+		t.Errorf("balances = %+v, want %+v", balances, want)
+	}
+
+	// The base currency is listed even when the user never had it
+	if _, err := env.transactions.StoreReplenishmentTransaction(ctx, 2, 10, "EUR"); err != nil {
+		t.Fatal(err)
+	}
+	balances, err = env.users.GetUserBalance(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []CurrencyBalance{{Currency: "EUR", Balance: 10}, {Currency: "RUB"}}
+	if !reflect.DeepEqual(balances, want) {
+		t.Errorf("balances = %+v, want %+v", balances, want)
+	}
+}
+
+func TestConvertBalance(t *testing.T) {
+	rates := staticRatesProvider{{"USD", "RUB"}: 60, {"JPY", "RUB"}: 0.5}
+	users := NewUserService(nil, nil, rates, NoBalanceCache{}, "RUB")
+
+	tests := []struct {
+		name     string
+		balances []CurrencyBalance
+		currency string
+		want     CurrencyBalance
+		wantErr  error
+	}{
+		{
+			name:     "same currency",
+			balances: []CurrencyBalance{{Currency: "RUB", Balance: 100, Reserved: 10}},
+			currency: "RUB",
+			want:     CurrencyBalance{Currency: "RUB", Balance: 100, Reserved: 10},
+		},
+		{
+			name: "sums converted currencies",
+			balances: []CurrencyBalance{
+				{Currency: "RUB", Balance: 100, Reserved: 10},
+				{Currency: "USD", Balance: 150, Reserved: 50},
+			},
+			currency: "RUB",
+			want:     CurrencyBalance{Currency: "RUB", Balance: 9100, Reserved: 3010},
+		},
+		{
+			name:     "currency without minor units",
+			balances: []CurrencyBalance{{Currency: "JPY", Balance: 3}},
+			currency: "RUB",
+			want:     CurrencyBalance{Currency: "RUB", Balance: 150},
+		},
+		{
+			name:     "inverse rate",
+			balances: []CurrencyBalance{{Currency: "RUB", Balance: 6000}},
+			currency: "USD",
+			want:     CurrencyBalance{Currency: "USD", Balance: 100},
+		},
+		{
+			name:     "unknown rate",
+			balances: []CurrencyBalance{{Currency: "EUR", Balance: 100}},
+			currency: "RUB",
+			wantErr:  ErrRateUnavailable,
+		},
+		{
+			name:     "zero amounts need no rate",
+			balances: []CurrencyBalance{{Currency: "EUR"}},
+			currency: "RUB",
+			want:     CurrencyBalance{Currency: "RUB"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := users.ConvertBalance(context.Background(), tt.balances, tt.currency)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("balance = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetUserTransactions(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+
+	if _, _, err := env.users.GetUserTransactions(ctx, 1, "created_at", false, 10, 0); err != ErrUserNotExists {
+		t.Fatalf("err = %v, want %v", err, ErrUserNotExists)
+	}
+
+	env.replenish(t, 1, 100)
+	env.reserve(t, 1, 40, 1, 1)
+	env.withdraw(t, 1, 30, 1, 1, true)
+	if _, _, err := env.transactions.StoreRefundTransaction(ctx, 1, 5, "RUB", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := env.transactions.StoreTransferTransaction(ctx, 1, 2, 20, "RUB"); err != nil {
+		t.Fatal(err)
+	}
+
+	items, total, err := env.users.GetUserTransactions(ctx, 1, "created_at", false, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != int64(len(items)) {
+		t.Errorf("total = %d, want %d", total, len(items))
+	}
+
+	descriptions := make([]string, 0, len(items))
+	for _, item := range items {
+		descriptions = append(descriptions, DescribeTransaction(item))
+	}
+	want := []string{
+		"replenishment",
+		"moved to reserve for order 1 of service 1",
+		"reserved for order 1 of service 1",
+		"revenue recognized for order 1 of service 1",
+		"reservation released for order 1 of service 1",
+		"returned from reserve for order 1 of service 1",
+		"refund for order 1 of service 1",
+		"transfer to user 2",
+	}
+	if !reflect.DeepEqual(descriptions, want) {
+		t.Errorf("descriptions = %q, want %q", descriptions, want)
+	}
+
+	page, _, err := env.users.GetUserTransactions(ctx, 1, "amount", true, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].Amount < page[1].Amount || page[0].Amount > items[0].Amount {
+		t.Errorf("page = %+v, want the second and third largest amounts", page)
+	}
+}
+
+func TestWriteStatement(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	env.replenish(t, 1, 100)
+
+	from := time.Now()
+	env.reserve(t, 1, 40, 1, 1)
+	env.withdraw(t, 1, 30, 1, 1, true)
+	to := time.Now().Add(time.Second)
+
+	tests := []struct {
+		format string
+		check  func(t *testing.T, output string)
+	}{
+		{
+			format: "csv",
+			check: func(t *testing.T, output string) {
+				lines := strings.Split(strings.TrimSpace(output), "\n")
+				if len(lines) != 5 {
+					t.Fatalf("statement has %d lines, want 5:\n%s", len(lines), output)
+				}
+				if !strings.Contains(lines[1], "opening balance,,100,RUB") {
+					t.Errorf("opening line = %q", lines[1])
+				}
+				if !strings.Contains(lines[2], "moved to reserve for order 1 of service 1,-40,60,RUB") {
+					t.Errorf("reservation line = %q", lines[2])
+				}
+				if !strings.Contains(lines[3], "returned from reserve for order 1 of service 1,10,70,RUB") {
+					t.Errorf("release line = %q", lines[3])
+				}
+				if !strings.Contains(lines[4], "closing balance,,70,RUB") {
+					t.Errorf("closing line = %q", lines[4])
+				}
+			},
+		},
+		{
+			format: "json",
+			check: func(t *testing.T, output string) {
+				var statement struct {
+					OpeningBalance int64 `json:"opening_balance"`
+					ClosingBalance int64 `json:"closing_balance"`
+					Transactions   []struct {
+						Amount  int64 `json:"amount"`
+						Balance int64 `json:"balance"`
+					} `json:"transactions"`
+				}
+				if err := json.Unmarshal([]byte(output), &statement); err != nil {
+					t.Fatalf("statement is not valid JSON: %v\n%s", err, output)
+				}
+				if statement.OpeningBalance != 100 || statement.ClosingBalance != 70 || len(statement.Transactions) != 2 {
+					t.Errorf("statement = %+v", statement)
+				}
+			},
+		},
+		{
+			format: "txt",
+			check: func(t *testing.T, output string) {
+				if !strings.Contains(output, "Opening balance: 100\n") || !strings.Contains(output, "Closing balance: 70\n") {
+					t.Errorf("statement = %s", output)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var output bytes.Buffer
+			w, err := NewStatementWriter(tt.format, &output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := env.users.WriteStatement(ctx, 1, "", from, to, w); err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, output.String())
+		})
+	}
+}
+
+func TestWriteStatementErrors(t *testing.T) {
+	ctx := context.Background()
+	env := newTestEnv(t)
+	env.replenish(t, 1, 100)
+	now := time.Now()
+
+	if _, err := NewStatementWriter("pdf", &bytes.Buffer{}); err != ErrUnsupportedStatementFormat {
+		t.Errorf("err = %v, want %v", err, ErrUnsupportedStatementFormat)
+	}
+
+	w, _ := NewStatementWriter("csv", &bytes.Buffer{})
+	if err := env.users.WriteStatement(ctx, 1, "RUB", now, now, w); err != ErrInvalidStatementPeriod {
+		t.Errorf("err = %v, want %v", err, ErrInvalidStatementPeriod)
+	}
+	if err := env.users.WriteStatement(ctx, 2, "RUB", now, now.Add(time.Hour), w); err != ErrUserNotExists {
+		t.Errorf("err = %v, want %v", err, ErrUserNotExists)
+	}
+}